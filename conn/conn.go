@@ -14,7 +14,8 @@ import (
 
 // A Bind listens on a port for both IPv6 and IPv4 UDP traffic.
 //
-// A Bind interface may also be a PeekLookAtSocketFd or BindSocketToInterface,
+// A Bind interface may also be a PeekLookAtSocketFd, BindSocketToInterface,
+// BatchReceiver, BindSetTOS, BindSendTOS, BindToDevice or BindKernelDrops,
 // depending on the platform-specific implementation.
 type Bind interface {
 	// LastMark reports the last mark set for this Bind.
@@ -50,7 +51,37 @@ type Bind interface {
 // The value actualPort reports the actual port number the Bind
 // object gets bound to.
 func CreateBind(port uint16) (b Bind, actualPort uint16, err error) {
-	return createBind(port)
+	return createBind(port, BindOptions{})
+}
+
+// BindOptions configures the sockets of a Bind.
+type BindOptions struct {
+	// ReusePort allows several Binds to listen on the same port, with the
+	// kernel distributing incoming flows among them. It is only supported
+	// on Linux, where it sets SO_REUSEPORT.
+	ReusePort bool
+
+	// ReceiveBuffer and SendBuffer are the sizes in bytes of the socket
+	// buffers, zero leaving the system defaults. The kernel may clamp them;
+	// on Linux, privileged processes may exceed the system limits.
+	ReceiveBuffer int
+	SendBuffer    int
+
+	// Addr is the local address the sockets are bound to, nil binding
+	// them to any. Packets are then only received on, and sent from,
+	// that address, and only a socket of its family is opened.
+	Addr net.IP
+
+	// GRO lets the kernel coalesce datagrams of the same flow into a single
+	// buffer, which must then be read through GROReceiver. It is only
+	// supported on Linux, where it sets UDP_GRO when the kernel has it.
+	GRO bool
+}
+
+// CreateBindWithOptions creates a Bind bound to a port, like CreateBind,
+// configuring its sockets according to options.
+func CreateBindWithOptions(port uint16, options BindOptions) (b Bind, actualPort uint16, err error) {
+	return createBind(port, options)
 }
 
 // BindSocketToInterface is implemented by Bind objects that support being
@@ -60,6 +91,71 @@ type BindSocketToInterface interface {
 	BindSocketToInterface6(interfaceIndex uint32, blackhole bool) error
 }
 
+// BatchReceiver is implemented by Bind objects that support reading several
+// datagrams with a single system call, such as recvmmsg(2) on Linux.
+//
+// Each method blocks until at least one packet is available and then reads
+// up to len(buffs) packets without blocking further. It reports the number
+// of packets read, n, storing the size and source address of the i-th packet
+// in sizes[i] and eps[i]. The sizes and eps slices must be at least as long
+// as buffs. Calls must not be made concurrently for the same address family.
+type BatchReceiver interface {
+	ReceiveIPv6Batch(buffs [][]byte, sizes []int, eps []Endpoint) (n int, err error)
+	ReceiveIPv4Batch(buffs [][]byte, sizes []int, eps []Endpoint) (n int, err error)
+}
+
+// GROReceiver is implemented by Bind objects that may hand back several
+// datagrams coalesced in one buffer, as UDP_GRO does on Linux.
+//
+// Each method reads like those of BatchReceiver, additionally storing in
+// segs[i] the size of the datagrams coalesced in the i-th buffer, all of
+// which but the last have exactly that size, or zero when the buffer holds
+// a single datagram. The segs slice must be at least as long as buffs.
+//
+// DisableGRO stops the coalescing, so that datagrams may be read one at a
+// time through Bind again.
+type GROReceiver interface {
+	ReceiveIPv6GRO(buffs [][]byte, sizes, segs []int, eps []Endpoint) (n int, err error)
+	ReceiveIPv4GRO(buffs [][]byte, sizes, segs []int, eps []Endpoint) (n int, err error)
+	DisableGRO() error
+}
+
+// BindSetTOS is implemented by Bind objects that support setting the type of
+// service (IPv4) and traffic class (IPv6) byte of the packets they send.
+type BindSetTOS interface {
+	SetTOS(tos uint8) error
+}
+
+// BindSendTOS is implemented by Bind objects that support overriding the type
+// of service (IPv4) or traffic class (IPv6) byte of a single packet.
+type BindSendTOS interface {
+	SendTOS(b []byte, ep Endpoint, tos uint8) error
+}
+
+// BindToDevice is implemented by Bind objects that support restricting their
+// sockets to a single network interface by name, such as SO_BINDTODEVICE on
+// Linux. An empty name removes the restriction.
+type BindToDevice interface {
+	BindToDevice(name string) error
+}
+
+// BindKernelDrops is implemented by Bind objects that learn how many
+// datagrams the kernel dropped before they could be received, as the
+// receive buffers of their sockets were full, such as through SO_RXQ_OVFL
+// on Linux. The kernel reports drops along with the next datagram
+// received, so the count lags behind until then.
+type BindKernelDrops interface {
+	KernelDrops() uint64
+}
+
+// BindBufferSizes is implemented by Bind objects that report the sizes of
+// the buffers the kernel granted their sockets, which may differ from those
+// requested in BindOptions. Linux reports twice the usable size, as it
+// reserves the rest for bookkeeping.
+type BindBufferSizes interface {
+	BufferSizes() (receive, send int, err error)
+}
+
 // PeekLookAtSocketFd is implemented by Bind objects that support having their
 // file descriptor peeked at. Used by wireguard-android.
 type PeekLookAtSocketFd interface {
@@ -8,9 +8,13 @@
 package conn
 
 import (
+	"errors"
 	"net"
 	"os"
 	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 /* This code is meant to be a temporary solution
@@ -31,6 +35,7 @@ type NativeEndpoint net.UDPAddr
 
 var _ Bind = (*nativeBind)(nil)
 var _ Endpoint = (*NativeEndpoint)(nil)
+var _ BindSetTOS = (*nativeBind)(nil)
 
 func CreateEndpoint(s string) (Endpoint, error) {
 	addr, err := parseEndpoint(s)
@@ -49,10 +54,12 @@ func (e *NativeEndpoint) SrcIP() net.IP {
 
 func (e *NativeEndpoint) DstToBytes() []byte {
 	addr := (*net.UDPAddr)(e)
-	out := addr.IP.To4()
-	if out == nil {
-		out = addr.IP
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
 	}
+	out := make([]byte, 0, net.IPv6len+2)
+	out = append(out, ip...)
 	out = append(out, byte(addr.Port&0xff))
 	out = append(out, byte((addr.Port>>8)&0xff))
 	return out
@@ -66,8 +73,8 @@ func (e *NativeEndpoint) SrcToString() string {
 	return ""
 }
 
-func listenNet(network string, port int) (*net.UDPConn, int, error) {
-	conn, err := net.ListenUDP(network, &net.UDPAddr{Port: port})
+func listenNet(network string, addr net.IP, port int) (*net.UDPConn, int, error) {
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: addr, Port: port})
 	if err != nil {
 		return nil, 0, err
 	}
@@ -96,27 +103,85 @@ func extractErrno(err error) error {
 	return syscallErr.Err
 }
 
-func createBind(uport uint16) (Bind, uint16, error) {
+func createBind(uport uint16, options BindOptions) (Bind, uint16, error) {
+	if options.ReusePort {
+		return nil, 0, errors.New("reusing ports is not supported on this platform")
+	}
+
 	var err error
 	var bind nativeBind
+	var newPort int
 
 	port := int(uport)
 
-	bind.ipv4, port, err = listenNet("udp4", port)
-	if err != nil && extractErrno(err) != syscall.EAFNOSUPPORT {
-		return nil, 0, err
+	// A bind to an address only has a socket of its family.
+	addr4 := options.Addr.To4()
+	if options.Addr != nil && addr4 == nil && options.Addr.To16() == nil {
+		return nil, 0, errors.New("invalid local address")
+	}
+
+	// Attempt ipv4 bind, update port if successful.
+	if options.Addr == nil || addr4 != nil {
+		bind.ipv4, newPort, err = listenNet("udp4", addr4, port)
+		if err != nil {
+			if extractErrno(err) != syscall.EAFNOSUPPORT {
+				return nil, 0, err
+			}
+		} else {
+			port = newPort
+		}
 	}
 
-	bind.ipv6, port, err = listenNet("udp6", port)
-	if err != nil && extractErrno(err) != syscall.EAFNOSUPPORT {
-		bind.ipv4.Close()
-		bind.ipv4 = nil
+	// Attempt ipv6 bind on the same port, update port if successful.
+	if options.Addr == nil || addr4 == nil {
+		bind.ipv6, newPort, err = listenNet("udp6", options.Addr, port)
+		if err != nil {
+			if extractErrno(err) != syscall.EAFNOSUPPORT {
+				if bind.ipv4 != nil {
+					bind.ipv4.Close()
+					bind.ipv4 = nil
+				}
+				return nil, 0, err
+			}
+		} else {
+			port = newPort
+		}
+	}
+
+	if bind.ipv4 == nil && bind.ipv6 == nil {
+		if options.Addr != nil {
+			return nil, 0, err
+		}
+		return nil, 0, errors.New("ipv4 and ipv6 not supported")
+	}
+
+	if err := bind.setBufferSizes(options); err != nil {
+		bind.Close()
 		return nil, 0, err
 	}
 
 	return &bind, uint16(port), nil
 }
 
+func (bind *nativeBind) setBufferSizes(options BindOptions) error {
+	for _, conn := range []*net.UDPConn{bind.ipv4, bind.ipv6} {
+		if conn == nil {
+			continue
+		}
+		if options.ReceiveBuffer > 0 {
+			if err := conn.SetReadBuffer(options.ReceiveBuffer); err != nil {
+				return err
+			}
+		}
+		if options.SendBuffer > 0 {
+			if err := conn.SetWriteBuffer(options.SendBuffer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (bind *nativeBind) Close() error {
 	var err1, err2 error
 	if bind.ipv4 != nil {
@@ -133,6 +198,20 @@ func (bind *nativeBind) Close() error {
 
 func (bind *nativeBind) LastMark() uint32 { return 0 }
 
+func (bind *nativeBind) SetTOS(tos uint8) error {
+	if bind.ipv6 != nil {
+		if err := ipv6.NewConn(bind.ipv6).SetTrafficClass(int(tos)); err != nil {
+			return err
+		}
+	}
+	if bind.ipv4 != nil {
+		if err := ipv4.NewConn(bind.ipv4).SetTOS(int(tos)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (bind *nativeBind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
 	if bind.ipv4 == nil {
 		return 0, nil, syscall.EAFNOSUPPORT
@@ -12,6 +12,7 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
@@ -20,6 +21,8 @@ import (
 
 const (
 	FD_ERR = -1
+
+	udpGRO = 0x68 // UDP_GRO of linux/udp.h, since Linux 5.0
 )
 
 type IPv4Source struct {
@@ -60,13 +63,24 @@ func (endpoint *NativeEndpoint) dst6() *unix.SockaddrInet6 {
 }
 
 type nativeBind struct {
+	drops4   kernelDrops // first, for the alignment of atomic counters
+	drops6   kernelDrops
+	closing  int32 // set before the sockets are shut down, accessed atomically
 	sock4    int
 	sock6    int
 	lastMark uint32
+	batch4   receiveBatch // scratch space for ReceiveIPv4Batch
+	batch6   receiveBatch // scratch space for ReceiveIPv6Batch
 }
 
 var _ Endpoint = (*NativeEndpoint)(nil)
 var _ Bind = (*nativeBind)(nil)
+var _ BatchReceiver = (*nativeBind)(nil)
+var _ GROReceiver = (*nativeBind)(nil)
+var _ BindSetTOS = (*nativeBind)(nil)
+var _ BindSendTOS = (*nativeBind)(nil)
+var _ BindKernelDrops = (*nativeBind)(nil)
+var _ BindBufferSizes = (*nativeBind)(nil)
 
 func CreateEndpoint(s string) (Endpoint, error) {
 	var end NativeEndpoint
@@ -103,33 +117,47 @@ func CreateEndpoint(s string) (Endpoint, error) {
 	return nil, errors.New("Invalid IP address")
 }
 
-func createBind(port uint16) (Bind, uint16, error) {
+func createBind(port uint16, options BindOptions) (Bind, uint16, error) {
 	var err error
 	var bind nativeBind
 	var newPort uint16
 
+	// A bind to an address only has a socket of its family.
+	bind.sock4, bind.sock6 = FD_ERR, FD_ERR
+	addr4 := options.Addr.To4()
+	if options.Addr != nil && addr4 == nil && options.Addr.To16() == nil {
+		return nil, 0, errors.New("invalid local address")
+	}
+
 	// Attempt ipv6 bind, update port if successful.
-	bind.sock6, newPort, err = create6(port)
-	if err != nil {
-		if err != syscall.EAFNOSUPPORT {
-			return nil, 0, err
+	if options.Addr == nil || addr4 == nil {
+		bind.sock6, newPort, err = create6(port, options)
+		if err != nil {
+			if err != syscall.EAFNOSUPPORT {
+				return nil, 0, err
+			}
+		} else {
+			port = newPort
 		}
-	} else {
-		port = newPort
 	}
 
 	// Attempt ipv4 bind, update port if successful.
-	bind.sock4, newPort, err = create4(port)
-	if err != nil {
-		if err != syscall.EAFNOSUPPORT {
-			unix.Close(bind.sock6)
-			return nil, 0, err
+	if options.Addr == nil || addr4 != nil {
+		bind.sock4, newPort, err = create4(port, options)
+		if err != nil {
+			if err != syscall.EAFNOSUPPORT {
+				unix.Close(bind.sock6)
+				return nil, 0, err
+			}
+		} else {
+			port = newPort
 		}
-	} else {
-		port = newPort
 	}
 
 	if bind.sock4 == FD_ERR && bind.sock6 == FD_ERR {
+		if options.Addr != nil {
+			return nil, 0, err
+		}
 		return nil, 0, errors.New("ipv4 and ipv6 not supported")
 	}
 
@@ -178,6 +206,7 @@ func closeUnblock(fd int) error {
 }
 
 func (bind *nativeBind) Close() error {
+	atomic.StoreInt32(&bind.closing, 1)
 	var err1, err2 error
 	if bind.sock6 != -1 {
 		err1 = closeUnblock(bind.sock6)
@@ -192,6 +221,13 @@ func (bind *nativeBind) Close() error {
 	return err2
 }
 
+/* Reports whether the bind is being closed, when reads from its sockets,
+ * which are shut down, return empty datagrams rather than failing
+ */
+func (bind *nativeBind) isClosing() bool {
+	return atomic.LoadInt32(&bind.closing) != 0
+}
+
 func (bind *nativeBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
 	var end NativeEndpoint
 	if bind.sock6 == -1 {
@@ -201,7 +237,11 @@ func (bind *nativeBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
 		bind.sock6,
 		buff,
 		&end,
+		&bind.drops6,
 	)
+	if n == 0 && bind.isClosing() {
+		return 0, nil, unix.EBADF
+	}
 	return n, &end, err
 }
 
@@ -214,23 +254,142 @@ func (bind *nativeBind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
 		bind.sock4,
 		buff,
 		&end,
+		&bind.drops4,
 	)
+	if n == 0 && bind.isClosing() {
+		return 0, nil, unix.EBADF
+	}
 	return n, &end, err
 }
 
+func (bind *nativeBind) ReceiveIPv6Batch(buffs [][]byte, sizes []int, eps []Endpoint) (int, error) {
+	return bind.ReceiveIPv6GRO(buffs, sizes, nil, eps)
+}
+
+func (bind *nativeBind) ReceiveIPv4Batch(buffs [][]byte, sizes []int, eps []Endpoint) (int, error) {
+	return bind.ReceiveIPv4GRO(buffs, sizes, nil, eps)
+}
+
+func (bind *nativeBind) ReceiveIPv6GRO(buffs [][]byte, sizes, segs []int, eps []Endpoint) (int, error) {
+	if bind.sock6 == -1 {
+		return 0, syscall.EAFNOSUPPORT
+	}
+	n, err := bind.batch6.receive6(bind.sock6, buffs, sizes, segs, eps, &bind.drops6)
+	if n > 0 && sizes[0] == 0 && bind.isClosing() {
+		return 0, unix.EBADF
+	}
+	return n, err
+}
+
+func (bind *nativeBind) ReceiveIPv4GRO(buffs [][]byte, sizes, segs []int, eps []Endpoint) (int, error) {
+	if bind.sock4 == -1 {
+		return 0, syscall.EAFNOSUPPORT
+	}
+	n, err := bind.batch4.receive4(bind.sock4, buffs, sizes, segs, eps, &bind.drops4)
+	if n > 0 && sizes[0] == 0 && bind.isClosing() {
+		return 0, unix.EBADF
+	}
+	return n, err
+}
+
+func (bind *nativeBind) DisableGRO() error {
+	for _, fd := range []int{bind.sock4, bind.sock6} {
+		if fd == -1 {
+			continue
+		}
+		err := unix.SetsockoptInt(fd, unix.SOL_UDP, udpGRO, 0)
+		if err != nil && err != unix.ENOPROTOOPT { // never enabled by older kernels
+			return err
+		}
+	}
+	return nil
+}
+
+func (bind *nativeBind) KernelDrops() uint64 {
+	return bind.drops4.total() + bind.drops6.total()
+}
+
 func (bind *nativeBind) Send(buff []byte, end Endpoint) error {
+	return bind.send(buff, end, -1)
+}
+
+func (bind *nativeBind) SendTOS(buff []byte, end Endpoint, tos uint8) error {
+	return bind.send(buff, end, int(tos))
+}
+
+func (bind *nativeBind) send(buff []byte, end Endpoint, tos int) error {
 	nend := end.(*NativeEndpoint)
 	if !nend.isV6 {
 		if bind.sock4 == -1 {
 			return syscall.EAFNOSUPPORT
 		}
-		return send4(bind.sock4, nend, buff)
+		return send4(bind.sock4, nend, buff, tos)
 	} else {
 		if bind.sock6 == -1 {
 			return syscall.EAFNOSUPPORT
 		}
-		return send6(bind.sock6, nend, buff)
+		return send6(bind.sock6, nend, buff, tos)
+	}
+}
+
+func (bind *nativeBind) BindToDevice(name string) error {
+	if bind.sock6 != -1 {
+		err := unix.SetsockoptString(
+			bind.sock6,
+			unix.SOL_SOCKET,
+			unix.SO_BINDTODEVICE,
+			name,
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if bind.sock4 != -1 {
+		err := unix.SetsockoptString(
+			bind.sock4,
+			unix.SOL_SOCKET,
+			unix.SO_BINDTODEVICE,
+			name,
+		)
+
+		if err != nil {
+			return err
+		}
 	}
+
+	return nil
+}
+
+func (bind *nativeBind) SetTOS(tos uint8) error {
+	if bind.sock6 != -1 {
+		err := unix.SetsockoptInt(
+			bind.sock6,
+			unix.IPPROTO_IPV6,
+			unix.IPV6_TCLASS,
+			int(tos),
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if bind.sock4 != -1 {
+		err := unix.SetsockoptInt(
+			bind.sock4,
+			unix.IPPROTO_IP,
+			unix.IP_TOS,
+			int(tos),
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (end *NativeEndpoint) SrcIP() net.IP {
@@ -305,7 +464,49 @@ func zoneToUint32(zone string) (uint32, error) {
 	return uint32(n), err
 }
 
-func create4(port uint16) (int, uint16, error) {
+/* Sets the sizes of the socket buffers requested, beyond the system
+ * limits when permitted to (CAP_NET_ADMIN)
+ */
+func setBufferSizes(fd int, options BindOptions) error {
+	buffers := []struct {
+		size  int
+		force int
+		opt   int
+	}{
+		{options.ReceiveBuffer, unix.SO_RCVBUFFORCE, unix.SO_RCVBUF},
+		{options.SendBuffer, unix.SO_SNDBUFFORCE, unix.SO_SNDBUF},
+	}
+	for _, buffer := range buffers {
+		if buffer.size <= 0 {
+			continue
+		}
+		if unix.SetsockoptInt(fd, unix.SOL_SOCKET, buffer.force, buffer.size) == nil {
+			continue
+		}
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, buffer.opt, buffer.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bind *nativeBind) BufferSizes() (receive, send int, err error) {
+	fd := bind.sock4
+	if fd == -1 {
+		fd = bind.sock6
+	}
+	receive, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF)
+	if err != nil {
+		return 0, 0, err
+	}
+	send, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF)
+	if err != nil {
+		return 0, 0, err
+	}
+	return receive, send, nil
+}
+
+func create4(port uint16, options BindOptions) (int, uint16, error) {
 
 	// create socket
 
@@ -322,6 +523,7 @@ func create4(port uint16) (int, uint16, error) {
 	addr := unix.SockaddrInet4{
 		Port: int(port),
 	}
+	copy(addr.Addr[:], options.Addr.To4())
 
 	// set sockopts and bind
 
@@ -335,6 +537,21 @@ func create4(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		if options.ReusePort {
+			if err := unix.SetsockoptInt(
+				fd,
+				unix.SOL_SOCKET,
+				unix.SO_REUSEPORT,
+				1,
+			); err != nil {
+				return err
+			}
+		}
+
+		if err := setBufferSizes(fd, options); err != nil {
+			return err
+		}
+
 		if err := unix.SetsockoptInt(
 			fd,
 			unix.IPPROTO_IP,
@@ -344,6 +561,26 @@ func create4(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		// counting kernel drops is merely informative
+
+		unix.SetsockoptInt(
+			fd,
+			unix.SOL_SOCKET,
+			unix.SO_RXQ_OVFL,
+			1,
+		)
+
+		// older kernels merely do without coalescing
+
+		if options.GRO {
+			unix.SetsockoptInt(
+				fd,
+				unix.SOL_UDP,
+				udpGRO,
+				1,
+			)
+		}
+
 		return unix.Bind(fd, &addr)
 	}(); err != nil {
 		unix.Close(fd)
@@ -358,7 +595,7 @@ func create4(port uint16) (int, uint16, error) {
 	return fd, uint16(addr.Port), err
 }
 
-func create6(port uint16) (int, uint16, error) {
+func create6(port uint16, options BindOptions) (int, uint16, error) {
 
 	// create socket
 
@@ -377,6 +614,9 @@ func create6(port uint16) (int, uint16, error) {
 	addr := unix.SockaddrInet6{
 		Port: int(port),
 	}
+	if options.Addr != nil {
+		copy(addr.Addr[:], options.Addr.To16())
+	}
 
 	if err := func() error {
 
@@ -389,6 +629,21 @@ func create6(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		if options.ReusePort {
+			if err := unix.SetsockoptInt(
+				fd,
+				unix.SOL_SOCKET,
+				unix.SO_REUSEPORT,
+				1,
+			); err != nil {
+				return err
+			}
+		}
+
+		if err := setBufferSizes(fd, options); err != nil {
+			return err
+		}
+
 		if err := unix.SetsockoptInt(
 			fd,
 			unix.IPPROTO_IPV6,
@@ -398,6 +653,26 @@ func create6(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		// counting kernel drops is merely informative
+
+		unix.SetsockoptInt(
+			fd,
+			unix.SOL_SOCKET,
+			unix.SO_RXQ_OVFL,
+			1,
+		)
+
+		// older kernels merely do without coalescing
+
+		if options.GRO {
+			unix.SetsockoptInt(
+				fd,
+				unix.SOL_UDP,
+				udpGRO,
+				1,
+			)
+		}
+
 		if err := unix.SetsockoptInt(
 			fd,
 			unix.IPPROTO_IPV6,
@@ -422,13 +697,15 @@ func create6(port uint16) (int, uint16, error) {
 	return fd, uint16(addr.Port), err
 }
 
-func send4(sock int, end *NativeEndpoint, buff []byte) error {
+func send4(sock int, end *NativeEndpoint, buff []byte, tos int) error {
 
 	// construct message header
 
 	cmsg := struct {
 		cmsghdr unix.Cmsghdr
 		pktinfo unix.Inet4Pktinfo
+		toshdr  unix.Cmsghdr
+		tos     int32
 	}{
 		unix.Cmsghdr{
 			Level: unix.IPPROTO_IP,
@@ -439,10 +716,23 @@ func send4(sock int, end *NativeEndpoint, buff []byte) error {
 			Spec_dst: end.src4().Src,
 			Ifindex:  end.src4().Ifindex,
 		},
+		unix.Cmsghdr{
+			Level: unix.IPPROTO_IP,
+			Type:  unix.IP_TOS,
+			Len:   4 + unix.SizeofCmsghdr,
+		},
+		int32(tos),
+	}
+
+	// only override the type of service when requested
+
+	oob := (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:]
+	if tos < 0 {
+		oob = oob[:unsafe.Offsetof(cmsg.toshdr)]
 	}
 
 	end.Lock()
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
+	_, err := unix.SendmsgN(sock, buff, oob, end.dst4(), 0)
 	end.Unlock()
 
 	if err == nil {
@@ -455,20 +745,22 @@ func send4(sock int, end *NativeEndpoint, buff []byte) error {
 		end.ClearSrc()
 		cmsg.pktinfo = unix.Inet4Pktinfo{}
 		end.Lock()
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
+		_, err = unix.SendmsgN(sock, buff, oob, end.dst4(), 0)
 		end.Unlock()
 	}
 
 	return err
 }
 
-func send6(sock int, end *NativeEndpoint, buff []byte) error {
+func send6(sock int, end *NativeEndpoint, buff []byte, tclass int) error {
 
 	// construct message header
 
 	cmsg := struct {
-		cmsghdr unix.Cmsghdr
-		pktinfo unix.Inet6Pktinfo
+		cmsghdr   unix.Cmsghdr
+		pktinfo   unix.Inet6Pktinfo
+		tclasshdr unix.Cmsghdr
+		tclass    int32
 	}{
 		unix.Cmsghdr{
 			Level: unix.IPPROTO_IPV6,
@@ -479,14 +771,27 @@ func send6(sock int, end *NativeEndpoint, buff []byte) error {
 			Addr:    end.src6().src,
 			Ifindex: end.dst6().ZoneId,
 		},
+		unix.Cmsghdr{
+			Level: unix.IPPROTO_IPV6,
+			Type:  unix.IPV6_TCLASS,
+			Len:   4 + unix.SizeofCmsghdr,
+		},
+		int32(tclass),
 	}
 
 	if cmsg.pktinfo.Addr == [16]byte{} {
 		cmsg.pktinfo.Ifindex = 0
 	}
 
+	// only override the traffic class when requested
+
+	oob := (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:]
+	if tclass < 0 {
+		oob = oob[:unsafe.Offsetof(cmsg.tclasshdr)]
+	}
+
 	end.Lock()
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
+	_, err := unix.SendmsgN(sock, buff, oob, end.dst6(), 0)
 	end.Unlock()
 
 	if err == nil {
@@ -499,23 +804,20 @@ func send6(sock int, end *NativeEndpoint, buff []byte) error {
 		end.ClearSrc()
 		cmsg.pktinfo = unix.Inet6Pktinfo{}
 		end.Lock()
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
+		_, err = unix.SendmsgN(sock, buff, oob, end.dst6(), 0)
 		end.Unlock()
 	}
 
 	return err
 }
 
-func receive4(sock int, buff []byte, end *NativeEndpoint) (int, error) {
+func receive4(sock int, buff []byte, end *NativeEndpoint, drops *kernelDrops) (int, error) {
 
 	// construct message header
 
-	var cmsg struct {
-		cmsghdr unix.Cmsghdr
-		pktinfo unix.Inet4Pktinfo
-	}
+	var control receiveControl
 
-	size, _, _, newDst, err := unix.Recvmsg(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], 0)
+	size, oobn, _, newDst, err := unix.Recvmsg(sock, buff, control.bytes(), 0)
 
 	if err != nil {
 		return 0, err
@@ -528,26 +830,18 @@ func receive4(sock int, buff []byte, end *NativeEndpoint) (int, error) {
 
 	// update source cache
 
-	if cmsg.cmsghdr.Level == unix.IPPROTO_IP &&
-		cmsg.cmsghdr.Type == unix.IP_PKTINFO &&
-		cmsg.cmsghdr.Len >= unix.SizeofInet4Pktinfo {
-		end.src4().Src = cmsg.pktinfo.Spec_dst
-		end.src4().Ifindex = cmsg.pktinfo.Ifindex
-	}
+	parseControl4(control.bytes()[:oobn], end, drops)
 
 	return size, nil
 }
 
-func receive6(sock int, buff []byte, end *NativeEndpoint) (int, error) {
+func receive6(sock int, buff []byte, end *NativeEndpoint, drops *kernelDrops) (int, error) {
 
 	// construct message header
 
-	var cmsg struct {
-		cmsghdr unix.Cmsghdr
-		pktinfo unix.Inet6Pktinfo
-	}
+	var control receiveControl
 
-	size, _, _, newDst, err := unix.Recvmsg(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], 0)
+	size, oobn, _, newDst, err := unix.Recvmsg(sock, buff, control.bytes(), 0)
 
 	if err != nil {
 		return 0, err
@@ -560,12 +854,234 @@ func receive6(sock int, buff []byte, end *NativeEndpoint) (int, error) {
 
 	// update source cache
 
-	if cmsg.cmsghdr.Level == unix.IPPROTO_IPV6 &&
-		cmsg.cmsghdr.Type == unix.IPV6_PKTINFO &&
-		cmsg.cmsghdr.Len >= unix.SizeofInet6Pktinfo {
-		end.src6().src = cmsg.pktinfo.Addr
-		end.dst6().ZoneId = cmsg.pktinfo.Ifindex
-	}
+	parseControl6(control.bytes()[:oobn], end, drops)
 
 	return size, nil
 }
+
+/* Storage for the control messages received along with a datagram
+ *
+ * The kernel places the drop counter of SO_RXQ_OVFL and the segment size
+ * of UDP_GRO, when there are, before the packet info, so the messages are
+ * walked rather than read at fixed offsets.
+ */
+type receiveControl struct {
+	ovflhdr unix.Cmsghdr
+	ovfl    uint64 // uint32, padded to the alignment of headers
+	grohdr  unix.Cmsghdr
+	gro     uint64 // int, padded to the alignment of headers
+	cmsghdr unix.Cmsghdr
+	pktinfo unix.Inet6Pktinfo // large enough for either address family
+}
+
+func (control *receiveControl) bytes() []byte {
+	return (*[unsafe.Sizeof(*control)]byte)(unsafe.Pointer(control))[:]
+}
+
+/* Returns the data of the next control message in oob and the messages
+ * following it, or a nil header when there is none
+ */
+func nextControl(oob []byte) (*unix.Cmsghdr, []byte, []byte) {
+	if len(oob) < unix.SizeofCmsghdr {
+		return nil, nil, nil
+	}
+	hdr := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	if int(hdr.Len) < unix.CmsgLen(0) || int(hdr.Len) > len(oob) {
+		return nil, nil, nil
+	}
+	data := oob[unix.CmsgLen(0):hdr.Len]
+	next := unix.CmsgSpace(len(data))
+	if next > len(oob) {
+		next = len(oob)
+	}
+	return hdr, data, oob[next:]
+}
+
+func parseControl4(oob []byte, end *NativeEndpoint, drops *kernelDrops) (segment int) {
+	for hdr, data, rest := nextControl(oob); hdr != nil; hdr, data, rest = nextControl(rest) {
+		switch {
+		case hdr.Level == unix.IPPROTO_IP && hdr.Type == unix.IP_PKTINFO && len(data) >= unix.SizeofInet4Pktinfo:
+			pktinfo := (*unix.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+			end.src4().Src = pktinfo.Spec_dst
+			end.src4().Ifindex = pktinfo.Ifindex
+		case hdr.Level == unix.SOL_SOCKET && hdr.Type == unix.SO_RXQ_OVFL && len(data) >= 4:
+			drops.update(*(*uint32)(unsafe.Pointer(&data[0])))
+		case hdr.Level == unix.SOL_UDP && hdr.Type == udpGRO && len(data) >= 4:
+			segment = int(*(*int32)(unsafe.Pointer(&data[0])))
+		}
+	}
+	return segment
+}
+
+func parseControl6(oob []byte, end *NativeEndpoint, drops *kernelDrops) (segment int) {
+	for hdr, data, rest := nextControl(oob); hdr != nil; hdr, data, rest = nextControl(rest) {
+		switch {
+		case hdr.Level == unix.IPPROTO_IPV6 && hdr.Type == unix.IPV6_PKTINFO && len(data) >= unix.SizeofInet6Pktinfo:
+			pktinfo := (*unix.Inet6Pktinfo)(unsafe.Pointer(&data[0]))
+			end.src6().src = pktinfo.Addr
+			end.dst6().ZoneId = pktinfo.Ifindex
+		case hdr.Level == unix.SOL_SOCKET && hdr.Type == unix.SO_RXQ_OVFL && len(data) >= 4:
+			drops.update(*(*uint32)(unsafe.Pointer(&data[0])))
+		case hdr.Level == unix.SOL_UDP && hdr.Type == udpGRO && len(data) >= 4:
+			segment = int(*(*int32)(unsafe.Pointer(&data[0])))
+		}
+	}
+	return segment
+}
+
+/* Counts the datagrams dropped by the kernel for a socket
+ *
+ * SO_RXQ_OVFL reports the number of drops since the socket was opened as
+ * a wrapping 32 bit counter; only the routine receiving from the socket
+ * updates it, while the total may be read from anywhere.
+ */
+type kernelDrops struct {
+	dropped uint64 // accessed atomically
+	last    uint32
+	_       uint32 // keeps dropped aligned in arrays and structs
+}
+
+func (drops *kernelDrops) update(counter uint32) {
+	atomic.AddUint64(&drops.dropped, uint64(counter-drops.last))
+	drops.last = counter
+}
+
+func (drops *kernelDrops) total() uint64 {
+	return atomic.LoadUint64(&drops.dropped)
+}
+
+/* Batched reception using recvmmsg(2)
+ *
+ * The message headers, addresses and control messages are kept
+ * between calls, so that reading a batch does not allocate
+ * beyond the endpoints handed back to the caller.
+ */
+
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+type receiveBatch struct {
+	msgs  []mmsghdr
+	iovs  []unix.Iovec
+	names []unix.RawSockaddrInet6 // large enough for either address family
+	cmsgs []receiveControl
+}
+
+func (batch *receiveBatch) prepare(buffs [][]byte) []mmsghdr {
+	if len(batch.msgs) < len(buffs) {
+		batch.msgs = make([]mmsghdr, len(buffs))
+		batch.iovs = make([]unix.Iovec, len(buffs))
+		batch.names = make([]unix.RawSockaddrInet6, len(buffs))
+		batch.cmsgs = make([]receiveControl, len(buffs))
+	}
+
+	for i, buff := range buffs {
+		iov := &batch.iovs[i]
+		iov.Base = &buff[0]
+		iov.SetLen(len(buff))
+
+		hdr := &batch.msgs[i].hdr
+		hdr.Name = (*byte)(unsafe.Pointer(&batch.names[i]))
+		hdr.Namelen = unix.SizeofSockaddrInet6
+		hdr.Iov = iov
+		hdr.SetIovlen(1)
+		hdr.Control = (*byte)(unsafe.Pointer(&batch.cmsgs[i]))
+		hdr.SetControllen(int(unsafe.Sizeof(batch.cmsgs[i])))
+		hdr.Flags = 0
+		batch.msgs[i].len = 0
+	}
+
+	return batch.msgs[:len(buffs)]
+}
+
+func recvmmsg(sock int, msgs []mmsghdr) (int, error) {
+	n, _, errno := unix.Syscall6(
+		unix.SYS_RECVMMSG,
+		uintptr(sock),
+		uintptr(unsafe.Pointer(&msgs[0])),
+		uintptr(len(msgs)),
+		unix.MSG_WAITFORONE,
+		0,
+		0,
+	)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+func sockaddrPort(port *uint16) int {
+	p := (*[2]byte)(unsafe.Pointer(port))
+	return int(p[0])<<8 + int(p[1])
+}
+
+func (batch *receiveBatch) receive4(sock int, buffs [][]byte, sizes, segs []int, eps []Endpoint, drops *kernelDrops) (int, error) {
+	if len(buffs) == 0 {
+		return 0, nil
+	}
+
+	msgs := batch.prepare(buffs)
+	n, err := recvmmsg(sock, msgs)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < n; i++ {
+		end := new(NativeEndpoint)
+		end.isV6 = false
+
+		name := (*unix.RawSockaddrInet4)(unsafe.Pointer(&batch.names[i]))
+		end.dst4().Port = sockaddrPort(&name.Port)
+		end.dst4().Addr = name.Addr
+
+		// update source cache
+
+		control := &batch.cmsgs[i]
+		segment := parseControl4(control.bytes()[:msgs[i].hdr.Controllen], end, drops)
+
+		sizes[i] = int(msgs[i].len)
+		if segs != nil {
+			segs[i] = segment
+		}
+		eps[i] = end
+	}
+
+	return n, nil
+}
+
+func (batch *receiveBatch) receive6(sock int, buffs [][]byte, sizes, segs []int, eps []Endpoint, drops *kernelDrops) (int, error) {
+	if len(buffs) == 0 {
+		return 0, nil
+	}
+
+	msgs := batch.prepare(buffs)
+	n, err := recvmmsg(sock, msgs)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < n; i++ {
+		end := new(NativeEndpoint)
+		end.isV6 = true
+
+		name := &batch.names[i]
+		end.dst6().Port = sockaddrPort(&name.Port)
+		end.dst6().ZoneId = name.Scope_id
+		end.dst6().Addr = name.Addr
+
+		// update source cache
+
+		control := &batch.cmsgs[i]
+		segment := parseControl6(control.bytes()[:msgs[i].hdr.Controllen], end, drops)
+
+		sizes[i] = int(msgs[i].len)
+		if segs != nil {
+			segs[i] = segment
+		}
+		eps[i] = end
+	}
+
+	return n, nil
+}
@@ -7,6 +7,11 @@
 
 package conn
 
+import "errors"
+
 func (bind *nativeBind) SetMark(mark uint32) error {
+	if mark != 0 {
+		return errors.New("fwmark is not supported on this platform")
+	}
 	return nil
 }
@@ -0,0 +1,137 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// A PacketConnEndpoint is the address of a peer from which a datagram was
+// received through a Bind created by CreatePacketConnBind.
+//
+// A conn carrying both address families may report IPv4 sources as
+// IPv4-mapped IPv6 addresses. The endpoint presents those as plain IPv4
+// addresses, so that they compare equal to the same source reported
+// either way and to endpoints created from IPv4 addresses.
+type PacketConnEndpoint struct {
+	addr net.Addr
+}
+
+// Addr returns the address as the net.PacketConn reported it.
+func (e *PacketConnEndpoint) Addr() net.Addr {
+	return e.addr
+}
+
+// udpAddr returns the address with an IPv4-mapped IP address unmapped.
+func (e *PacketConnEndpoint) udpAddr() (*net.UDPAddr, bool) {
+	addr, ok := e.addr.(*net.UDPAddr)
+	if !ok {
+		return nil, false
+	}
+	if ip4 := addr.IP.To4(); ip4 != nil && len(addr.IP) != net.IPv4len {
+		return &net.UDPAddr{IP: ip4, Port: addr.Port}, true
+	}
+	return addr, true
+}
+
+func (_ *PacketConnEndpoint) ClearSrc() {}
+
+func (e *PacketConnEndpoint) DstIP() net.IP {
+	addr, ok := e.udpAddr()
+	if !ok {
+		return nil
+	}
+	return addr.IP
+}
+
+func (e *PacketConnEndpoint) SrcIP() net.IP {
+	return nil // not supported
+}
+
+func (e *PacketConnEndpoint) DstToBytes() []byte {
+	addr, ok := e.udpAddr()
+	if !ok {
+		return []byte(e.addr.String())
+	}
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	out := make([]byte, 0, net.IPv6len+2)
+	out = append(out, ip...)
+	out = append(out, byte(addr.Port&0xff))
+	out = append(out, byte((addr.Port>>8)&0xff))
+	return out
+}
+
+func (e *PacketConnEndpoint) DstToString() string {
+	if addr, ok := e.udpAddr(); ok {
+		return addr.String()
+	}
+	return e.addr.String()
+}
+
+func (e *PacketConnEndpoint) SrcToString() string {
+	return ""
+}
+
+// packetConnBind carries datagrams over a net.PacketConn supplied by the
+// caller, such as one of a userspace network stack. The conn carries both
+// address families, so all datagrams are received through ReceiveIPv4.
+type packetConnBind struct {
+	conn net.PacketConn
+}
+
+// CreatePacketConnBind creates a Bind sending and receiving through conn,
+// which the Bind owns and closes. Endpoints not received through the Bind,
+// such as those of CreateEndpoint, must be UDP addresses.
+func CreatePacketConnBind(conn net.PacketConn) Bind {
+	return &packetConnBind{conn: conn}
+}
+
+func (bind *packetConnBind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
+	n, addr, err := bind.conn.ReadFrom(buff)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, &PacketConnEndpoint{addr: addr}, nil
+}
+
+func (bind *packetConnBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
+	return 0, nil, syscall.EAFNOSUPPORT
+}
+
+func (bind *packetConnBind) Send(buff []byte, endpoint Endpoint) error {
+	var addr net.Addr
+	if pend, ok := endpoint.(*PacketConnEndpoint); ok {
+		addr = pend.addr
+	} else {
+		udpAddr, err := net.ResolveUDPAddr("udp", endpoint.DstToString())
+		if err != nil {
+			return err
+		}
+		addr = udpAddr
+	}
+	_, err := bind.conn.WriteTo(buff, addr)
+	return err
+}
+
+func (bind *packetConnBind) Close() error {
+	return bind.conn.Close()
+}
+
+func (bind *packetConnBind) LastMark() uint32 {
+	return 0
+}
+
+func (bind *packetConnBind) SetMark(mark uint32) error {
+	if mark != 0 {
+		return errors.New("fwmark is not supported on a packet conn")
+	}
+	return nil
+}
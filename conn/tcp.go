@@ -0,0 +1,356 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TCPEndpointPrefix marks the string form of a TCPEndpoint.
+const TCPEndpointPrefix = "tcp://"
+
+const (
+	tcpFrameHeaderSize = 2 // big endian length of the message
+	tcpMaxFrameSize    = 1<<16 - 1
+	tcpDialTimeout     = 5 * time.Second
+	tcpWriteTimeout    = 5 * time.Second
+	tcpReadTimeout     = 5 * time.Second // to read the rest of a message once its header arrived
+	tcpIdleTimeout     = 5 * time.Minute // after which a connection without messages is closed
+	tcpFirstTimeout    = 5 * time.Second // to read the first message on an accepted connection
+	tcpMaxConns        = 1024            // connections accepted or dialed at once
+	tcpMaxConnsPerIP   = 8               // connections open at once with a single remote address
+)
+
+var (
+	errTCPBindClosed = errors.New("tcp bind closed")
+	errTCPConnsLimit = errors.New("too many tcp connections")
+)
+
+// A TCPEndpoint is the address of a peer reached over TCP, for networks
+// which block UDP. Its string form carries TCPEndpointPrefix.
+type TCPEndpoint net.TCPAddr
+
+// CreateTCPEndpoint creates an endpoint reaching the IP address and port s
+// over TCP. The TCPEndpointPrefix of s is optional.
+func CreateTCPEndpoint(s string) (Endpoint, error) {
+	addr, err := parseEndpoint(strings.TrimPrefix(s, TCPEndpointPrefix))
+	if err != nil {
+		return nil, err
+	}
+	return &TCPEndpoint{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}, nil
+}
+
+func tcpEndpointFromAddr(addr *net.TCPAddr) *TCPEndpoint {
+	endpoint := &TCPEndpoint{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		endpoint.IP = ip4
+	}
+	return endpoint
+}
+
+func (_ *TCPEndpoint) ClearSrc() {}
+
+func (e *TCPEndpoint) DstIP() net.IP {
+	return e.IP
+}
+
+func (e *TCPEndpoint) SrcIP() net.IP {
+	return nil // not supported
+}
+
+func (e *TCPEndpoint) DstToBytes() []byte {
+	ip := e.IP.To4()
+	if ip == nil {
+		ip = e.IP.To16()
+	}
+	out := make([]byte, 0, net.IPv6len+2)
+	out = append(out, ip...)
+	out = append(out, byte(e.Port&0xff))
+	out = append(out, byte((e.Port>>8)&0xff))
+	return out
+}
+
+func (e *TCPEndpoint) DstToString() string {
+	return TCPEndpointPrefix + (*net.TCPAddr)(e).String()
+}
+
+func (e *TCPEndpoint) SrcToString() string {
+	return ""
+}
+
+func (e *TCPEndpoint) key() string {
+	return (*net.TCPAddr)(e).String()
+}
+
+type tcpPacket struct {
+	data     []byte
+	endpoint *TCPEndpoint
+}
+
+type tcpConn struct {
+	sync.Mutex // serializes writes
+	conn       *net.TCPConn
+}
+
+// tcpBind carries messages over TCP, each preceded by its length as a
+// 16 bit big endian integer. It accepts connections on its port and dials
+// endpoints it has no connection to in the background; messages arriving
+// on any connection are received as if they were datagrams from the
+// remote address. Connections idle for tcpIdleTimeout are closed, and at
+// most tcpMaxConns are open at once, tcpMaxConnsPerIP of which with the
+// same remote IP address; accepted connections not sending a first
+// message within tcpFirstTimeout are closed, so that no single host ties
+// them all up.
+type tcpBind struct {
+	listener *net.TCPListener
+	dialer   net.Dialer
+	ipv4     chan tcpPacket
+	ipv6     chan tcpPacket
+	closing  chan struct{}
+
+	mutex  sync.Mutex
+	conns  map[string]*tcpConn // by remote address
+	ips    map[string]int      // number of connections, by remote IP address
+	dials  map[string][]byte   // latest message to send, by remote address being dialed
+	closed bool
+}
+
+// CreateTCPBind creates a Bind exchanging messages over TCP connections,
+// listening for them on a TCP port.
+//
+// The value actualPort reports the actual port number the Bind
+// object gets bound to.
+func CreateTCPBind(port uint16) (b Bind, actualPort uint16, err error) {
+	return CreateTCPBindWithOptions(port, BindOptions{})
+}
+
+// CreateTCPBindWithOptions creates a Bind exchanging messages over TCP
+// connections, like CreateTCPBind, listening on and dialing from the local
+// address of options, if any; its other options do not apply to TCP.
+func CreateTCPBindWithOptions(port uint16, options BindOptions) (b Bind, actualPort uint16, err error) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: options.Addr, Port: int(port)})
+	if err != nil {
+		return nil, 0, err
+	}
+	bind := &tcpBind{
+		listener: listener,
+		dialer:   net.Dialer{Timeout: tcpDialTimeout},
+		ipv4:     make(chan tcpPacket),
+		ipv6:     make(chan tcpPacket),
+		closing:  make(chan struct{}),
+		conns:    make(map[string]*tcpConn),
+		ips:      make(map[string]int),
+		dials:    make(map[string][]byte),
+	}
+	if options.Addr != nil {
+		bind.dialer.LocalAddr = &net.TCPAddr{IP: options.Addr}
+	}
+	go bind.accept()
+	return bind, uint16(listener.Addr().(*net.TCPAddr).Port), nil
+}
+
+func (bind *tcpBind) accept() {
+	for {
+		conn, err := bind.listener.AcceptTCP()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		if _, err := bind.add(conn, tcpFirstTimeout); err != nil {
+			conn.Close()
+		}
+	}
+}
+
+// add registers a connection, replacing any previous one to the same
+// address, and starts reading messages from it, the first of which is
+// to arrive within firstTimeout.
+func (bind *tcpBind) add(conn *net.TCPConn, firstTimeout time.Duration) (*tcpConn, error) {
+	endpoint := tcpEndpointFromAddr(conn.RemoteAddr().(*net.TCPAddr))
+	tc := &tcpConn{conn: conn}
+
+	bind.mutex.Lock()
+	if bind.closed {
+		bind.mutex.Unlock()
+		return nil, errTCPBindClosed
+	}
+	if old, ok := bind.conns[endpoint.key()]; ok {
+		old.conn.Close()
+	} else if len(bind.conns) >= tcpMaxConns || bind.ips[endpoint.IP.String()] >= tcpMaxConnsPerIP {
+		bind.mutex.Unlock()
+		return nil, errTCPConnsLimit
+	} else {
+		bind.ips[endpoint.IP.String()]++
+	}
+	bind.conns[endpoint.key()] = tc
+	bind.mutex.Unlock()
+
+	go bind.read(tc, endpoint, firstTimeout)
+	return tc, nil
+}
+
+func (bind *tcpBind) remove(tc *tcpConn, endpoint *TCPEndpoint) {
+	bind.mutex.Lock()
+	if bind.conns[endpoint.key()] == tc {
+		delete(bind.conns, endpoint.key())
+		ip := endpoint.IP.String()
+		bind.ips[ip]--
+		if bind.ips[ip] == 0 {
+			delete(bind.ips, ip)
+		}
+	}
+	bind.mutex.Unlock()
+	tc.conn.Close()
+}
+
+func (bind *tcpBind) read(tc *tcpConn, endpoint *TCPEndpoint, firstTimeout time.Duration) {
+	defer bind.remove(tc, endpoint)
+
+	queue := bind.ipv6
+	if endpoint.IP.To4() != nil {
+		queue = bind.ipv4
+	}
+
+	var header [tcpFrameHeaderSize]byte
+	for timeout := firstTimeout; ; timeout = tcpIdleTimeout {
+		tc.conn.SetReadDeadline(time.Now().Add(timeout))
+		if _, err := io.ReadFull(tc.conn, header[:]); err != nil {
+			return
+		}
+		size := binary.BigEndian.Uint16(header[:])
+		if size == 0 {
+			return
+		}
+		data := make([]byte, size)
+		tc.conn.SetReadDeadline(time.Now().Add(tcpReadTimeout))
+		if _, err := io.ReadFull(tc.conn, data); err != nil {
+			return
+		}
+		select {
+		case queue <- tcpPacket{data: data, endpoint: endpoint}:
+		case <-bind.closing:
+			return
+		}
+	}
+}
+
+func (bind *tcpBind) receive(queue chan tcpPacket, buff []byte) (int, Endpoint, error) {
+	select {
+	case packet := <-queue:
+		return copy(buff, packet.data), packet.endpoint, nil
+	case <-bind.closing:
+		return 0, nil, errTCPBindClosed
+	}
+}
+
+func (bind *tcpBind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
+	return bind.receive(bind.ipv4, buff)
+}
+
+func (bind *tcpBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
+	return bind.receive(bind.ipv6, buff)
+}
+
+func (bind *tcpBind) Send(buff []byte, endpoint Endpoint) error {
+	nend, ok := endpoint.(*TCPEndpoint)
+	if !ok {
+		return errors.New("not a tcp endpoint")
+	}
+	if len(buff) == 0 || len(buff) > tcpMaxFrameSize {
+		return errors.New("message size not supported over tcp")
+	}
+
+	bind.mutex.Lock()
+	if bind.closed {
+		bind.mutex.Unlock()
+		return errTCPBindClosed
+	}
+	tc, ok := bind.conns[nend.key()]
+
+	// connect in the background, unless the peer already did, keeping
+	// the latest message to send once connected
+
+	if !ok {
+		_, dialing := bind.dials[nend.key()]
+		bind.dials[nend.key()] = append([]byte(nil), buff...)
+		bind.mutex.Unlock()
+		if !dialing {
+			go bind.dial(nend)
+		}
+		return nil
+	}
+	bind.mutex.Unlock()
+	return bind.write(tc, buff)
+}
+
+// dial connects to the endpoint and sends the message which was kept
+// for it, if any.
+func (bind *tcpBind) dial(endpoint *TCPEndpoint) {
+	conn, err := bind.dialer.Dial("tcp", endpoint.key())
+	var tc *tcpConn
+	if err == nil {
+		tc, err = bind.add(conn.(*net.TCPConn), tcpIdleTimeout)
+		if err != nil {
+			conn.Close()
+		}
+	}
+
+	bind.mutex.Lock()
+	pending := bind.dials[endpoint.key()]
+	delete(bind.dials, endpoint.key())
+	bind.mutex.Unlock()
+	if err == nil {
+		bind.write(tc, pending)
+	}
+}
+
+func (bind *tcpBind) write(tc *tcpConn, buff []byte) error {
+	var header [tcpFrameHeaderSize]byte
+	binary.BigEndian.PutUint16(header[:], uint16(len(buff)))
+	buffers := net.Buffers{header[:], buff}
+
+	tc.Lock()
+	defer tc.Unlock()
+	tc.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	if _, err := buffers.WriteTo(tc.conn); err != nil {
+		tc.conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (bind *tcpBind) Close() error {
+	bind.mutex.Lock()
+	defer bind.mutex.Unlock()
+	if bind.closed {
+		return nil
+	}
+	bind.closed = true
+	close(bind.closing)
+	for _, tc := range bind.conns {
+		tc.conn.Close()
+	}
+	return bind.listener.Close()
+}
+
+func (bind *tcpBind) LastMark() uint32 {
+	return 0
+}
+
+func (bind *tcpBind) SetMark(mark uint32) error {
+	if mark != 0 {
+		return errors.New("fwmark is not supported over tcp")
+	}
+	return nil
+}
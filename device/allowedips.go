@@ -192,6 +192,36 @@ func (node *trieEntry) entriesForPeer(p *Peer, results []net.IPNet) []net.IPNet
 	return results
 }
 
+/* Routes packets to peers by the addresses inside them
+ *
+ * Outbound packets are sent to the peer their destination is routed to,
+ * and inbound packets are only accepted if their source is routed to the
+ * peer they came from. AllowedIPs, an in-memory trie, is the default;
+ * another table, such as one kept in sync with the routing table of the
+ * kernel, can be given in DeviceOptions. Lookups happen for every packet
+ * from many routines at once, so a table must be safe for concurrent use.
+ *
+ * Replace swaps in a whole configuration, as applied by ApplyConfig:
+ * a lookup sees either all of the old entries or all of the new ones.
+ */
+type AllowedIPsTable interface {
+	Insert(ip net.IP, cidr uint, peer *Peer)
+	RemoveByPeer(peer *Peer)
+	Reset()
+	Replace(entries []AllowedIPsEntry)
+	LookupIPv4(address []byte) *Peer
+	LookupIPv6(address []byte) *Peer
+	EntriesForPeer(peer *Peer) []net.IPNet
+}
+
+var _ AllowedIPsTable = (*AllowedIPs)(nil)
+
+type AllowedIPsEntry struct {
+	IP   net.IP
+	CIDR uint
+	Peer *Peer
+}
+
 type AllowedIPs struct {
 	IPv4  *trieEntry
 	IPv6  *trieEntry
@@ -216,6 +246,19 @@ func (table *AllowedIPs) Reset() {
 	table.IPv6 = nil
 }
 
+func (table *AllowedIPs) Replace(entries []AllowedIPsEntry) {
+	var fresh AllowedIPs
+	for _, entry := range entries {
+		fresh.Insert(entry.IP, entry.CIDR, entry.Peer)
+	}
+
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	table.IPv4 = fresh.IPv4
+	table.IPv6 = fresh.IPv6
+}
+
 func (table *AllowedIPs) RemoveByPeer(peer *Peer) {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
@@ -0,0 +1,35 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+)
+
+type clockHolder struct {
+	now func() time.Time
+}
+
+/* Returns the current time of the clock protocol timers are measured
+ * against, such as the age of keypairs
+ */
+func (device *Device) now() time.Time {
+	return device.clock.Load().(clockHolder).now()
+}
+
+/* Replaces the clock of the protocol timers, nil restoring time.Now
+ *
+ * Times of time.Now carry a monotonic reading, which already makes the
+ * timers immune to jumps of the wall clock; another clock mostly serves
+ * tests, which can advance it at will. As keypairs are dated by the clock
+ * when created, it should be replaced before the device is up.
+ */
+func (device *Device) SetClock(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	device.clock.Store(clockHolder{now})
+}
@@ -0,0 +1,145 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* The complete set of peers of a device, see ApplyConfig
+ */
+type Config struct {
+	Peers []PeerConfig
+}
+
+type PeerConfig struct {
+	PublicKey           NoisePublicKey
+	PresharedKey        NoiseSymmetricKey
+	Endpoint            conn.Endpoint // nil keeps the current endpoint of an existing peer
+	AllowedIPs          []net.IPNet
+	PersistentKeepalive uint16 // seconds, zero disables
+	Timeouts            PeerTimeouts
+	PinEndpoint         bool // see Peer.SetEndpointPinned
+}
+
+/* Replaces the peers of the device by those of the config in one step:
+ * peers missing from the config are removed, new ones are added and the
+ * others are updated, their allowed IPs being replaced
+ *
+ * The config is validated before anything changes, so an invalid one
+ * leaves the device untouched. The new routing table is built aside and
+ * swapped in together with the peer map, while both are locked, so the
+ * receive and send routines never observe a partially applied config.
+ */
+func (device *Device) ApplyConfig(config Config) error {
+	if device.isClosed.Get() {
+		return errors.New("device closed")
+	}
+
+	// validate
+
+	if len(config.Peers) > MaxPeers {
+		return errors.New("too many peers")
+	}
+	networks := make([][]allowedIP, len(config.Peers))
+	seen := make(map[NoisePublicKey]bool, len(config.Peers))
+	for i, peerConfig := range config.Peers {
+		if seen[peerConfig.PublicKey] {
+			return fmt.Errorf("duplicate peer: %x", peerConfig.PublicKey[:])
+		}
+		seen[peerConfig.PublicKey] = true
+		var err error
+		networks[i], err = parseAllowedIPs(peerConfig.AllowedIPs)
+		if err != nil {
+			return err
+		}
+		if err := peerConfig.Timeouts.validate(device.HandshakeTimeout()); err != nil {
+			return err
+		}
+	}
+
+	// lock resources
+
+	device.staticIdentity.RLock()
+	defer device.staticIdentity.RUnlock()
+
+	device.peers.Lock()
+	defer device.peers.Unlock()
+
+	// a peer with the key of the device itself is ignored, as over UAPI
+
+	for i, peerConfig := range config.Peers {
+		if peerConfig.PublicKey.Equals(device.staticIdentity.publicKey) {
+			config.Peers = append(config.Peers[:i:i], config.Peers[i+1:]...)
+			networks = append(networks[:i:i], networks[i+1:]...)
+			break
+		}
+	}
+
+	// build the new peer map and routing table aside
+
+	keyMap := make(map[NoisePublicKey]*Peer, len(config.Peers))
+	var added []*Peer
+	var entries []AllowedIPsEntry
+	for i, peerConfig := range config.Peers {
+		peer, ok := device.peers.keyMap[peerConfig.PublicKey]
+		if !ok {
+			peer = unsafeNewPeer(device, peerConfig.PublicKey)
+			added = append(added, peer)
+		}
+		keyMap[peerConfig.PublicKey] = peer
+		for _, network := range networks[i] {
+			entries = append(entries, AllowedIPsEntry{IP: network.ip, CIDR: network.cidr, Peer: peer})
+		}
+	}
+
+	// update peers
+
+	for _, peerConfig := range config.Peers {
+		peer := keyMap[peerConfig.PublicKey]
+		peer.SetPresharedKey(peerConfig.PresharedKey)
+		peer.timeouts.Store(peerConfig.Timeouts)
+		peer.SetEndpointPinned(peerConfig.PinEndpoint)
+		if peerConfig.Endpoint != nil {
+			peer.Lock()
+			peer.endpoint = peerConfig.Endpoint
+			peer.Unlock()
+			peer.clearEndpointHost()
+		}
+	}
+
+	// swap in
+
+	device.allowedips.Replace(entries)
+
+	removed := device.peers.keyMap
+	device.peers.keyMap = keyMap
+
+	// stop removed peers and start new ones
+
+	for key, peer := range removed {
+		if _, ok := keyMap[key]; !ok {
+			peer.Stop()
+		}
+	}
+	if device.isUp.Get() {
+		for _, peer := range added {
+			peer.Start()
+		}
+	}
+
+	// keepalives are sent only once started
+
+	for _, peerConfig := range config.Peers {
+		keyMap[peerConfig.PublicKey].SetPersistentKeepaliveInterval(peerConfig.PersistentKeepalive)
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestApplyConfigOwnKey(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	own, other := device.staticIdentity.publicKey, sk.publicKey()
+
+	err = device.ApplyConfig(Config{Peers: []PeerConfig{{PublicKey: own}, {PublicKey: other}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.LookupPeer(own) != nil {
+		t.Fatal("peer added with the key of the device itself")
+	}
+	if device.LookupPeer(other) == nil {
+		t.Fatal("other peer not added")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	device.Up()
+
+	keys := make([]NoisePublicKey, 3)
+	for i := range keys {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = sk.publicKey()
+	}
+	network := func(s string) net.IPNet {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *network
+	}
+	endpoint, err := conn.CreateEndpoint("192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = device.ApplyConfig(Config{Peers: []PeerConfig{
+		{PublicKey: keys[0], AllowedIPs: []net.IPNet{network("10.0.0.0/24")}},
+		{PublicKey: keys[1], AllowedIPs: []net.IPNet{network("10.0.1.0/24")}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer0, peer1 := device.LookupPeer(keys[0]), device.LookupPeer(keys[1])
+	if peer0 == nil || peer1 == nil || !peer0.isRunning.Get() || !peer1.isRunning.Get() {
+		t.Fatal("configured peers not added and started")
+	}
+
+	// an invalid config changes nothing
+
+	invalid := network("10.0.2.0/24")
+	invalid.IP = invalid.IP[:2]
+	err = device.ApplyConfig(Config{Peers: []PeerConfig{
+		{PublicKey: keys[2], AllowedIPs: []net.IPNet{network("10.0.3.0/24")}},
+		{PublicKey: keys[0], AllowedIPs: []net.IPNet{invalid}},
+	}})
+	if err == nil {
+		t.Fatal("applied config with invalid allowed ip")
+	}
+	if err := device.ApplyConfig(Config{Peers: []PeerConfig{{PublicKey: keys[0]}, {PublicKey: keys[0]}}}); err == nil {
+		t.Fatal("applied config with duplicate peer")
+	}
+	if device.LookupPeer(keys[2]) != nil || device.allowedips.LookupIPv4(net.IPv4(10, 0, 1, 1).To4()) != peer1 {
+		t.Fatal("invalid config was partially applied")
+	}
+
+	// remove, update and add in one step
+
+	err = device.ApplyConfig(Config{Peers: []PeerConfig{
+		{PublicKey: keys[0], Endpoint: endpoint, AllowedIPs: []net.IPNet{network("10.0.4.0/24")}},
+		{PublicKey: keys[2], AllowedIPs: []net.IPNet{network("10.0.1.0/24")}, PersistentKeepalive: 25},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer2 := device.LookupPeer(keys[2])
+	if device.LookupPeer(keys[0]) != peer0 || device.LookupPeer(keys[1]) != nil || peer2 == nil {
+		t.Fatal("peers not replaced")
+	}
+	if peer1.isRunning.Get() || !peer2.isRunning.Get() {
+		t.Fatal("removed peer still running or added peer not started")
+	}
+	if peer2.PersistentKeepaliveInterval() != 25 {
+		t.Fatal("persistent keepalive not set")
+	}
+	peer0.RLock()
+	if peer0.endpoint != endpoint {
+		t.Error("endpoint not updated")
+	}
+	peer0.RUnlock()
+
+	lookups := []struct {
+		ip   net.IP
+		peer *Peer
+	}{
+		{net.IPv4(10, 0, 0, 1), nil},
+		{net.IPv4(10, 0, 4, 1), peer0},
+		{net.IPv4(10, 0, 1, 1), peer2},
+	}
+	for _, lookup := range lookups {
+		if peer := device.allowedips.LookupIPv4(lookup.ip.To4()); peer != lookup.peer {
+			t.Errorf("%v routed to the wrong peer", lookup.ip)
+		}
+	}
+}
+
+type testAllowedIPs struct {
+	lookups int64 // accessed atomically, must stay 64-bit aligned
+	*AllowedIPs
+}
+
+func (table *testAllowedIPs) LookupIPv4(address []byte) *Peer {
+	atomic.AddInt64(&table.lookups, 1)
+	return table.AllowedIPs.LookupIPv4(address)
+}
+
+func TestAllowedIPsTable(t *testing.T) {
+	table := &testAllowedIPs{AllowedIPs: new(AllowedIPs)}
+	tun := tuntest.NewChannelTUN()
+	device, err := NewDeviceWithOptions(tun.TUN(), NewLogger(LogLevelError, ""), DeviceOptions{AllowedIPs: table})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	err = device.ApplyConfig(Config{Peers: []PeerConfig{
+		{PublicKey: sk.publicKey(), AllowedIPs: []net.IPNet{*network}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := device.LookupPeer(sk.publicKey())
+	if table.AllowedIPs.LookupIPv4(net.IPv4(10, 0, 0, 1).To4()) != peer {
+		t.Fatal("config not applied to the table")
+	}
+
+	// outbound packets are routed through the table
+
+	device.Up()
+	tun.Outbound <- tuntest.Ping(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.1.1"))
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&table.lookups) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("outbound packet not routed through the table")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
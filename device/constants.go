@@ -17,7 +17,6 @@ const (
 	RekeyAfterTime          = time.Second * 120
 	RekeyAttemptTime        = time.Second * 90
 	RekeyTimeout            = time.Second * 5
-	MaxTimerHandshakes      = 90 / 5 /* RekeyAttemptTime / RekeyTimeout */
 	RekeyTimeoutJitterMaxMs = 334
 	RejectAfterTime         = time.Second * 180
 	KeepaliveTimeout        = time.Second * 10
@@ -35,7 +34,43 @@ const (
 /* Implementation constants */
 
 const (
-	UnderLoadQueueSize = QueueHandshakeSize / 8
-	UnderLoadAfterTime = time.Second // how long does the device remain under load after detected
-	MaxPeers           = 1 << 16     // maximum number of configured peers
+	UnderLoadQueueSize      = QueueHandshakeSize / 8
+	UnderLoadHandshakeRate  = 1000        // handshake messages per second before the device is under load
+	UnderLoadAfterTime      = time.Second // how long does the device remain under load after detected
+	MaxPeers                = 1 << 16     // maximum number of configured peers
+	DefaultReceiveBatchSize = 32          // datagrams read per system call, where supported
+	DefaultReplayWindowSize = 8128        // counters accepted behind the latest, alike on every word size
+)
+
+const (
+	HandshakeEventQueueSize   = 64              // handshake events buffered for a slow consumer
+	DefaultDisconnectTimeout  = RejectAfterTime // silence after which a peer is considered disconnected
+	EndpointResolveInterval   = time.Minute     // how often endpoints given as host names are resolved
+	PersistentKeepaliveJitter = time.Second * 2 // largest advance of persistent keepalives on their interval
+	DefaultRoamingHoldTime    = time.Second * 3 // least time between endpoint changes of a peer by roaming
+)
+
+const (
+	DecryptFailureAlarmThreshold = 64               // consecutive decryption failures raising the alarm
+	DecryptFailureAlarmWindow    = time.Second * 10 // time within which they must occur
+)
+
+const (
+	receiveBackoffMin = time.Millisecond * 5   // first pause after a transient receive error
+	receiveBackoffMax = time.Millisecond * 500 // longest pause between failing receives
+)
+
+const (
+	bindReopenBackoffMin = time.Millisecond * 100 // first pause after failing to reopen the sockets
+	bindReopenBackoffMax = time.Second * 30       // longest pause between attempts to reopen the sockets
+	rateSampleInterval   = time.Second            // how often moving averages of rates are updated
+	rateAverageWeight    = 0.2                    // weight of the latest sample in moving averages
+	cookieSecretGrace    = RekeyTimeout           // previous cookie secret remains valid this long after rotation
+	logLimitInterval     = time.Second * 5        // interval in which repeated log messages are limited
+	logLimitBurst        = 5                      // messages with the same template logged per interval
+	tunWriteRetries      = 4                      // retries of a write to a busy TUN device
+	tunWriteBackoffMin   = time.Microsecond * 500 // first pause before retrying a write to the TUN device
+	indexSweepInterval   = time.Minute            // how often indices of rejected keypairs are reaped
+	selfTestTimeout      = time.Second * 5        // longest wait for a packet of the self-test
+	peerTimeoutMin       = time.Second            // shortest override of a timer of a peer
 )
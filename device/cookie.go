@@ -23,6 +23,8 @@ type CookieChecker struct {
 	mac2 struct {
 		secret        [blake2s.Size]byte
 		secretSet     time.Time
+		previous      [blake2s.Size]byte // secret before the last rotation
+		hasPrevious   bool
 		encryptionKey [chacha20poly1305.KeySize]byte
 	}
 }
@@ -64,6 +66,7 @@ func (st *CookieChecker) Init(pk NoisePublicKey) {
 	}()
 
 	st.mac2.secretSet = time.Time{}
+	st.mac2.hasPrevious = false
 }
 
 func (st *CookieChecker) CheckMAC1(msg []byte) bool {
@@ -90,12 +93,24 @@ func (st *CookieChecker) CheckMAC2(msg []byte, src []byte) bool {
 	if time.Since(st.mac2.secretSet) > CookieRefreshTime {
 		return false
 	}
+	if checkMAC2(&st.mac2.secret, msg, src) {
+		return true
+	}
+
+	// cookies issued just before the last rotation remain valid for a while
+
+	return st.mac2.hasPrevious &&
+		time.Since(st.mac2.secretSet) <= cookieSecretGrace &&
+		checkMAC2(&st.mac2.previous, msg, src)
+}
+
+func checkMAC2(secret *[blake2s.Size]byte, msg []byte, src []byte) bool {
 
 	// derive cookie key
 
 	var cookie [blake2s.Size128]byte
 	func() {
-		mac, _ := blake2s.New128(st.mac2.secret[:])
+		mac, _ := blake2s.New128(secret[:])
 		mac.Write(src)
 		mac.Sum(cookie[:0])
 	}()
@@ -127,12 +142,12 @@ func (st *CookieChecker) CreateReply(
 	if time.Since(st.mac2.secretSet) > CookieRefreshTime {
 		st.RUnlock()
 		st.Lock()
-		_, err := rand.Read(st.mac2.secret[:])
-		if err != nil {
-			st.Unlock()
-			return nil, err
+		if time.Since(st.mac2.secretSet) > CookieRefreshTime {
+			if err := st.unsafeRotateSecret(); err != nil {
+				st.Unlock()
+				return nil, err
+			}
 		}
-		st.mac2.secretSet = time.Now()
 		st.Unlock()
 		st.RLock()
 	}
@@ -171,6 +186,59 @@ func (st *CookieChecker) CreateReply(
 	return reply, nil
 }
 
+/* Replaces the secret from which cookies are derived
+ *
+ * Holding the lock excludes cookie replies being created meanwhile, and
+ * the previous secret is still accepted for a grace period, in case a
+ * cookie derived from it was just sent.
+ */
+func (st *CookieChecker) RotateSecret() error {
+	st.Lock()
+	defer st.Unlock()
+	return st.unsafeRotateSecret()
+}
+
+func (st *CookieChecker) unsafeRotateSecret() error {
+	var secret [blake2s.Size]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return err
+	}
+	st.mac2.previous = st.mac2.secret
+	st.mac2.hasPrevious = time.Since(st.mac2.secretSet) <= CookieRefreshTime
+	st.mac2.secret = secret
+	st.mac2.secretSet = time.Now()
+	return nil
+}
+
+func (device *Device) RoutineRotateCookieSecret() {
+	logDebug := device.log.Debug
+
+	ticker := time.NewTicker(CookieRefreshTime)
+	defer func() {
+		ticker.Stop()
+		logDebug.Println("Routine: cookie secret rotation - stopped")
+		device.state.stopping.Done()
+	}()
+
+	beat := device.startHeartbeat("cookie secret rotation", nil)
+	defer device.stopHeartbeat(beat)
+
+	logDebug.Println("Routine: cookie secret rotation - started")
+	device.state.starting.Done()
+
+	for {
+		select {
+		case <-ticker.C:
+			beat.beat()
+			if err := device.cookieChecker.RotateSecret(); err != nil {
+				device.log.Error.Println("Failed to rotate cookie secret:", err)
+			}
+		case <-device.signals.stop:
+			return
+		}
+	}
+}
+
 func (st *CookieGenerator) Init(pk NoisePublicKey) {
 	st.Lock()
 	defer st.Unlock()
@@ -6,7 +6,14 @@
 package device
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 func TestCookieMAC1(t *testing.T) {
@@ -189,3 +196,151 @@ func TestCookieMAC1(t *testing.T) {
 		0x7d, 0xa1, 0xd5, 0x85, 0x6d, 0xf0, 0x1b, 0xaa,
 	})
 }
+
+func TestCookieSecretRotation(t *testing.T) {
+	var (
+		generator CookieGenerator
+		checker   CookieChecker
+	)
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+
+	generator.Init(pk)
+	checker.Init(pk)
+
+	src := []byte{192, 168, 13, 37, 10, 10, 10}
+	msg := make([]byte, MessageInitiationSize)
+	if _, err := rand.Read(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	exchangeCookie := func() {
+		generator.AddMacs(msg)
+		reply, err := checker.CreateReply(msg, 1377, src)
+		if err != nil {
+			t.Fatal("Failed to create cookie reply:", err)
+		}
+		if !generator.ConsumeReply(reply) {
+			t.Fatal("Failed to consume cookie reply")
+		}
+		generator.AddMacs(msg)
+	}
+
+	// a cookie issued just before rotation is accepted for a grace period
+
+	exchangeCookie()
+	if err := checker.RotateSecret(); err != nil {
+		t.Fatal(err)
+	}
+	if !checker.CheckMAC2(msg, src) {
+		t.Fatal("cookie rejected right after rotation")
+	}
+
+	checker.mac2.secretSet = time.Now().Add(-cookieSecretGrace - time.Second)
+	if checker.CheckMAC2(msg, src) {
+		t.Fatal("cookie of previous secret accepted after grace period")
+	}
+
+	// a cookie of the new secret is accepted
+
+	exchangeCookie()
+	if !checker.CheckMAC2(msg, src) {
+		t.Fatal("cookie of current secret rejected")
+	}
+
+	// only the secret before the last rotation is kept
+
+	checker.RotateSecret()
+	checker.RotateSecret()
+	if checker.CheckMAC2(msg, src) {
+		t.Fatal("cookie accepted after two rotations")
+	}
+}
+
+// TestCookieReplyWireFormat builds and opens cookie replies as the protocol
+// specifies, independently of the checker and generator: the cookie is
+// sealed with XChaCha20Poly1305 under HASH(LABEL_COOKIE || Spub), with a
+// 24 byte nonce and the mac1 of the message answered as additional data.
+func TestCookieReplyWireFormat(t *testing.T) {
+	var (
+		generator CookieGenerator
+		checker   CookieChecker
+	)
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	generator.Init(pk)
+	checker.Init(pk)
+
+	key := blake2s.Sum256(append([]byte(WGLabelCookie), pk[:]...))
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := []byte{192, 168, 13, 37, 10, 10, 10}
+	msg := make([]byte, MessageInitiationSize)
+	if _, err := rand.Read(msg); err != nil {
+		t.Fatal(err)
+	}
+	generator.AddMacs(msg)
+	smac2 := len(msg) - blake2s.Size128
+	smac1 := smac2 - blake2s.Size128
+	mac1 := msg[smac1:smac2]
+
+	// a reply built by hand is consumed, and mac2 is keyed by its cookie
+
+	var nonce [chacha20poly1305.NonceSizeX]byte
+	for i := range nonce {
+		nonce[i] = byte(i)
+	}
+	cookie := [blake2s.Size128]byte{0xc0, 0x0c, 0x1e}
+	packet := make([]byte, 8, MessageCookieReplySize)
+	binary.LittleEndian.PutUint32(packet[0:], MessageCookieReplyType)
+	binary.LittleEndian.PutUint32(packet[4:], 1377)
+	packet = append(packet, nonce[:]...)
+	packet = aead.Seal(packet, nonce[:], cookie[:], mac1)
+
+	reply, err := ParseCookieReply(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !generator.ConsumeReply(&reply) {
+		t.Fatal("cookie reply built to the specification rejected")
+	}
+	generator.AddMacs(msg)
+	mac, _ := blake2s.New128(cookie[:])
+	mac.Write(msg[:smac2])
+	if !bytes.Equal(mac.Sum(nil), msg[smac2:]) {
+		t.Fatal("mac2 not keyed by the cookie of the reply")
+	}
+
+	// a reply created by the checker opens to the cookie of the source
+
+	created, err := checker.CreateReply(msg, 1377, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, created)
+	packet = buffer.Bytes()
+	if len(packet) != MessageCookieReplySize || binary.LittleEndian.Uint32(packet[4:8]) != 1377 {
+		t.Fatal("cookie reply header not laid out as specified")
+	}
+	opened, err := aead.Open(nil, packet[8:32], packet[32:], mac1)
+	if err != nil {
+		t.Fatal("cookie reply not sealed as specified:", err)
+	}
+	mac, _ = blake2s.New128(checker.mac2.secret[:])
+	mac.Write(src)
+	if !bytes.Equal(opened, mac.Sum(nil)) {
+		t.Fatal("cookie reply does not carry the cookie of the source")
+	}
+}
@@ -6,6 +6,9 @@
 package device
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -20,9 +23,36 @@ import (
 )
 
 type Device struct {
-	isUp     AtomicBool // device is (going) up
-	isClosed AtomicBool // device is closed? (acting as guard)
-	log      *Logger
+
+	// These fields are accessed with atomic operations, which must be
+	// 64-bit aligned even on 32-bit platforms, hence they come first.
+	stats struct {
+		rxOversized       uint64                  // decrypted packets exceeding the MTU
+		drops             [dropReasonCount]uint64 // received packets dropped, by reason
+		initiations       rateAverage             // handshake initiations queued per second
+		eventsDropped     uint64                  // handshake events not delivered, as the channel was full
+		tunWriteExhausted uint64                  // packets dropped as the TUN device stayed busy
+		tunWriteFailed    uint64                  // packets dropped as writing to the TUN device failed
+		kernelDrops       uint64                  // datagrams the kernel dropped for binds since closed
+		indicesReaped     uint64                  // indices of rejected keypairs deleted by the sweeper
+		cookiesAccepted   uint64                  // cookie replies which updated the cookie of a peer
+		cookiesRejected   uint64                  // cookie replies undecodable, for unknown indices or undecryptable
+		forwarded         uint64                  // decrypted packets forwarded to another peer in transit mode
+	}
+
+	isUp       AtomicBool // device is (going) up
+	isClosed   AtomicBool // device is closed? (acting as guard)
+	transit    AtomicBool // forward packets between peers, see SetTransit
+	log        *Logger
+	sink       atomic.Value // logSinkHolder
+	logLimiter logLimiter
+	alarm      atomic.Value // DecryptFailureAlarm
+	exporter   atomic.Value // metricsHolder
+	clock      atomic.Value // clockHolder
+	roaming    atomic.Value // time.Duration, see SetRoamingHoldTime
+	options    DeviceOptions
+	given      DeviceOptions
+	checksums  uint32 // ChecksumValidation, accessed atomically
 
 	// synchronized resources (locks acquired in order)
 
@@ -38,10 +68,20 @@ type Device struct {
 		starting sync.WaitGroup
 		stopping sync.WaitGroup
 		sync.RWMutex
-		bind          conn.Bind // bind interface
+		bind          conn.Bind   // bind interface
+		extraBinds    []conn.Bind // further binds receiving on the same port
 		netlinkCancel *rwcancel.RWCancel
-		port          uint16 // listening port
-		fwmark        uint32 // mark value (0 = disabled)
+		port          uint16     // listening port
+		fwmark        uint32     // mark value (0 = disabled)
+		tos           uint8      // type of service value (0 = default)
+		iface         string     // interface the sockets are bound to ("" = any)
+		addr          net.IP     // local address the sockets are bound to (nil = any)
+		inheritDSCP   AtomicBool // copy DSCP of inner packets onto outer packets
+		batchSize     int        // datagrams read per system call
+		sockets       int        // binds receiving on the listening port
+		tcp           bool       // also carry messages over TCP
+		tcpBind       conn.Bind  // bind listening on TCP (nil = disabled)
+		generation    uint64     // bumped whenever the binds are reconfigured
 	}
 
 	staticIdentity struct {
@@ -57,13 +97,18 @@ type Device struct {
 
 	// unprotected / "self-synchronising resources"
 
-	allowedips    AllowedIPs
+	allowedips    AllowedIPsTable
 	indexTable    IndexTable
 	cookieChecker CookieChecker
 
 	rate struct {
-		underLoadUntil atomic.Value
-		limiter        ratelimiter.Ratelimiter
+		underLoadUntil     atomic.Value
+		thresholds         atomic.Value // UnderLoadThresholds
+		cookiePolicy       uint32       // CookiePolicy, accessed atomically
+		handshakes         rateMeter
+		limiter            ratelimiter.Ratelimiter
+		cookieReplyLimiter ratelimiter.Ratelimiter
+		icmpLimiter        ratelimiter.Ratelimiter
 	}
 
 	pool struct {
@@ -79,15 +124,29 @@ type Device struct {
 		encryption chan *QueueOutboundElement
 		decryption chan *QueueInboundElement
 		handshake  chan QueueHandshakeElement
+		tunWriters []chan *QueueInboundElement // by flow, if writing in parallel
+		overflow   uint32                      // HandshakeQueuePolicy, accessed atomically
 	}
 
 	signals struct {
 		stop chan struct{}
 	}
 
+	events struct {
+		handshakes       chan HandshakeEvent
+		handshakeTimeout atomic.Value // time.Duration
+	}
+
 	tun struct {
-		device tun.Device
-		mtu    int32
+		sync.RWMutex
+		device          tun.Device // replaced by SetTUN
+		mtu             int32
+		unreachableICMP AtomicBool // answer packets without a peer with ICMP errors
+	}
+
+	heartbeats struct {
+		sync.Mutex
+		running map[*heartbeat]struct{} // routines reporting their activity, see Status
 	}
 }
 
@@ -140,7 +199,7 @@ func deviceUpdateState(device *Device) {
 		device.peers.RLock()
 		for _, peer := range device.peers.keyMap {
 			peer.Start()
-			if peer.persistentKeepaliveInterval > 0 {
+			if peer.PersistentKeepaliveInterval() > 0 {
 				peer.SendKeepalive()
 			}
 		}
@@ -183,14 +242,79 @@ func (device *Device) Down() {
 	deviceUpdateState(device)
 }
 
+type logSinkHolder struct {
+	LogSink
+}
+
+func (device *Device) logSink() LogSink {
+	return device.sink.Load().(logSinkHolder).LogSink
+}
+
+/* Reports whether debug messages are logged, so that the hot paths can
+ * skip preparing the fields of messages which would be discarded
+ */
+func (device *Device) debugEnabled() bool {
+	return logEnabled(device.logSink(), LogLevelDebug)
+}
+
+/* Returns the sink for messages which attackers can trigger at will,
+ * which limits how often each of them is logged
+ */
+func (device *Device) limitedLogSink() LogSink {
+	return limitedSink{device.logSink(), &device.logLimiter}
+}
+
+/* Replaces the sink of the structured log messages of the device,
+ * which defaults to its Logger
+ */
+func (device *Device) SetLogSink(sink LogSink) {
+	if sink == nil {
+		sink = device.log.Sink()
+	}
+	device.sink.Store(logSinkHolder{sink})
+}
+
+/* Sets the MTU of the TUN device, if it can be changed, and of the tunnel:
+ * transport messages are padded to at most the MTU, and decrypted packets
+ * which exceed it are dropped instead of being written to the TUN device
+ */
+func (device *Device) SetMTU(mtu int) error {
+	if mtu <= 0 || mtu > MaxContentSize {
+		return fmt.Errorf("invalid MTU: %d", mtu)
+	}
+	if setter, ok := device.tunDevice().(tun.MTUSetter); ok {
+		if err := setter.SetMTU(mtu); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&device.tun.mtu, int32(mtu))
+	return nil
+}
+
+func (device *Device) MTU() int {
+	return int(atomic.LoadInt32(&device.tun.mtu))
+}
+
+/* Thresholds past which the device considers itself under load,
+ * demanding a cookie from initiators before processing their handshakes
+ *
+ * They take effect for the next handshake message received, so they can
+ * be lowered while the device is attacked. The handshake rate compares to
+ * Device.HandshakeMessageRate.
+ */
+type UnderLoadThresholds struct {
+	QueueSize     int           // backlog of the handshake queue
+	HandshakeRate uint32        // handshake messages per second, zero to disable
+	HoldTime      time.Duration // how long the device remains under load, zero for UnderLoadAfterTime
+}
+
 func (device *Device) IsUnderLoad() bool {
 
 	// check if currently under load
 
 	now := time.Now()
-	underLoad := len(device.queue.handshake) >= UnderLoadQueueSize
-	if underLoad {
-		device.rate.underLoadUntil.Store(now.Add(UnderLoadAfterTime))
+	if device.exceedsLoadThresholds(now) {
+		device.rate.underLoadUntil.Store(now.Add(device.UnderLoadThresholds().HoldTime))
 		return true
 	}
 
@@ -200,6 +324,113 @@ func (device *Device) IsUnderLoad() bool {
 	return until.After(now)
 }
 
+/* The device is under load when handshake messages arrive faster than the
+ * configured rate, or when the handshake workers can no longer keep up
+ * with them, leaving a backlog in the handshake queue
+ */
+func (device *Device) exceedsLoadThresholds(now time.Time) bool {
+	thresholds := device.UnderLoadThresholds()
+	if len(device.queue.handshake) >= thresholds.QueueSize {
+		return true
+	}
+	if thresholds.HandshakeRate == 0 {
+		return false
+	}
+	return device.rate.handshakes.Rate(now) >= float64(thresholds.HandshakeRate)
+}
+
+func (device *Device) UnderLoadThresholds() UnderLoadThresholds {
+	return device.rate.thresholds.Load().(UnderLoadThresholds)
+}
+
+/* Replaces the thresholds, see UnderLoadThresholds
+ *
+ * The hold time is limited to the lifetime of a cookie, so that an attack
+ * cannot keep demanding cookies from initiators for long after it ended.
+ */
+func (device *Device) SetUnderLoadThresholds(thresholds UnderLoadThresholds) error {
+	if size := cap(device.queue.handshake); thresholds.QueueSize < 1 || thresholds.QueueSize > size {
+		return fmt.Errorf("under load queue size must be between 1 and %d", size)
+	}
+	if thresholds.HoldTime < 0 || thresholds.HoldTime > CookieRefreshTime {
+		return fmt.Errorf("under load hold time must be between 0 and %v", CookieRefreshTime)
+	}
+	if thresholds.HoldTime == 0 {
+		thresholds.HoldTime = UnderLoadAfterTime
+	}
+	device.rate.thresholds.Store(thresholds)
+	return nil
+}
+
+/* Decides when initiators must present a cookie, proving that they own
+ * their source address, before their handshake messages are processed
+ *
+ * CookiePolicyNever leaves a device exposed to floods of handshake
+ * messages from spoofed addresses, each costing Diffie-Hellman operations,
+ * and to reflecting handshake responses onto the spoofed addresses; it
+ * only suits devices whose traffic is already scrubbed upstream. The rate
+ * limit per source address still applies under load, though spoofed
+ * addresses evade it. CookiePolicyAlways costs every initiator under the
+ * policy an extra round trip to obtain a cookie.
+ */
+type CookiePolicy uint32
+
+const (
+	CookiePolicyAuto   CookiePolicy = iota // only demand cookies under load, see UnderLoadThresholds
+	CookiePolicyAlways                     // always demand cookies
+	CookiePolicyNever                      // never demand cookies
+)
+
+func (device *Device) CookiePolicy() CookiePolicy {
+	return CookiePolicy(atomic.LoadUint32(&device.rate.cookiePolicy))
+}
+
+func (device *Device) SetCookiePolicy(policy CookiePolicy) error {
+	if policy > CookiePolicyNever {
+		return fmt.Errorf("invalid cookie policy: %d", policy)
+	}
+	atomic.StoreUint32(&device.rate.cookiePolicy, uint32(policy))
+	return nil
+}
+
+func (device *Device) demandsCookie(underLoad bool) bool {
+	switch device.CookiePolicy() {
+	case CookiePolicyAlways:
+		return true
+	case CookiePolicyNever:
+		return false
+	}
+	return underLoad
+}
+
+/* Decides which message is dropped when a handshake message arrives while
+ * the handshake queue is full, as the receivers never wait for the queue,
+ * so the sockets keep draining however far handshakes fall behind
+ *
+ * Dropping the newest keeps the work already queued, while dropping the
+ * oldest favours fresh messages, as initiators which have been waiting
+ * longest are the likeliest to have given up and retried. Either drop is
+ * counted in DropStats.HandshakeQueueOverflow.
+ */
+type HandshakeQueuePolicy uint32
+
+const (
+	HandshakeQueueDropNewest HandshakeQueuePolicy = iota // drop the arriving message
+	HandshakeQueueDropOldest                             // drop the message queued longest
+)
+
+func (device *Device) HandshakeQueuePolicy() HandshakeQueuePolicy {
+	return HandshakeQueuePolicy(atomic.LoadUint32(&device.queue.overflow))
+}
+
+func (device *Device) SetHandshakeQueuePolicy(policy HandshakeQueuePolicy) error {
+	if policy > HandshakeQueueDropOldest {
+		return fmt.Errorf("invalid handshake queue policy: %d", policy)
+	}
+	atomic.StoreUint32(&device.queue.overflow, uint32(policy))
+	return nil
+}
+
 func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	// lock required resources
 
@@ -253,13 +484,111 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	return nil
 }
 
+/* Options fixed when creating a device, zero values select the defaults
+ *
+ * Larger inbound and outbound queues absorb longer bursts on links with
+ * a high bandwidth-delay product, at the cost of memory and of latency
+ * under sustained load. A smaller handshake queue fills up sooner,
+ * so the device considers itself under load and demands cookies earlier.
+ * A wider replay window rejects fewer packets on links which reorder
+ * heavily, at the cost of memory for every keypair.
+ *
+ * By default each peer writes the packets it receives to the TUN device
+ * itself, one after another. With more than one TUN writer, packets are
+ * spread over that many routines by flow, so the flows of a busy peer are
+ * written in parallel while each flow stays in order.
+ *
+ * Larger socket buffers keep the kernel from dropping datagrams when the
+ * device falls behind for a moment, see DeviceStats.KernelDrops; they are
+ * applied whenever the sockets are (re)opened, and the sizes the kernel
+ * actually granted are logged, as it may clamp them.
+ *
+ * ListenPacket replaces the UDP sockets by a net.PacketConn of the caller,
+ * such as one of a userspace network stack or of a test, called with the
+ * listening port whenever the sockets would be (re)opened. The port of
+ * the conn is taken as the listening port if it has a UDP address. A
+ * single conn then carries both address families, and the socket options
+ * above and those of the device, such as the fwmark, do not apply.
+ *
+ * AllowedIPs replaces the in-memory table routing packets to peers, see
+ * AllowedIPsTable. The device owns the table and resets it when created.
+ */
+type DeviceOptions struct {
+	QueueInboundSize   int // decryption queue and inbound queue of every peer
+	QueueOutboundSize  int // encryption queue and outbound queues of every peer
+	QueueHandshakeSize int // handshake queue
+	ReplayWindowSize   int // counters accepted behind the latest, a multiple of 64
+	TUNWriters         int // routines writing to the TUN device, see below
+	ReceiveBuffer      int // bytes of the UDP socket receive buffers, zero keeps the system default
+	SendBuffer         int // bytes of the UDP socket send buffers, zero keeps the system default
+
+	ListenPacket func(port uint16) (net.PacketConn, error) // opens the conn used in place of UDP sockets, see below
+	AllowedIPs   AllowedIPsTable                           // routes packets to peers, see below
+}
+
+func (options *DeviceOptions) setDefaults() error {
+	sizes := []struct {
+		name  string
+		size  *int
+		value int
+	}{
+		{"inbound", &options.QueueInboundSize, QueueInboundSize},
+		{"outbound", &options.QueueOutboundSize, QueueOutboundSize},
+		{"handshake", &options.QueueHandshakeSize, QueueHandshakeSize},
+	}
+	for _, queue := range sizes {
+		if *queue.size < 0 {
+			return fmt.Errorf("invalid %s queue size: %d", queue.name, *queue.size)
+		}
+		if *queue.size == 0 {
+			*queue.size = queue.value
+		}
+	}
+	if options.ReplayWindowSize == 0 {
+		options.ReplayWindowSize = DefaultReplayWindowSize
+	}
+	if options.ReplayWindowSize < 0 || options.ReplayWindowSize%64 != 0 {
+		return fmt.Errorf("invalid replay window size: %d, must be a multiple of 64", options.ReplayWindowSize)
+	}
+	if options.TUNWriters < 0 {
+		return fmt.Errorf("invalid number of TUN writers: %d", options.TUNWriters)
+	}
+	if options.ReceiveBuffer < 0 || options.SendBuffer < 0 {
+		return fmt.Errorf("invalid socket buffer sizes: %d, %d", options.ReceiveBuffer, options.SendBuffer)
+	}
+	if options.AllowedIPs == nil {
+		options.AllowedIPs = new(AllowedIPs)
+	}
+	return nil
+}
+
 func NewDevice(tunDevice tun.Device, logger *Logger) *Device {
+	device, _ := NewDeviceWithOptions(tunDevice, logger, DeviceOptions{})
+	return device
+}
+
+func NewDeviceWithOptions(tunDevice tun.Device, logger *Logger, options DeviceOptions) (*Device, error) {
+	given := options
+	if err := options.setDefaults(); err != nil {
+		return nil, err
+	}
+
 	device := new(Device)
+	device.options = options
+	device.given = given
 
 	device.isUp.Set(false)
 	device.isClosed.Set(false)
 
 	device.log = logger
+	device.sink.Store(logSinkHolder{logger.Sink()})
+	device.alarm.Store(DecryptFailureAlarm{
+		Threshold: DecryptFailureAlarmThreshold,
+		Window:    DecryptFailureAlarmWindow,
+	})
+	device.exporter.Store(metricsHolder{NoopMetrics{}})
+	device.clock.Store(clockHolder{time.Now})
+	device.roaming.Store(DefaultRoamingHoldTime)
 
 	device.tun.device = tunDevice
 	mtu, err := device.tun.device.MTU()
@@ -272,27 +601,49 @@ func NewDevice(tunDevice tun.Device, logger *Logger) *Device {
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
 
 	device.rate.limiter.Init()
+	device.rate.cookieReplyLimiter.Init()
+	device.rate.icmpLimiter.Init()
 	device.rate.underLoadUntil.Store(time.Time{})
+	underLoadQueueSize := options.QueueHandshakeSize * UnderLoadQueueSize / QueueHandshakeSize
+	if underLoadQueueSize < 1 {
+		underLoadQueueSize = 1
+	}
+	device.rate.thresholds.Store(UnderLoadThresholds{
+		QueueSize:     underLoadQueueSize,
+		HandshakeRate: UnderLoadHandshakeRate,
+		HoldTime:      UnderLoadAfterTime,
+	})
 
 	device.indexTable.Init()
+	device.allowedips = options.AllowedIPs
 	device.allowedips.Reset()
 
 	device.PopulatePools()
 
 	// create queues
 
-	device.queue.handshake = make(chan QueueHandshakeElement, QueueHandshakeSize)
-	device.queue.encryption = make(chan *QueueOutboundElement, QueueOutboundSize)
-	device.queue.decryption = make(chan *QueueInboundElement, QueueInboundSize)
+	device.queue.handshake = make(chan QueueHandshakeElement, options.QueueHandshakeSize)
+	device.queue.encryption = make(chan *QueueOutboundElement, options.QueueOutboundSize)
+	device.queue.decryption = make(chan *QueueInboundElement, options.QueueInboundSize)
+	if options.TUNWriters > 1 {
+		device.queue.tunWriters = make([]chan *QueueInboundElement, options.TUNWriters)
+		for i := range device.queue.tunWriters {
+			device.queue.tunWriters[i] = make(chan *QueueInboundElement, options.QueueInboundSize)
+		}
+	}
 
 	// prepare signals
 
 	device.signals.stop = make(chan struct{})
+	device.events.handshakes = make(chan HandshakeEvent, HandshakeEventQueueSize)
+	device.events.handshakeTimeout.Store(RekeyAttemptTime)
 
 	// prepare net
 
 	device.net.port = 0
 	device.net.bind = nil
+	device.net.batchSize = DefaultReceiveBatchSize
+	device.net.sockets = 1
 
 	// start workers
 
@@ -307,14 +658,23 @@ func NewDevice(tunDevice tun.Device, logger *Logger) *Device {
 		go device.RoutineHandshake()
 	}
 
-	device.state.starting.Add(2)
-	device.state.stopping.Add(2)
+	device.state.starting.Add(5)
+	device.state.stopping.Add(5)
 	go device.RoutineReadFromTUN()
 	go device.RoutineTUNEventReader()
+	go device.RoutineSampleRates()
+	go device.RoutineRotateCookieSecret()
+	go device.RoutineSweepIndices()
+
+	for _, queue := range device.queue.tunWriters {
+		device.state.starting.Add(1)
+		device.state.stopping.Add(1)
+		go device.RoutineWriteToTUN(queue)
+	}
 
 	device.state.starting.Wait()
 
-	return device
+	return device, nil
 }
 
 func (device *Device) LookupPeer(pk NoisePublicKey) *Peer {
@@ -324,6 +684,12 @@ func (device *Device) LookupPeer(pk NoisePublicKey) *Peer {
 	return device.peers.keyMap[pk]
 }
 
+/* Removes a peer, which may be done while the device is running
+ *
+ * Stopping the peer deletes its keypairs from the index table,
+ * so transport packets for it which are still in flight no longer resolve
+ * to a keypair and are dropped by the receive routines.
+ */
 func (device *Device) RemovePeer(key NoisePublicKey) {
 	device.peers.Lock()
 	defer device.peers.Unlock()
@@ -347,6 +713,11 @@ func (device *Device) RemoveAllPeers() {
 }
 
 func (device *Device) FlushPacketQueues() {
+	for _, queue := range device.queue.tunWriters {
+		for len(queue) > 0 {
+			device.releaseInboundElement(<-queue)
+		}
+	}
 	for {
 		select {
 		case elem, ok := <-device.queue.decryption:
@@ -365,6 +736,15 @@ func (device *Device) FlushPacketQueues() {
 
 }
 
+/* Closes the device and releases all of its resources
+ *
+ * Routines are stopped in the order in which packets flow through them:
+ * first the TUN reader and bind receivers, so that no new packets are
+ * queued, then the device workers, which drop and unlock whatever is left
+ * in the encryption and decryption queues, and finally the routines of
+ * every peer, which release the remaining elements of their queues.
+ * No routine is left waiting on an element that will never be unlocked.
+ */
 func (device *Device) Close() {
 	if device.isClosed.Swap(true) {
 		return
@@ -377,7 +757,7 @@ func (device *Device) Close() {
 	device.state.Lock()
 	defer device.state.Unlock()
 
-	device.tun.device.Close()
+	device.tunDevice().Close()
 	device.BindClose()
 
 	device.isUp.Set(false)
@@ -390,6 +770,8 @@ func (device *Device) Close() {
 	device.FlushPacketQueues()
 
 	device.rate.limiter.Close()
+	device.rate.cookieReplyLimiter.Close()
+	device.rate.icmpLimiter.Close()
 
 	device.state.changing.Set(false)
 	device.log.Info.Println("Interface closed")
@@ -407,7 +789,7 @@ func (device *Device) SendKeepalivesToPeersWithCurrentKeypair() {
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
 		peer.keypairs.RLock()
-		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(RejectAfterTime).Before(time.Now())
+		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(RejectAfterTime).Before(device.now())
 		peer.keypairs.RUnlock()
 		if sendKeepalive {
 			peer.SendKeepalive()
@@ -422,20 +804,182 @@ func unsafeCloseBind(device *Device) error {
 	if netc.netlinkCancel != nil {
 		netc.netlinkCancel.Cancel()
 	}
+	atomic.AddUint64(&device.stats.kernelDrops, device.unsafeKernelDrops())
 	if netc.bind != nil {
 		err = netc.bind.Close()
 		netc.bind = nil
 	}
+	for _, bind := range netc.extraBinds {
+		if err2 := bind.Close(); err == nil {
+			err = err2
+		}
+	}
+	netc.extraBinds = nil
+	if netc.tcpBind != nil {
+		if err2 := netc.tcpBind.Close(); err == nil {
+			err = err2
+		}
+		netc.tcpBind = nil
+	}
 	netc.stopping.Wait()
 	return err
 }
 
+/* Returns all binds of the device, the first being the one sending
+ */
+func (device *Device) unsafeBinds() []conn.Bind {
+	if device.net.bind == nil {
+		return nil
+	}
+	return append([]conn.Bind{device.net.bind}, device.net.extraBinds...)
+}
+
+/* Returns the number of datagrams the kernel dropped, as the receive
+ * buffers were full, for the binds currently open
+ */
+func (device *Device) unsafeKernelDrops() uint64 {
+	var dropped uint64
+	for _, bind := range append(device.unsafeBinds(), device.net.tcpBind) {
+		if counter, ok := bind.(conn.BindKernelDrops); ok {
+			dropped += counter.KernelDrops()
+		}
+	}
+	return dropped
+}
+
+/* Returns the bind sending to the endpoint, which is the TCP bind
+ * for endpoints reached over TCP
+ */
+func (device *Device) unsafeSendBind(endpoint conn.Endpoint) (conn.Bind, error) {
+	if _, ok := endpoint.(*conn.TCPEndpoint); ok {
+		if device.net.tcpBind == nil {
+			return nil, errors.New("no tcp bind")
+		}
+		return device.net.tcpBind, nil
+	}
+	if device.net.bind == nil {
+		return nil, errors.New("no bind")
+	}
+	return device.net.bind, nil
+}
+
 func (device *Device) Bind() conn.Bind {
 	device.net.Lock()
 	defer device.net.Unlock()
 	return device.net.bind
 }
 
+/* Sets the type of service (IPv4) and traffic class (IPv6) byte
+ * of all packets sent by the device, including cookie replies.
+ */
+func (device *Device) BindSetTOS(tos uint8) error {
+
+	device.net.Lock()
+	defer device.net.Unlock()
+
+	if device.net.tos == tos {
+		return nil
+	}
+
+	// update tos on existing bind
+
+	for _, bind := range device.unsafeBinds() {
+		setter, ok := bind.(conn.BindSetTOS)
+		if !ok {
+			return errors.New("setting the type of service is not supported on this platform")
+		}
+		if err := setter.SetTOS(tos); err != nil {
+			return err
+		}
+	}
+	device.net.tos = tos
+
+	return nil
+}
+
+/* Restricts the sockets of the device to a single network interface,
+ * so that packets cannot leave through another one when routes change.
+ * The restriction is reapplied whenever the bind is updated.
+ */
+func (device *Device) BindSetInterface(name string) error {
+
+	device.net.Lock()
+	defer device.net.Unlock()
+
+	if device.net.iface == name {
+		return nil
+	}
+	if device.net.tcp && name != "" {
+		return errTCPSocketOptions
+	}
+
+	// update interface on existing bind
+
+	for _, bind := range device.unsafeBinds() {
+		if err := bindToDevice(bind, name); err != nil {
+			return err
+		}
+	}
+	device.net.iface = name
+
+	return nil
+}
+
+/* Binds the sockets of the device to a local address, nil to any, so
+ * that on a host with several addresses the packets sent to peers, cookie
+ * replies included, always originate from it; only sockets of the family
+ * of the address are opened
+ *
+ * The sockets are reopened on the new address right away when open, and
+ * the source addresses cached for peers are cleared.
+ */
+func (device *Device) BindSetAddress(addr net.IP) error {
+	if addr != nil && (addr.To16() == nil || addr.IsMulticast()) {
+		return fmt.Errorf("invalid local address: %v", addr)
+	}
+	if ip4 := addr.To4(); ip4 != nil {
+		addr = ip4
+	}
+
+	device.net.Lock()
+	defer device.net.Unlock()
+
+	if device.net.addr.Equal(addr) {
+		return nil
+	}
+	device.net.addr = addr
+
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.Lock()
+		if peer.endpoint != nil {
+			peer.endpoint.ClearSrc()
+		}
+		peer.Unlock()
+	}
+	device.peers.RUnlock()
+
+	return unsafeBindUpdate(device, device.net.port)
+}
+
+func bindToDevice(bind conn.Bind, name string) error {
+	binder, ok := bind.(conn.BindToDevice)
+	if !ok {
+		return errors.New("binding to an interface is not supported on this platform")
+	}
+	return binder.BindToDevice(name)
+}
+
+/* Enables copying the DSCP bits of the type of service (IPv4)
+ * or traffic class (IPv6) of each packet read from the TUN device
+ * onto the outer packet carrying it, where supported.
+ *
+ * Packets with a zero DSCP keep the value set by BindSetTOS.
+ */
+func (device *Device) SetInheritDSCP(inherit bool) {
+	device.net.inheritDSCP.Set(inherit)
+}
+
 func (device *Device) BindSetMark(mark uint32) error {
 
 	device.net.Lock()
@@ -446,15 +990,18 @@ func (device *Device) BindSetMark(mark uint32) error {
 	if device.net.fwmark == mark {
 		return nil
 	}
+	if device.net.tcp && mark != 0 {
+		return errTCPSocketOptions
+	}
 
 	// update fwmark on existing bind
 
-	device.net.fwmark = mark
-	if device.isUp.Get() && device.net.bind != nil {
-		if err := device.net.bind.SetMark(mark); err != nil {
+	for _, bind := range device.unsafeBinds() {
+		if err := bind.SetMark(mark); err != nil {
 			return err
 		}
 	}
+	device.net.fwmark = mark
 
 	// clear cached source addresses
 
@@ -471,11 +1018,97 @@ func (device *Device) BindSetMark(mark uint32) error {
 	return nil
 }
 
+/* Sets the number of sockets receiving on the listening port, each with
+ * its own receiving routines, which scales receiving over several cores.
+ * Takes effect the next time the bind is updated; more than one socket
+ * is only supported on Linux.
+ */
+func (device *Device) SetReceiveSockets(sockets int) {
+	if sockets < 1 {
+		sockets = 1
+	}
+	device.net.Lock()
+	device.net.sockets = sockets
+	device.net.Unlock()
+}
+
+var errTCPSocketOptions = errors.New("fwmark and binding to an interface are not supported over tcp")
+
+/* Enables carrying messages over TCP, for networks blocking UDP: the
+ * device listens on TCP on its listening port, in addition to UDP, and
+ * reaches endpoints given as TCP endpoints over TCP
+ *
+ * Each message is preceded by its length; TCP endpoints do not support
+ * the type of service. As the TCP sockets would escape them, TCP cannot
+ * be enabled along with a fwmark or an interface the sockets are bound
+ * to, nor can those be set while it is. Rebinds if the device is up.
+ */
+func (device *Device) SetTCPTransport(enable bool) error {
+	device.net.Lock()
+	defer device.net.Unlock()
+
+	if device.net.tcp == enable {
+		return nil
+	}
+	if enable && (device.net.fwmark != 0 || device.net.iface != "") {
+		return errTCPSocketOptions
+	}
+	device.net.tcp = enable
+	return unsafeBindUpdate(device, device.net.port)
+}
+
+/* Sets the maximum number of datagrams read from a socket by a single
+ * system call, on platforms supporting batched reads.
+ *
+ * The new size takes effect the next time the bind is updated.
+ */
+func (device *Device) SetReceiveBatchSize(size int) {
+	if size < 1 {
+		size = 1
+	}
+	device.net.Lock()
+	device.net.batchSize = size
+	device.net.Unlock()
+}
+
 func (device *Device) BindUpdate() error {
+	device.net.Lock()
+	defer device.net.Unlock()
+	return unsafeBindUpdate(device, device.net.port)
+}
 
+/* Changes the listening port, rebinding if the device is up
+ *
+ * Unlike BindUpdate, the sockets for the new port are opened before the
+ * old ones are closed, so datagrams keep arriving until the switch over
+ * and a port which is in use leaves the current bind untouched.
+ */
+func (device *Device) SetListenPort(port uint16) error {
 	device.net.Lock()
 	defer device.net.Unlock()
 
+	netc := &device.net
+	if !device.isUp.Get() || netc.bind == nil || (port != 0 && port == netc.port) {
+		return unsafeBindUpdate(device, port)
+	}
+
+	binds, actualPort, err := device.createBinds(port)
+	if err != nil {
+		return err
+	}
+	netc.generation++
+	if err := unsafeCloseBind(device); err != nil {
+		for _, bind := range binds {
+			bind.Close()
+		}
+		return err
+	}
+	return unsafeStartBind(device, binds, actualPort)
+}
+
+func unsafeBindUpdate(device *Device, port uint16) error {
+	device.net.generation++
+
 	// close existing sockets
 
 	if err := unsafeCloseBind(device); err != nil {
@@ -488,60 +1121,224 @@ func (device *Device) BindUpdate() error {
 
 		// bind to new port
 
-		var err error
-		netc := &device.net
-		netc.bind, netc.port, err = conn.CreateBind(netc.port)
+		binds, actualPort, err := device.createBinds(port)
 		if err != nil {
-			netc.bind = nil
-			netc.port = 0
+			device.net.port = 0
 			return err
 		}
-		netc.netlinkCancel, err = device.startRouteListener(netc.bind)
+		return unsafeStartBind(device, binds, actualPort)
+	}
+
+	device.net.port = port
+	return nil
+}
+
+/* Creates the binds of the device, which all listen on the same port
+ * when receiving on several sockets, the kernel distributing flows among them
+ */
+func (device *Device) createBinds(port uint16) ([]conn.Bind, uint16, error) {
+	if device.options.ListenPacket != nil {
+		packetConn, err := device.options.ListenPacket(port)
 		if err != nil {
-			netc.bind.Close()
-			netc.bind = nil
-			netc.port = 0
-			return err
+			return nil, 0, err
+		}
+		if addr, ok := packetConn.LocalAddr().(*net.UDPAddr); ok {
+			port = uint16(addr.Port)
 		}
+		return []conn.Bind{conn.CreatePacketConnBind(packetConn)}, port, nil
+	}
+
+	options := conn.BindOptions{
+		ReusePort:     device.net.sockets > 1,
+		ReceiveBuffer: device.options.ReceiveBuffer,
+		SendBuffer:    device.options.SendBuffer,
+		Addr:          device.net.addr,
+		GRO:           true,
+	}
+	sockets := device.net.sockets
+	if sockets < 1 {
+		sockets = 1
+	}
+
+	binds := make([]conn.Bind, 0, sockets)
+	for i := 0; i < sockets; i++ {
+		bind, actualPort, err := conn.CreateBindWithOptions(port, options)
+		if err != nil {
+			for _, bind := range binds {
+				bind.Close()
+			}
+			return nil, 0, err
+		}
+		binds = append(binds, bind)
+		port = actualPort
+	}
+
+	// the kernel may clamp the buffer sizes
+
+	if options.ReceiveBuffer > 0 || options.SendBuffer > 0 {
+		if sizer, ok := binds[0].(conn.BindBufferSizes); ok {
+			receive, send, err := sizer.BufferSizes()
+			if err != nil {
+				device.log.Error.Println("Failed to query UDP socket buffer sizes:", err)
+			} else {
+				device.log.Info.Printf("UDP socket buffers: receive %d bytes (requested %d), send %d bytes (requested %d)\n",
+					receive, options.ReceiveBuffer, send, options.SendBuffer)
+			}
+		}
+	}
+	return binds, port, nil
+}
+
+/* Makes freshly created binds the binds of the device, the first one
+ * sending, applying the socket options and starting the receiving routines
+ */
+func unsafeStartBind(device *Device, binds []conn.Bind, port uint16) error {
+	var err error
+	netc := &device.net
+	netc.bind, netc.extraBinds, netc.port = binds[0], binds[1:], port
+
+	// listen for route changes
+
+	netc.netlinkCancel, err = device.startRouteListener(netc.bind)
+	if err != nil {
+		unsafeCloseBind(device)
+		netc.port = 0
+		return err
+	}
+
+	for _, bind := range binds {
 
 		// set fwmark
 
 		if netc.fwmark != 0 {
-			err = netc.bind.SetMark(netc.fwmark)
+			err = bind.SetMark(netc.fwmark)
 			if err != nil {
+				unsafeCloseBind(device)
+				netc.port = 0
 				return err
 			}
 		}
 
-		// clear cached source addresses
+		// set interface
 
-		device.peers.RLock()
-		for _, peer := range device.peers.keyMap {
-			peer.Lock()
-			defer peer.Unlock()
-			if peer.endpoint != nil {
-				peer.endpoint.ClearSrc()
+		if netc.iface != "" {
+			err = bindToDevice(bind, netc.iface)
+			if err != nil {
+				unsafeCloseBind(device)
+				netc.port = 0
+				return err
 			}
 		}
-		device.peers.RUnlock()
 
-		// start receiving routines
+		// set type of service
+
+		if netc.tos != 0 {
+			if setter, ok := bind.(conn.BindSetTOS); ok {
+				err = setter.SetTOS(netc.tos)
+			} else {
+				err = errors.New("not supported on this platform")
+			}
+			if err != nil {
+				device.log.Error.Println("Unable to set type of service:", err)
+			}
+		}
+	}
+
+	// listen on tcp
+
+	if netc.tcp {
+		netc.tcpBind, _, err = conn.CreateTCPBindWithOptions(port, conn.BindOptions{Addr: netc.addr})
+		if err != nil {
+			unsafeCloseBind(device)
+			netc.port = 0
+			return err
+		}
+		binds = append(binds, netc.tcpBind)
+	}
+
+	// clear cached source addresses
+
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.Lock()
+		defer peer.Unlock()
+		if peer.endpoint != nil {
+			peer.endpoint.ClearSrc()
+		}
+	}
+	device.peers.RUnlock()
+
+	// start receiving routines
 
+	for _, bind := range binds {
 		device.net.starting.Add(2)
 		device.net.stopping.Add(2)
-		go device.RoutineReceiveIncoming(ipv4.Version, netc.bind)
-		go device.RoutineReceiveIncoming(ipv6.Version, netc.bind)
-		device.net.starting.Wait()
-
-		device.log.Debug.Println("UDP bind has been updated")
+		go device.RoutineReceiveIncoming(ipv4.Version, bind)
+		go device.RoutineReceiveIncoming(ipv6.Version, bind)
 	}
+	device.net.starting.Wait()
+
+	device.log.Debug.Println("UDP bind has been updated")
 
 	return nil
 }
 
 func (device *Device) BindClose() error {
 	device.net.Lock()
+	device.net.generation++
 	err := unsafeCloseBind(device)
 	device.net.Unlock()
 	return err
 }
+
+/* Reopens the sockets after one failed while still in use, retrying with
+ * exponential backoff until it succeeds or the device is reconfigured
+ *
+ * Binds closed deliberately have already been replaced or removed by the
+ * time this acquires the lock, which leaves them alone. Any later update
+ * or closing of the binds bumps their generation, which stops retrying.
+ */
+func (device *Device) reopenBind(failed conn.Bind) {
+	netc := &device.net
+
+	netc.Lock()
+	current := false
+	for _, bind := range device.unsafeBinds() {
+		current = current || bind == failed
+	}
+	if !current || !device.isUp.Get() {
+		netc.Unlock()
+		return
+	}
+	port := netc.port
+	unsafeCloseBind(device)
+	generation := netc.generation
+	netc.Unlock()
+
+	backoff := bindReopenBackoffMin
+	for attempt := 1; ; attempt++ {
+		netc.Lock()
+		if device.isClosed.Get() || !device.isUp.Get() || netc.bind != nil || netc.generation != generation {
+			netc.Unlock()
+			return
+		}
+		if netc.port != 0 {
+			port = netc.port
+		}
+		device.log.Info.Printf("Reopening UDP sockets on port %d (attempt %d)\n", port, attempt)
+		binds, actualPort, err := device.createBinds(port)
+		if err == nil {
+			err = unsafeStartBind(device, binds, actualPort)
+		}
+		netc.Unlock()
+		if err == nil {
+			return
+		}
+
+		device.log.Error.Println("Unable to reopen UDP sockets:", err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > bindReopenBackoffMax {
+			backoff = bindReopenBackoffMax
+		}
+	}
+}
@@ -8,11 +8,24 @@ package device
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/tun/tuntest"
 )
 
@@ -28,6 +41,8 @@ allowed_ip=1.0.0.2/32
 endpoint=127.0.0.1:53512`
 	tun1 := tuntest.NewChannelTUN()
 	dev1 := NewDevice(tun1.TUN(), NewLogger(LogLevelDebug, "dev1: "))
+	metrics1 := new(testMetrics)
+	dev1.SetMetrics(metrics1)
 	dev1.Up()
 	defer dev1.Close()
 	if err := dev1.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg1))); err != nil {
@@ -44,6 +59,8 @@ allowed_ip=1.0.0.1/32
 endpoint=127.0.0.1:53511`
 	tun2 := tuntest.NewChannelTUN()
 	dev2 := NewDevice(tun2.TUN(), NewLogger(LogLevelDebug, "dev2: "))
+	metrics2 := new(testMetrics)
+	dev2.SetMetrics(metrics2)
 	dev2.Up()
 	defer dev2.Close()
 	if err := dev2.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg2))); err != nil {
@@ -75,6 +92,88 @@ endpoint=127.0.0.1:53511`
 			t.Error("return ping did not transit")
 		}
 	})
+
+	t.Run("handshake stats", func(t *testing.T) {
+		for _, dev := range []*Device{dev1, dev2} {
+			dev.peers.RLock()
+			for _, peer := range dev.peers.keyMap {
+				stats := peer.Stats()
+				if stats.HandshakesCompleted == 0 || stats.LastHandshake.IsZero() {
+					t.Errorf("%v: handshake completion not recorded", peer)
+				}
+			}
+			dev.peers.RUnlock()
+		}
+	})
+
+	t.Run("handshake events", func(t *testing.T) {
+		for _, dev := range []*Device{dev1, dev2} {
+			select {
+			case event := <-dev.HandshakeEvents():
+				dev.peers.RLock()
+				_, ok := dev.peers.keyMap[event.PublicKey]
+				dev.peers.RUnlock()
+				if !ok || event.Endpoint == nil || event.Time.IsZero() {
+					t.Errorf("unexpected handshake event: %+v", event)
+				}
+			default:
+				t.Error("no handshake event emitted")
+			}
+		}
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		for _, metrics := range []*testMetrics{metrics1, metrics2} {
+			metrics.Lock()
+			if metrics.rxBytes == 0 || metrics.txBytes == 0 {
+				t.Errorf("traffic not recorded: %d bytes received, %d sent", metrics.rxBytes, metrics.txBytes)
+			}
+			metrics.Unlock()
+		}
+
+		// only the initiator measures the latency of the handshake
+
+		metrics2.Lock()
+		if len(metrics2.latencies) != 1 || metrics2.latencies[0] <= 0 {
+			t.Errorf("unexpected handshake latencies: %v", metrics2.latencies)
+		}
+		metrics2.Unlock()
+	})
+}
+
+type testMetrics struct {
+	sync.Mutex
+	drops     map[DropReason]int
+	rxBytes   int
+	txBytes   int
+	latencies []time.Duration
+}
+
+func (m *testMetrics) IncDrop(reason DropReason) {
+	m.Lock()
+	defer m.Unlock()
+	if m.drops == nil {
+		m.drops = make(map[DropReason]int)
+	}
+	m.drops[reason]++
+}
+
+func (m *testMetrics) AddRxBytes(peer *Peer, n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.rxBytes += n
+}
+
+func (m *testMetrics) AddTxBytes(peer *Peer, n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.txBytes += n
+}
+
+func (m *testMetrics) ObserveHandshakeLatency(d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.latencies = append(m.latencies, d)
 }
 
 func assertNil(t *testing.T, err error) {
@@ -100,3 +199,911 @@ func randDevice(t *testing.T) *Device {
 	device.SetPrivateKey(sk)
 	return device
 }
+
+func TestBindSetTOS(t *testing.T) {
+
+	// a device which is down applies the value once it comes up
+
+	device := randDevice(t)
+	defer device.Close()
+	if err := device.BindSetTOS(0xb8); err != nil {
+		t.Fatal(err)
+	}
+	if device.net.tos != 0xb8 {
+		t.Fatal("type of service of device which is down not recorded")
+	}
+	device.Up()
+	if device.Bind() == nil {
+		t.Fatal("device with type of service did not come up")
+	}
+
+	// one which is up applies it to its sockets right away
+
+	if err := device.BindSetTOS(0x28); err != nil {
+		t.Fatal(err)
+	}
+	if device.net.tos != 0x28 {
+		t.Fatal("type of service of device which is up not recorded")
+	}
+	if err := device.BindUpdate(); err != nil {
+		t.Fatal("type of service not reapplied on update:", err)
+	}
+
+	// binds which cannot set it leave the value unchanged
+
+	var network sync.Map
+	other, err := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelError, ""), DeviceOptions{
+		ListenPacket: func(port uint16) (net.PacketConn, error) {
+			return newTestPacketConn(&network, port), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.Up()
+	if err := other.BindSetTOS(0xb8); err == nil {
+		t.Fatal("set type of service on a bind not supporting it")
+	}
+	if other.net.tos != 0 {
+		t.Fatal("failed type of service was recorded")
+	}
+}
+
+func TestInnerDSCP(t *testing.T) {
+	ipv4Packet := make([]byte, ipv4.HeaderLen)
+	ipv4Packet[0] = ipv4.Version<<4 | ipv4.HeaderLen/4
+	ipv4Packet[1] = 0xb8 | 0x03 // EF, congestion experienced
+	ipv6Packet := make([]byte, ipv6.HeaderLen)
+	ipv6Packet[0] = ipv6.Version<<4 | 0xb
+	ipv6Packet[1] = 0x9<<4 | 0x0f // traffic class 0xb9, flow label bits
+	tests := []struct {
+		name   string
+		packet []byte
+		dscp   uint8
+	}{
+		{"IPv4", ipv4Packet, 0xb8},
+		{"IPv6", ipv6Packet, 0xb8},
+		{"unknown version", []byte{0x5f, 0xff}, 0},
+	}
+	for _, test := range tests {
+		if dscp := innerDSCP(test.packet); dscp != test.dscp {
+			t.Errorf("%s: DSCP %#x, expected %#x", test.name, dscp, test.dscp)
+		}
+	}
+}
+
+// TestDeviceAlignment checks that atomically-accessed fields are
+// aligned to 64-bit boundaries, as required by the atomic package.
+func TestDeviceAlignment(t *testing.T) {
+	var d Device
+	checkAlignment(t, "Device.stats", unsafe.Offsetof(d.stats))
+	checkAlignment(t, "Device.stats.initiations", unsafe.Offsetof(d.stats)+unsafe.Offsetof(d.stats.initiations))
+}
+
+func TestSetListenPort(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	device.Up()
+
+	port := func() uint16 {
+		device.net.RLock()
+		defer device.net.RUnlock()
+		if device.net.bind == nil {
+			t.Fatal("device has no bind")
+		}
+		return device.net.port
+	}
+
+	old := port()
+	if err := device.SetListenPort(0); err != nil {
+		t.Fatal(err)
+	}
+	if port() == old {
+		t.Fatal("listen port did not change")
+	}
+
+	// a port in use leaves the current bind in place
+
+	busy, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	old = port()
+	if err := device.SetListenPort(uint16(busy.LocalAddr().(*net.UDPAddr).Port)); err == nil {
+		t.Fatal("bound to a port in use")
+	}
+	if port() != old {
+		t.Fatal("failed port change replaced the bind")
+	}
+}
+
+func TestBindSetInterface(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	device.Up()
+
+	if err := device.BindSetInterface("nonexistent0"); err == nil {
+		t.Fatal("bound to nonexistent interface")
+	}
+	if device.net.iface != "" {
+		t.Fatal("failed binding was recorded")
+	}
+
+	// a bind which cannot be bound to the interface is not left up
+
+	device.net.Lock()
+	device.net.iface = "nonexistent0"
+	device.net.Unlock()
+	if err := device.BindUpdate(); err == nil {
+		t.Fatal("bound to nonexistent interface on update")
+	}
+	if device.Bind() != nil || device.net.port != 0 {
+		t.Fatal("failed update left the bind up")
+	}
+	device.net.Lock()
+	device.net.iface = ""
+	device.net.Unlock()
+	if err := device.BindUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	if err := device.BindSetInterface("lo"); err != nil {
+		t.Skip("unable to bind to loopback interface:", err)
+	}
+	if err := device.BindUpdate(); err != nil {
+		t.Fatal("binding not reapplied on update:", err)
+	}
+}
+
+func TestBindSetAddress(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	device.Up()
+
+	if err := device.BindSetAddress(net.IPv4(224, 0, 0, 1)); err == nil {
+		t.Fatal("bound to multicast address")
+	}
+	if err := device.BindSetAddress(net.IPv4(127, 0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	device.net.RLock()
+	port := device.net.port
+	device.net.RUnlock()
+
+	send := func(ip net.IP, size int) {
+		sender, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: ip, Port: int(port)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sender.Close()
+		packet := make([]byte, size)
+		binary.LittleEndian.PutUint32(packet[:4], MessageTransportType)
+		sender.Write(packet)
+	}
+	waitDrops := func(drops uint64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for device.DropStats().UnknownIndex < drops {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d messages, expected %d", device.DropStats().UnknownIndex, drops)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	send(net.IPv4(127, 0, 0, 1), MessageTransportSize)
+	waitDrops(1)
+
+	// the whole of 127.0.0.0/8 is local on Linux, but not bound to;
+	// a short message sent there would be received before the next one
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	send(net.IPv4(127, 0, 0, 2), MessageTransportSize-1)
+	send(net.IPv4(127, 0, 0, 1), MessageTransportSize)
+	waitDrops(2)
+	if drops := device.DropStats().ShortPacket; drops != 0 {
+		t.Fatalf("received %d messages sent to another address", drops)
+	}
+}
+
+func TestReceiveSockets(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("several receiving sockets are only supported on Linux")
+	}
+	device := randDevice(t)
+	defer device.Close()
+	device.SetReceiveSockets(4)
+	device.Up()
+	if err := device.BindUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	device.net.RLock()
+	binds := device.unsafeBinds()
+	device.net.RUnlock()
+	if len(binds) != 4 {
+		t.Fatalf("got %d binds, expected 4", len(binds))
+	}
+
+	device.SetReceiveSockets(1)
+	if err := device.BindUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	device.net.RLock()
+	binds = device.unsafeBinds()
+	device.net.RUnlock()
+	if len(binds) != 1 {
+		t.Fatalf("got %d binds after reducing sockets, expected 1", len(binds))
+	}
+}
+
+func TestReopenFailedBind(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	device.Up()
+
+	device.net.RLock()
+	failed, port := device.net.bind, device.net.port
+	device.net.RUnlock()
+	if failed == nil {
+		t.Fatal("device has no bind")
+	}
+
+	// closing the sockets behind the device's back fails its receivers
+
+	failed.Close()
+	for i := 0; ; i++ {
+		device.net.RLock()
+		bind, reopened := device.net.bind, device.net.port
+		device.net.RUnlock()
+		if bind != nil && bind != failed {
+			if reopened != port {
+				t.Fatalf("reopened on port %d, expected %d", reopened, port)
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatal("failed bind not reopened")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// a deliberately closed bind stays closed
+
+	if err := device.BindClose(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	device.net.RLock()
+	defer device.net.RUnlock()
+	if device.net.bind != nil {
+		t.Fatal("closed bind was reopened")
+	}
+}
+
+// reopenCounter counts the attempts to reopen the sockets logged to it.
+type reopenCounter struct {
+	attempts int32
+}
+
+func (counter *reopenCounter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("Reopening UDP sockets")) {
+		atomic.AddInt32(&counter.attempts, 1)
+	}
+	return len(p), nil
+}
+
+func TestReopenFailedBindReconfigured(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	var reopens reopenCounter
+	device.log.Info = log.New(&reopens, "", 0)
+	device.log.Error = log.New(ioutil.Discard, "", 0) // failing on purpose
+	device.Up()
+
+	// the failed bind cannot be reopened, until the device is reconfigured
+
+	device.net.Lock()
+	failed := device.net.bind
+	device.net.iface = "nonexistent0"
+	device.net.Unlock()
+	failed.Close()
+	for i := 0; atomic.LoadInt32(&reopens.attempts) < 2; i++ {
+		if i == 100 {
+			t.Fatal("failed bind not reopened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := device.BindClose(); err != nil {
+		t.Fatal(err)
+	}
+	attempts := atomic.LoadInt32(&reopens.attempts)
+	time.Sleep(4 * bindReopenBackoffMin)
+	if atomic.LoadInt32(&reopens.attempts) != attempts {
+		t.Fatal("reopening continued after the bind was closed")
+	}
+}
+
+func TestDeviceOptions(t *testing.T) {
+	logger := NewLogger(LogLevelError, "")
+
+	if _, err := NewDeviceWithOptions(newDummyTUN("dummy"), logger, DeviceOptions{QueueInboundSize: -1}); err == nil {
+		t.Fatal("accepted negative queue size")
+	}
+
+	// the defaults are valid options themselves, on every word size
+
+	var defaults DeviceOptions
+	for i := 0; i < 2; i++ {
+		if err := defaults.setDefaults(); err != nil {
+			t.Fatalf("defaults rejected: %v", err)
+		}
+	}
+	if defaults.ReplayWindowSize != DefaultReplayWindowSize {
+		t.Errorf("got replay window size %d, expected default %d", defaults.ReplayWindowSize, DefaultReplayWindowSize)
+	}
+
+	if _, err := NewDeviceWithOptions(newDummyTUN("dummy"), logger, DeviceOptions{ReplayWindowSize: 100}); err == nil {
+		t.Fatal("accepted replay window size which is not a multiple of 64")
+	}
+	if _, err := NewDeviceWithOptions(newDummyTUN("dummy"), logger, DeviceOptions{TUNWriters: -1}); err == nil {
+		t.Fatal("accepted negative number of TUN writers")
+	}
+	if _, err := NewDeviceWithOptions(newDummyTUN("dummy"), logger, DeviceOptions{ReceiveBuffer: -1}); err == nil {
+		t.Fatal("accepted negative socket buffer size")
+	}
+
+	device, err := NewDeviceWithOptions(newDummyTUN("dummy"), logger, DeviceOptions{
+		QueueInboundSize:   4096,
+		QueueHandshakeSize: 64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if size := cap(device.queue.decryption); size != 4096 {
+		t.Errorf("got decryption queue size %d, expected 4096", size)
+	}
+	if size := cap(device.queue.encryption); size != QueueOutboundSize {
+		t.Errorf("got encryption queue size %d, expected default %d", size, QueueOutboundSize)
+	}
+	if size := cap(device.queue.handshake); size != 64 {
+		t.Errorf("got handshake queue size %d, expected 64", size)
+	}
+	if size := device.UnderLoadThresholds().QueueSize; size != 8 {
+		t.Errorf("got under load queue size %d, expected 8", size)
+	}
+
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+	if size := cap(peer.queue.inbound); size != 4096 {
+		t.Errorf("got peer inbound queue size %d, expected 4096", size)
+	}
+}
+
+func TestSocketBufferSizes(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("buffer sizes are only reported on Linux")
+	}
+	sizes := func(options DeviceOptions) (receive, send int) {
+		device, err := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelError, ""), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer device.Close()
+		device.Up()
+		device.net.RLock()
+		defer device.net.RUnlock()
+		receive, send, err = device.net.bind.(conn.BindBufferSizes).BufferSizes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return receive, send
+	}
+
+	receive, send := sizes(DeviceOptions{})
+	grownReceive, grownSend := sizes(DeviceOptions{ReceiveBuffer: 4 * receive, SendBuffer: 4 * send})
+	if grownReceive <= receive || grownSend <= send {
+		t.Fatalf("buffers not grown: receive %d to %d bytes, send %d to %d bytes", receive, grownReceive, send, grownSend)
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	sk1, _ := newPrivateKey()
+	sk2, _ := newPrivateKey()
+	pk1, pk2 := sk1.publicKey(), sk2.publicKey()
+
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), NewLogger(LogLevelError, "dev1: "))
+	dev1.Up()
+	if err := dev1.SetTCPTransport(true); err != nil {
+		t.Fatal(err)
+	}
+	defer dev1.Close()
+	cfg1 := fmt.Sprintf("private_key=%x\npublic_key=%x\nallowed_ip=1.0.0.2/32\n", sk1[:], pk2[:])
+	if err := dev1.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg1))); err != nil {
+		t.Fatal(err)
+	}
+	dev1.net.RLock()
+	port := dev1.net.port
+	dev1.net.RUnlock()
+
+	// the second device only knows the first over tcp
+
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), NewLogger(LogLevelError, "dev2: "))
+	dev2.Up()
+	if err := dev2.SetTCPTransport(true); err != nil {
+		t.Fatal(err)
+	}
+	defer dev2.Close()
+	cfg2 := fmt.Sprintf("private_key=%x\npublic_key=%x\nallowed_ip=1.0.0.1/32\nendpoint=tcp://127.0.0.1:%d\n", sk2[:], pk1[:], port)
+	if err := dev2.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg2))); err != nil {
+		t.Fatal(err)
+	}
+
+	msg2to1 := tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	tun2.Outbound <- msg2to1
+	select {
+	case msgRecv := <-tun1.Inbound:
+		if !bytes.Equal(msg2to1, msgRecv) {
+			t.Fatal("ping did not transit correctly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping did not transit over tcp")
+	}
+
+	// the reply follows the connection back
+
+	msg1to2 := tuntest.Ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+	tun1.Outbound <- msg1to2
+	select {
+	case msgRecv := <-tun2.Inbound:
+		if !bytes.Equal(msg1to2, msgRecv) {
+			t.Fatal("return ping did not transit correctly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("return ping did not transit over tcp")
+	}
+	peer := dev1.LookupPeer(pk2)
+	peer.RLock()
+	_, ok := peer.endpoint.(*conn.TCPEndpoint)
+	peer.RUnlock()
+	if !ok {
+		t.Fatal("peer did not roam to its tcp endpoint")
+	}
+
+	// sending does not wait for a connection to be established
+
+	dev1.net.RLock()
+	tcpBind := dev1.net.tcpBind
+	dev1.net.RUnlock()
+	unreachable, _ := conn.CreateTCPEndpoint("192.0.2.1:51820")
+	start := time.Now()
+	if err := tcpBind.Send(make([]byte, MessageKeepaliveSize), unreachable); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("sending waited for the connection")
+	}
+
+	// a single host cannot open more than a few connections, the
+	// second device holding one already
+
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for i := 0; i < 8; i++ {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	last := conns[len(conns)-1]
+	last.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := last.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+		t.Fatal("connection beyond the limit of a host was not closed")
+	}
+
+	// the tcp sockets would escape a fwmark or an interface
+
+	if err := dev1.BindSetMark(1); err == nil {
+		t.Fatal("fwmark set along with tcp")
+	}
+	if err := dev1.BindSetInterface("lo"); err == nil {
+		t.Fatal("interface set along with tcp")
+	}
+	dev3 := NewDevice(tuntest.NewChannelTUN().TUN(), NewLogger(LogLevelError, "dev3: "))
+	defer dev3.Close()
+	if err := dev3.BindSetMark(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev3.SetTCPTransport(true); err == nil {
+		t.Fatal("tcp enabled along with a fwmark")
+	}
+}
+
+func TestKernelDrops(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("kernel drops are only reported on Linux")
+	}
+	bind, port, err := conn.CreateBind(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	counter, ok := bind.(conn.BindKernelDrops)
+	if !ok {
+		t.Fatal("bind does not report kernel drops")
+	}
+
+	// overflow the receive buffer of the socket, which nobody reads
+
+	sender, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	datagram := make([]byte, 1400)
+	for i := 0; i < 4096; i++ {
+		sender.Write(datagram)
+	}
+
+	// drops are reported along with the datagrams queued after them,
+	// which must still carry their packet info
+
+	buff := make([]byte, MaxMessageSize)
+	for i := 0; i < 8192 && counter.KernelDrops() == 0; i++ {
+		sender.Write(datagram)
+		_, endpoint, err := bind.ReceiveIPv4(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !endpoint.SrcIP().Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Fatalf("unexpected source of datagram: %v", endpoint.SrcIP())
+		}
+	}
+	if counter.KernelDrops() == 0 {
+		t.Error("no kernel drops reported")
+	}
+}
+
+// testPacketConn delivers datagrams in memory to the conns registered
+// in its network under their ports, all on 127.0.0.1.
+type testPacketConn struct {
+	addr    *net.UDPAddr
+	network *sync.Map // port -> *testPacketConn
+	inbound chan testDatagram
+	closed  chan struct{}
+	once    sync.Once
+}
+
+type testDatagram struct {
+	data []byte
+	addr net.Addr
+}
+
+func newTestPacketConn(network *sync.Map, port uint16) *testPacketConn {
+	pc := &testPacketConn{
+		addr:    &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1).To4(), Port: int(port)},
+		network: network,
+		inbound: make(chan testDatagram, 64),
+		closed:  make(chan struct{}),
+	}
+	network.Store(int(port), pc)
+	return pc
+}
+
+func (pc *testPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case datagram := <-pc.inbound:
+		return copy(b, datagram.data), datagram.addr, nil
+	case <-pc.closed:
+		return 0, nil, errors.New("test packet conn closed")
+	}
+}
+
+func (pc *testPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst, ok := pc.network.Load(addr.(*net.UDPAddr).Port)
+	if !ok {
+		return len(b), nil
+	}
+	select {
+	case dst.(*testPacketConn).inbound <- testDatagram{data: append([]byte(nil), b...), addr: pc.addr}:
+	default:
+	}
+	return len(b), nil
+}
+
+func (pc *testPacketConn) Close() error {
+	pc.once.Do(func() {
+		pc.network.Delete(pc.addr.Port)
+		close(pc.closed)
+	})
+	return nil
+}
+
+func (pc *testPacketConn) LocalAddr() net.Addr                { return pc.addr }
+func (pc *testPacketConn) SetDeadline(t time.Time) error      { return nil }
+func (pc *testPacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (pc *testPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestListenPacket(t *testing.T) {
+	var network sync.Map
+	sk1, _ := newPrivateKey()
+	sk2, _ := newPrivateKey()
+	pk1, pk2 := sk1.publicKey(), sk2.publicKey()
+
+	devices := make([]*Device, 2)
+	tuns := make([]*tuntest.ChannelTUN, 2)
+	for i, port := range []uint16{1001, 1002} {
+		port := port
+		tuns[i] = tuntest.NewChannelTUN()
+		dev, err := NewDeviceWithOptions(tuns[i].TUN(), NewLogger(LogLevelError, fmt.Sprintf("dev%d: ", i+1)), DeviceOptions{
+			ListenPacket: func(uint16) (net.PacketConn, error) {
+				return newTestPacketConn(&network, port), nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dev.Up()
+		defer dev.Close()
+		devices[i] = dev
+	}
+
+	cfg1 := fmt.Sprintf("private_key=%x\npublic_key=%x\nallowed_ip=1.0.0.2/32\n", sk1[:], pk2[:])
+	if err := devices[0].IpcSetOperation(bufio.NewReader(strings.NewReader(cfg1))); err != nil {
+		t.Fatal(err)
+	}
+	cfg2 := fmt.Sprintf("private_key=%x\npublic_key=%x\nallowed_ip=1.0.0.1/32\nendpoint=127.0.0.1:1001\n", sk2[:], pk1[:])
+	if err := devices[1].IpcSetOperation(bufio.NewReader(strings.NewReader(cfg2))); err != nil {
+		t.Fatal(err)
+	}
+	devices[0].net.RLock()
+	port := devices[0].net.port
+	devices[0].net.RUnlock()
+	if port != 1001 {
+		t.Fatalf("listening port %d, expected the port of the conn", port)
+	}
+
+	// the ping crosses the in-memory network, and its reply as well
+
+	msg2to1 := tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	tuns[1].Outbound <- msg2to1
+	select {
+	case msgRecv := <-tuns[0].Inbound:
+		if !bytes.Equal(msg2to1, msgRecv) {
+			t.Fatal("ping did not transit correctly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping did not transit over the packet conn")
+	}
+	msg1to2 := tuntest.Ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+	tuns[0].Outbound <- msg1to2
+	select {
+	case msgRecv := <-tuns[1].Inbound:
+		if !bytes.Equal(msg1to2, msgRecv) {
+			t.Fatal("return ping did not transit correctly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("return ping did not transit over the packet conn")
+	}
+}
+
+func TestSetTUN(t *testing.T) {
+	var network sync.Map
+	sk1, _ := newPrivateKey()
+	sk2, _ := newPrivateKey()
+	pk1, pk2 := sk1.publicKey(), sk2.publicKey()
+
+	devices := make([]*Device, 2)
+	tuns := make([]*tuntest.ChannelTUN, 2)
+	for i, port := range []uint16{1001, 1002} {
+		port := port
+		tuns[i] = tuntest.NewChannelTUN()
+		dev, err := NewDeviceWithOptions(tuns[i].TUN(), NewLogger(LogLevelError, fmt.Sprintf("dev%d: ", i+1)), DeviceOptions{
+			ListenPacket: func(uint16) (net.PacketConn, error) {
+				return newTestPacketConn(&network, port), nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dev.Up()
+		defer dev.Close()
+		devices[i] = dev
+	}
+
+	cfg1 := fmt.Sprintf("private_key=%x\npublic_key=%x\nallowed_ip=1.0.0.2/32\n", sk1[:], pk2[:])
+	if err := devices[0].IpcSetOperation(bufio.NewReader(strings.NewReader(cfg1))); err != nil {
+		t.Fatal(err)
+	}
+	cfg2 := fmt.Sprintf("private_key=%x\npublic_key=%x\nallowed_ip=1.0.0.1/32\nendpoint=127.0.0.1:1001\n", sk2[:], pk1[:])
+	if err := devices[1].IpcSetOperation(bufio.NewReader(strings.NewReader(cfg2))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old TUN device is closed, and packets flow through the new one both ways
+
+	old := tuns[0]
+	tuns[0] = tuntest.NewChannelTUN()
+	if err := devices[0].SetTUN(tuns[0].TUN()); err != nil {
+		t.Fatal(err)
+	}
+	for range old.TUN().Events() {
+	}
+
+	msg2to1 := tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	tuns[1].Outbound <- msg2to1
+	select {
+	case msgRecv := <-tuns[0].Inbound:
+		if !bytes.Equal(msg2to1, msgRecv) {
+			t.Fatal("ping did not transit correctly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping not written to the new TUN device")
+	}
+	msg1to2 := tuntest.Ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+	tuns[0].Outbound <- msg1to2
+	select {
+	case msgRecv := <-tuns[1].Inbound:
+		if !bytes.Equal(msg1to2, msgRecv) {
+			t.Fatal("return ping did not transit correctly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("return ping not read from the new TUN device")
+	}
+
+	devices[1].Close()
+	if err := devices[1].SetTUN(tuntest.NewChannelTUN().TUN()); err == nil {
+		t.Fatal("replaced the TUN device of a closed device")
+	}
+}
+
+func TestTransit(t *testing.T) {
+	var network sync.Map
+	var sks [3]NoisePrivateKey
+	var pks [3]NoisePublicKey
+	for i := range sks {
+		sks[i], _ = newPrivateKey()
+		pks[i] = sks[i].publicKey()
+	}
+
+	// the hub, without a TUN device of any use, relays between two peers
+
+	sink := tuntest.NewSinkTUN()
+	tuns := []*tuntest.ChannelTUN{tuntest.NewChannelTUN(), tuntest.NewChannelTUN()}
+	devices := make([]*Device, 3)
+	for i, port := range []uint16{1001, 1002, 1003} {
+		port := port
+		var tunDevice tun.Device = sink
+		if i > 0 {
+			tunDevice = tuns[i-1].TUN()
+		}
+		dev, err := NewDeviceWithOptions(tunDevice, NewLogger(LogLevelError, fmt.Sprintf("dev%d: ", i+1)), DeviceOptions{
+			ListenPacket: func(uint16) (net.PacketConn, error) {
+				return newTestPacketConn(&network, port), nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dev.Up()
+		defer dev.Close()
+		devices[i] = dev
+	}
+	devices[0].SetTransit(true)
+
+	configs := []string{
+		fmt.Sprintf("private_key=%x\npublic_key=%x\nallowed_ip=1.0.0.1/32\nendpoint=127.0.0.1:1002\npublic_key=%x\nallowed_ip=1.0.0.2/32\nendpoint=127.0.0.1:1003\n",
+			sks[0][:], pks[1][:], pks[2][:]),
+		fmt.Sprintf("private_key=%x\npublic_key=%x\nallowed_ip=1.0.0.2/32\nendpoint=127.0.0.1:1001\n", sks[1][:], pks[0][:]),
+		fmt.Sprintf("private_key=%x\npublic_key=%x\nallowed_ip=1.0.0.1/32\nendpoint=127.0.0.1:1001\n", sks[2][:], pks[0][:]),
+	}
+	for i, config := range configs {
+		if err := devices[i].IpcSetOperation(bufio.NewReader(strings.NewReader(config))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg1to2 := tuntest.Ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+	tuns[0].Outbound <- msg1to2
+	select {
+	case msgRecv := <-tuns[1].Inbound:
+		if !bytes.Equal(msg1to2, msgRecv) {
+			t.Fatal("ping did not transit correctly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping not relayed by the hub")
+	}
+	if forwarded := devices[0].Stats().Forwarded; forwarded != 1 {
+		t.Fatalf("hub forwarded %d packets, expected 1", forwarded)
+	}
+	if packets := sink.Packets(); packets != 0 {
+		t.Fatalf("hub wrote %d relayed packets to its TUN device", packets)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	result := device.SelfTest()
+	if !result.Passed() || result.Stage != selfTestStageDone {
+		t.Fatalf("self-test failed at %s: %v", result.Stage, result.Err)
+	}
+	if result.Handshake <= 0 || result.RoundTrip <= 0 {
+		t.Fatalf("unexpected durations: %+v", result)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+
+	routines := func(name string) []RoutineStatus {
+		var found []RoutineStatus
+		for _, routine := range device.Status().Routines {
+			if routine.Name == name {
+				found = append(found, routine)
+			}
+		}
+		return found
+	}
+	if workers := routines("handshake worker"); len(workers) != runtime.NumCPU() {
+		t.Fatalf("%d handshake workers running, expected %d", len(workers), runtime.NumCPU())
+	}
+	receivers := routines("sequential receiver")
+	if len(receivers) != 1 || receivers[0].Peer != peer.String() {
+		t.Fatalf("unexpected sequential receivers: %+v", receivers)
+	}
+	status := device.Status()
+	if depth, ok := status.InboundQueues[peer.handshake.remoteStatic]; !ok || depth != 0 || status.HandshakeQueue != 0 {
+		t.Fatalf("unexpected queue depths: %+v", status)
+	}
+
+	// a worker taking a message reports its activity
+
+	var last time.Time
+	for _, worker := range routines("handshake worker") {
+		if worker.LastActivity.After(last) {
+			last = worker.LastActivity
+		}
+	}
+	time.Sleep(time.Millisecond)
+	datagram := make([]byte, MessageInitiationSize)
+	binary.LittleEndian.PutUint32(datagram, MessageInitiationType)
+	if !receiveDatagram(t, device, datagram, "127.0.0.1:51820") {
+		t.Fatal("initiation not queued")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for active := false; !active; {
+		for _, worker := range routines("handshake worker") {
+			active = active || worker.LastActivity.After(last)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no handshake worker reported activity")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// stopped routines are gone
+
+	peer.Stop()
+	if receivers := routines("sequential receiver"); len(receivers) != 0 {
+		t.Fatalf("stopped sequential receivers reported: %+v", receivers)
+	}
+}
@@ -0,0 +1,68 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Emitted whenever a handshake with a peer completes, that is when the
+ * initiator receives the response or the responder receives the first
+ * message under the new keypair, and whenever the device gives up
+ * initiating one, see Device.SetHandshakeTimeout
+ */
+type HandshakeEvent struct {
+	PublicKey NoisePublicKey
+	Endpoint  conn.Endpoint // nil if the peer has no endpoint
+	Time      time.Time
+	Failed    bool // the handshake did not complete before the timeout
+}
+
+/* Returns the channel handshake events are delivered on
+ *
+ * Events are dropped, and counted in DeviceStats, rather than blocking the
+ * handshake when the channel is full, so the consumer should keep up.
+ */
+func (device *Device) HandshakeEvents() <-chan HandshakeEvent {
+	return device.events.handshakes
+}
+
+func (device *Device) HandshakeTimeout() time.Duration {
+	return device.events.handshakeTimeout.Load().(time.Duration)
+}
+
+/* Sets how long the device keeps retransmitting a handshake initiation,
+ * every RekeyTimeout, before giving up and emitting a failed handshake
+ * event; the default is RekeyAttemptTime
+ */
+func (device *Device) SetHandshakeTimeout(timeout time.Duration) error {
+	if timeout < RekeyTimeout {
+		return fmt.Errorf("handshake timeout %v shorter than the retransmission interval %v", timeout, RekeyTimeout)
+	}
+	device.events.handshakeTimeout.Store(timeout)
+	return nil
+}
+
+func (device *Device) emitHandshakeEvent(peer *Peer, failed bool) {
+	peer.RLock()
+	event := HandshakeEvent{
+		PublicKey: peer.handshake.remoteStatic,
+		Endpoint:  peer.endpoint,
+		Time:      time.Now(),
+		Failed:    failed,
+	}
+	peer.RUnlock()
+
+	select {
+	case device.events.handshakes <- event:
+	default:
+		atomic.AddUint64(&device.stats.eventsDropped, 1)
+	}
+}
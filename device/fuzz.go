@@ -0,0 +1,65 @@
+// +build gofuzz
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+/* Fuzz target of the message parsers, for go-fuzz:
+ *
+ *   go-fuzz-build -func Fuzz golang.zx2c4.com/wireguard/device
+ *   go-fuzz -bin device-fuzz.zip
+ *
+ * Besides panics, it catches parsers accepting what checkMessageSize
+ * rejects, and messages which do not marshal back to their input.
+ */
+func Fuzz(data []byte) int {
+	if len(data) < 4 {
+		return 0
+	}
+	msgType := binary.LittleEndian.Uint32(data[:4])
+	_, valid := checkMessageSize(msgType, len(data))
+
+	var (
+		msg interface{}
+		err error
+	)
+	switch msgType {
+	case MessageInitiationType:
+		msg, err = ParseInitiation(data)
+	case MessageResponseType:
+		msg, err = ParseResponse(data)
+	case MessageCookieReplyType:
+		msg, err = ParseCookieReply(data)
+	case MessageTransportType:
+		var transport MessageTransport
+		transport, err = ParseTransport(data)
+		if err == nil && len(transport.Content) != len(data)-MessageTransportOffsetContent {
+			panic("transport content does not span the remainder of the message")
+		}
+	default:
+		return 0
+	}
+	if (err == nil) != valid {
+		panic("parser disagrees with checkMessageSize")
+	}
+	if err != nil {
+		return 0
+	}
+
+	if msg != nil {
+		var buffer bytes.Buffer
+		binary.Write(&buffer, binary.LittleEndian, msg)
+		if !bytes.Equal(buffer.Bytes(), data) {
+			panic("message does not marshal back to its input")
+		}
+	}
+	return 1
+}
@@ -0,0 +1,179 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	icmpv4ProtocolNumber  = 1
+	icmpv4Unreachable     = 3
+	icmpv4AdminProhibited = 13
+	icmpv6ProtocolNumber  = 58
+	icmpv6Unreachable     = 1
+	icmpv6AdminProhibited = 1
+	icmpHeaderLen         = 8
+	icmpv6MinMTU          = 1280 // an ICMPv6 error must fit into the minimum MTU
+	icmpTTL               = 64
+)
+
+/* Builds an ICMP destination unreachable message, with the code for
+ * communication administratively prohibited, answering the packet
+ *
+ * Returns nil where no error must be sent (RFC 1812, RFC 4443): for ICMP
+ * errors, for fragments but the first, and for packets without a unicast
+ * source and destination.
+ */
+func unreachableICMP(packet []byte) []byte {
+	if len(packet) == 0 {
+		return nil
+	}
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		return unreachableICMPv4(packet)
+	case ipv6.Version:
+		return unreachableICMPv6(packet)
+	}
+	return nil
+}
+
+func unreachableICMPv4(packet []byte) []byte {
+	if len(packet) < ipv4.HeaderLen {
+		return nil
+	}
+	headerLen := int(packet[0]&0x0f) << 2
+	if headerLen < ipv4.HeaderLen || len(packet) < headerLen {
+		return nil
+	}
+	src := net.IP(packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len])
+	dst := net.IP(packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len])
+	if !isUnicast(src) || !isUnicast(dst) || src.Equal(net.IPv4bcast) || dst.Equal(net.IPv4bcast) {
+		return nil
+	}
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+		return nil
+	}
+	if packet[9] == icmpv4ProtocolNumber && len(packet) > headerLen {
+		switch packet[headerLen] {
+		case 3, 4, 5, 11, 12: // error messages
+			return nil
+		}
+	}
+
+	// quote the header and the first 8 bytes of the payload
+
+	quote := packet
+	if len(quote) > headerLen+8 {
+		quote = quote[:headerLen+8]
+	}
+
+	reply := make([]byte, ipv4.HeaderLen+icmpHeaderLen+len(quote))
+	ip := reply[:ipv4.HeaderLen]
+	ip[0] = ipv4.Version<<4 | ipv4.HeaderLen/4
+	binary.BigEndian.PutUint16(ip[IPv4offsetTotalLength:], uint16(len(reply)))
+	ip[8] = icmpTTL
+	ip[9] = icmpv4ProtocolNumber
+	copy(ip[IPv4offsetSrc:], dst)
+	copy(ip[IPv4offsetDst:], src)
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+	icmp := reply[ipv4.HeaderLen:]
+	icmp[0] = icmpv4Unreachable
+	icmp[1] = icmpv4AdminProhibited
+	copy(icmp[icmpHeaderLen:], quote)
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, 0))
+	return reply
+}
+
+func unreachableICMPv6(packet []byte) []byte {
+	if len(packet) < ipv6.HeaderLen {
+		return nil
+	}
+	src := net.IP(packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len])
+	dst := net.IP(packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len])
+	if !isUnicast(src) || !isUnicast(dst) {
+		return nil
+	}
+	if packet[6] == icmpv6ProtocolNumber && len(packet) > ipv6.HeaderLen && packet[ipv6.HeaderLen] < 128 {
+		return nil
+	}
+
+	// quote as much of the packet as fits into the minimum MTU
+
+	quote := packet
+	if max := icmpv6MinMTU - ipv6.HeaderLen - icmpHeaderLen; len(quote) > max {
+		quote = quote[:max]
+	}
+
+	reply := make([]byte, ipv6.HeaderLen+icmpHeaderLen+len(quote))
+	ip := reply[:ipv6.HeaderLen]
+	ip[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(ip[IPv6offsetPayloadLength:], uint16(icmpHeaderLen+len(quote)))
+	ip[6] = icmpv6ProtocolNumber
+	ip[7] = icmpTTL
+	copy(ip[IPv6offsetSrc:], dst)
+	copy(ip[IPv6offsetDst:], src)
+
+	icmp := reply[ipv6.HeaderLen:]
+	icmp[0] = icmpv6Unreachable
+	icmp[1] = icmpv6AdminProhibited
+	copy(icmp[icmpHeaderLen:], quote)
+
+	// the checksum covers a pseudo header of addresses, length and protocol
+
+	sum := pseudoHeaderSum(ip[IPv6offsetSrc:ipv6.HeaderLen], icmpv6ProtocolNumber, len(icmp))
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, sum))
+	return reply
+}
+
+func isUnicast(ip net.IP) bool {
+	return !ip.IsUnspecified() && !ip.IsMulticast()
+}
+
+/* Answers a packet read from the TUN device, for which there is no peer,
+ * with an ICMP error, if enabled; the errors sent to each source are
+ * rate limited
+ */
+func (device *Device) sendUnreachable(packet []byte) {
+	if !device.tun.unreachableICMP.Get() {
+		return
+	}
+	reply := unreachableICMP(packet)
+	if reply == nil {
+		return
+	}
+	var src net.IP
+	if reply[0]>>4 == ipv4.Version {
+		src = net.IP(reply[IPv4offsetDst : IPv4offsetDst+net.IPv4len])
+	} else {
+		src = net.IP(reply[IPv6offsetDst : IPv6offsetDst+net.IPv6len])
+	}
+	if !device.rate.icmpLimiter.Allow(src) {
+		return
+	}
+
+	buffer := device.GetMessageBuffer()
+	defer device.PutMessageBuffer(buffer)
+	offset := MessageTransportOffsetContent
+	size := copy(buffer[offset:], reply)
+	if _, err := device.tunDevice().Write(buffer[:offset+size], offset); err != nil {
+		device.log.Debug.Println("Failed to write ICMP error to TUN device:", err)
+	}
+}
+
+/* Enables answering packets routed to the device, but not to any peer,
+ * with ICMP destination unreachable, communication administratively
+ * prohibited, so applications fail fast instead of timing out; by default
+ * such packets are silently dropped
+ */
+func (device *Device) SetUnreachableICMP(enable bool) {
+	device.tun.unreachableICMP.Set(enable)
+}
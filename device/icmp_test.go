@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestUnreachableICMP(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+
+	local := net.IPv4(1, 0, 0, 1)
+	unrouted := net.IPv4(1, 0, 0, 9)
+	packet := testIPv4Packet(local, unrouted, []byte("no route to this peer"))
+
+	// silently dropped by default
+
+	tun.Outbound <- packet
+	select {
+	case <-tun.Inbound:
+		t.Fatal("ICMP error sent while disabled")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	device.SetUnreachableICMP(true)
+	tun.Outbound <- packet
+	var reply []byte
+	select {
+	case reply = <-tun.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ICMP error sent")
+	}
+
+	if len(reply) != ipv4.HeaderLen+icmpHeaderLen+ipv4.HeaderLen+8 {
+		t.Fatalf("ICMP error of %d bytes", len(reply))
+	}
+	if checksum(reply[:ipv4.HeaderLen], 0) != 0 || checksum(reply[ipv4.HeaderLen:], 0) != 0 {
+		t.Fatal("invalid checksum")
+	}
+	if !net.IP(reply[IPv4offsetSrc:IPv4offsetSrc+4]).Equal(unrouted) || !net.IP(reply[IPv4offsetDst:IPv4offsetDst+4]).Equal(local) {
+		t.Fatal("ICMP error not addressed to the sender")
+	}
+	icmp := reply[ipv4.HeaderLen:]
+	if icmp[0] != icmpv4Unreachable || icmp[1] != icmpv4AdminProhibited {
+		t.Fatalf("ICMP type %d code %d", icmp[0], icmp[1])
+	}
+	if !bytes.Equal(icmp[icmpHeaderLen:], packet[:ipv4.HeaderLen+8]) {
+		t.Fatal("ICMP error does not quote the packet")
+	}
+
+	// errors are never answered with errors
+
+	if unreachableICMP(reply) != nil {
+		t.Fatal("ICMP error answered")
+	}
+}
+
+func TestUnreachableICMPv6(t *testing.T) {
+	src := net.ParseIP("fd00::1")
+	dst := net.ParseIP("fd00::2")
+	packet := make([]byte, ipv6.HeaderLen+2000)
+	packet[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(packet[IPv6offsetPayloadLength:], 2000)
+	packet[6] = 17
+	copy(packet[IPv6offsetSrc:], src)
+	copy(packet[IPv6offsetDst:], dst)
+
+	reply := unreachableICMP(packet)
+	if len(reply) != icmpv6MinMTU {
+		t.Fatalf("ICMPv6 error of %d bytes, expected %d", len(reply), icmpv6MinMTU)
+	}
+	icmp := reply[ipv6.HeaderLen:]
+	var sum uint32
+	for i := IPv6offsetSrc; i < ipv6.HeaderLen; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(reply[i:]))
+	}
+	sum += uint32(len(icmp)) + icmpv6ProtocolNumber
+	if checksum(icmp, sum) != 0 {
+		t.Fatal("invalid checksum")
+	}
+	if icmp[0] != icmpv6Unreachable || icmp[1] != icmpv6AdminProhibited {
+		t.Fatalf("ICMPv6 type %d code %d", icmp[0], icmp[1])
+	}
+
+	// nothing is sent for multicast destinations
+
+	copy(packet[IPv6offsetDst:], net.ParseIP("ff02::1"))
+	if unreachableICMP(packet) != nil {
+		t.Fatal("multicast packet answered")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"sync"
+	"time"
 )
 
 type IndexTableEntry struct {
@@ -41,6 +42,36 @@ func (table *IndexTable) Delete(index uint32) {
 	delete(table.table, index)
 }
 
+/* Deletes the index only while it still maps to the keypair, as the
+ * sweeper may have reaped it and the index been handed out again since
+ */
+func (table *IndexTable) DeleteForKeypair(index uint32, keypair *Keypair) {
+	table.Lock()
+	defer table.Unlock()
+	if entry, ok := table.table[index]; ok && entry.keypair == keypair {
+		delete(table.table, index)
+	}
+}
+
+/* Deletes the indices of keypairs past RejectAfterTime, which can no longer
+ * receive, returning how many were deleted
+ *
+ * Their keypairs may still be held by the peers until the next rotation,
+ * but messages for them are rejected regardless of the index.
+ */
+func (table *IndexTable) SweepKeypairs(now time.Time) int {
+	table.Lock()
+	defer table.Unlock()
+	reaped := 0
+	for index, entry := range table.table {
+		if entry.keypair != nil && now.Sub(entry.keypair.created) >= RejectAfterTime {
+			delete(table.table, index)
+			reaped++
+		}
+	}
+	return reaped
+}
+
 func (table *IndexTable) SwapIndexForKeypair(index uint32, keypair *Keypair) {
 	table.Lock()
 	defer table.Unlock()
@@ -55,6 +86,23 @@ func (table *IndexTable) SwapIndexForKeypair(index uint32, keypair *Keypair) {
 	}
 }
 
+/* Registers a keypair under an index chosen elsewhere, such as that of a
+ * session imported from another device, unless the index is taken
+ */
+func (table *IndexTable) InsertKeypair(index uint32, peer *Peer, keypair *Keypair) bool {
+	table.Lock()
+	defer table.Unlock()
+	if _, ok := table.table[index]; ok {
+		return false
+	}
+	table.table[index] = IndexTableEntry{
+		peer:      peer,
+		keypair:   keypair,
+		handshake: nil,
+	}
+	return true
+}
+
 func (table *IndexTable) NewIndexForHandshake(peer *Peer, handshake *Handshake) (uint32, error) {
 	for {
 		// generate random index
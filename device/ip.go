@@ -6,7 +6,12 @@
 package device
 
 import (
+	"encoding/binary"
 	"net"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 const (
@@ -15,8 +20,180 @@ const (
 	IPv4offsetDst         = IPv4offsetSrc + net.IPv4len
 )
 
+const (
+	ecnMask = 0x03 // explicit congestion notification bits of the ToS / traffic class
+)
+
 const (
 	IPv6offsetPayloadLength = 4
 	IPv6offsetSrc           = 8
 	IPv6offsetDst           = IPv6offsetSrc + net.IPv6len
 )
+
+/* The type of service (IPv4) or traffic class (IPv6) of a packet, whose
+ * IP header has already been checked, without its ECN bits
+ */
+func innerDSCP(packet []byte) uint8 {
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		return packet[1] &^ ecnMask
+	case ipv6.Version:
+		return (packet[0]<<4 | packet[1]>>4) &^ ecnMask
+	}
+	return 0
+}
+
+const (
+	tcpProtocolNumber = 6
+	udpProtocolNumber = 17
+	tcpHeaderLen      = 20
+	udpHeaderLen      = 8
+)
+
+/* The internet checksum of RFC 1071, continuing from a partial sum
+ */
+func checksum(buf []byte, sum uint32) uint16 {
+	for ; len(buf) >= 2; buf = buf[2:] {
+		sum += uint32(binary.BigEndian.Uint16(buf))
+	}
+	if len(buf) == 1 {
+		sum += uint32(buf[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+/* Partial sum of the pseudo header covered by TCP, UDP and ICMPv6
+ * checksums, given the source and destination addresses back to back
+ */
+func pseudoHeaderSum(addrs []byte, protocol uint8, length int) uint32 {
+	var sum uint32
+	for i := 0; i+1 < len(addrs); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(addrs[i:]))
+	}
+	return sum + uint32(protocol) + uint32(length)
+}
+
+/* Hashes the addresses, protocol and ports of a packet, whose IP header
+ * has already been checked, so that the packets of a flow hash alike
+ *
+ * Ports are left out of fragments, which do not all carry them.
+ */
+func flowHash(packet []byte) uint32 {
+	var protocol uint8
+	var addrs, payload []byte
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		headerLen := int(packet[0]&0x0f) << 2
+		protocol = packet[9]
+		addrs = packet[IPv4offsetSrc : IPv4offsetDst+net.IPv4len]
+		if binary.BigEndian.Uint16(packet[6:8])&0x3fff == 0 {
+			payload = packet[headerLen:]
+		}
+	case ipv6.Version:
+		protocol = packet[6]
+		addrs = packet[IPv6offsetSrc : IPv6offsetDst+net.IPv6len]
+		payload = packet[ipv6.HeaderLen:]
+	}
+
+	// FNV-1a
+
+	hash := uint32(2166136261)
+	add := func(data []byte) {
+		for _, b := range data {
+			hash ^= uint32(b)
+			hash *= 16777619
+		}
+	}
+	add(addrs)
+	add([]byte{protocol})
+	if (protocol == tcpProtocolNumber || protocol == udpProtocolNumber) && len(payload) >= 4 {
+		add(payload[:4])
+	}
+	return hash
+}
+
+/* Which checksums of decrypted packets are validated, see
+ * Device.SetChecksumValidation
+ */
+type ChecksumValidation uint32
+
+const (
+	ChecksumValidationOff ChecksumValidation = iota
+	ChecksumValidationIP                     // IPv4 header checksums
+	ChecksumValidationAll                    // also TCP, UDP and ICMP checksums
+)
+
+/* Validates the checksums of a decrypted packet, whose IP header has
+ * already been checked and whose padding has been stripped
+ *
+ * Transport checksums are only validated for unfragmented packets whose
+ * IPv6 header is not followed by extension headers.
+ */
+func validChecksums(packet []byte, validation ChecksumValidation) bool {
+	if validation == ChecksumValidationOff {
+		return true
+	}
+
+	var protocol uint8
+	var addrs, payload []byte
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		headerLen := int(packet[0]&0x0f) << 2
+		if checksum(packet[:headerLen], 0) != 0 {
+			return false
+		}
+		if binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0 { // more fragments or offset
+			return true
+		}
+		protocol = packet[9]
+		addrs = packet[IPv4offsetSrc : IPv4offsetDst+net.IPv4len]
+		payload = packet[headerLen:]
+	case ipv6.Version:
+		protocol = packet[6]
+		addrs = packet[IPv6offsetSrc : IPv6offsetDst+net.IPv6len]
+		payload = packet[ipv6.HeaderLen:]
+	default:
+		return true
+	}
+	if validation != ChecksumValidationAll {
+		return true
+	}
+
+	switch protocol {
+	case tcpProtocolNumber:
+		if len(payload) < tcpHeaderLen {
+			return false
+		}
+	case udpProtocolNumber:
+		if len(payload) < udpHeaderLen {
+			return false
+		}
+		if len(addrs) == 2*net.IPv4len && binary.BigEndian.Uint16(payload[6:8]) == 0 {
+			return true // no checksum
+		}
+	case icmpv4ProtocolNumber:
+		return len(addrs) != 2*net.IPv4len || checksum(payload, 0) == 0
+	case icmpv6ProtocolNumber:
+		if len(addrs) != 2*net.IPv6len {
+			return true
+		}
+	default:
+		return true
+	}
+	return checksum(payload, pseudoHeaderSum(addrs, protocol, len(payload))) == 0
+}
+
+/* Enables validating the checksums of decrypted packets before they are
+ * written to the TUN device, dropping and counting those which fail
+ *
+ * As the AEAD already protects packets on the wire, a failure points at
+ * a bug in handling the packet, or at a peer sending corrupt packets; this
+ * is meant for diagnosing such problems and costs CPU, so it is off by
+ * default.
+ */
+func (device *Device) SetChecksumValidation(validation ChecksumValidation) {
+	atomic.StoreUint32(&device.checksums, uint32(validation))
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 	"unsafe"
 
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.zx2c4.com/wireguard/replay"
 )
 
@@ -24,6 +25,8 @@ import (
 
 type Keypair struct {
 	sendNonce    uint64
+	failures     uint64 // consecutive decryption failures, accessed atomically
+	failuresNano int64  // time of the first of them, accessed atomically
 	send         cipher.AEAD
 	receive      cipher.AEAD
 	replayFilter replay.ReplayFilter
@@ -31,6 +34,40 @@ type Keypair struct {
 	created      time.Time
 	localIndex   uint32
 	remoteIndex  uint32
+	peer         *Peer
+	decrypted    AtomicBool // a message of the peer was authenticated with it
+
+	// keys of the AEADs, kept to export the session, see ExportSessions
+
+	sendKey    [chacha20poly1305.KeySize]byte
+	receiveKey [chacha20poly1305.KeySize]byte
+}
+
+/* Reserves the next nonce for sending, or fails once the keypair
+ * has used RejectAfterMessages nonces; from then on it must not be used
+ * again, as reusing a nonce would break the AEAD construction
+ */
+func (keypair *Keypair) nextSendNonce() (uint64, bool) {
+	nonce := atomic.AddUint64(&keypair.sendNonce, 1) - 1
+	if nonce >= RejectAfterMessages {
+		atomic.StoreUint64(&keypair.sendNonce, RejectAfterMessages)
+		return 0, false
+	}
+	return nonce, true
+}
+
+func (keypair *Keypair) isExhausted() bool {
+	return atomic.LoadUint64(&keypair.sendNonce) >= RejectAfterMessages
+}
+
+/* Reports whether traffic flows over the keypair: it is neither past
+ * RejectAfterTime nor exhausted, and has decrypted or sent a message
+ */
+func (keypair *Keypair) isActive(now time.Time) bool {
+	if now.Sub(keypair.created) >= RejectAfterTime || keypair.isExhausted() {
+		return false
+	}
+	return keypair.decrypted.Get() || atomic.LoadUint64(&keypair.sendNonce) > 0
 }
 
 type Keypairs struct {
@@ -56,6 +93,43 @@ func (kp *Keypairs) Current() *Keypair {
 
 func (device *Device) DeleteKeypair(key *Keypair) {
 	if key != nil {
-		device.indexTable.Delete(key.localIndex)
+		device.indexTable.DeleteForKeypair(key.localIndex, key)
+	}
+}
+
+/* Sweeps the index table once, see IndexTable.SweepKeypairs
+ */
+func (device *Device) sweepIndices(now time.Time) int {
+	reaped := device.indexTable.SweepKeypairs(now)
+	atomic.AddUint64(&device.stats.indicesReaped, uint64(reaped))
+	return reaped
+}
+
+func (device *Device) RoutineSweepIndices() {
+	logDebug := device.log.Debug
+
+	ticker := time.NewTicker(indexSweepInterval)
+	defer func() {
+		ticker.Stop()
+		logDebug.Println("Routine: index sweeper - stopped")
+		device.state.stopping.Done()
+	}()
+
+	beat := device.startHeartbeat("index sweeper", nil)
+	defer device.stopHeartbeat(beat)
+
+	logDebug.Println("Routine: index sweeper - started")
+	device.state.starting.Done()
+
+	for {
+		select {
+		case <-ticker.C:
+			beat.beat()
+			if reaped := device.sweepIndices(device.now()); reaped > 0 {
+				logDebug.Println("Reaped", reaped, "indices of rejected keypairs")
+			}
+		case <-device.signals.stop:
+			return
+		}
 	}
 }
@@ -0,0 +1,277 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// handshakeInitiated reports whether the peer recently sent an initiation.
+func handshakeInitiated(peer *Peer) bool {
+	peer.handshake.mutex.RLock()
+	defer peer.handshake.mutex.RUnlock()
+	return time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout
+}
+
+// TestKeypairAlignment checks that atomically-accessed fields are
+// aligned to 64-bit boundaries, as required by the atomic package.
+func TestKeypairAlignment(t *testing.T) {
+	var kp Keypair
+	checkAlignment(t, "Keypair.sendNonce", unsafe.Offsetof(kp.sendNonce))
+	checkAlignment(t, "Keypair.failures", unsafe.Offsetof(kp.failures))
+	checkAlignment(t, "Keypair.failuresNano", unsafe.Offsetof(kp.failuresNano))
+	checkAlignment(t, "Keypair.replayFilter", unsafe.Offsetof(kp.replayFilter))
+}
+
+func TestKeypairNonceExhaustion(t *testing.T) {
+	keypair := newTestKeypair(t)
+	keypair.sendNonce = RejectAfterMessages - 2
+
+	for _, expected := range []uint64{RejectAfterMessages - 2, RejectAfterMessages - 1} {
+		nonce, ok := keypair.nextSendNonce()
+		if !ok || nonce != expected {
+			t.Fatalf("got nonce %d (%v), expected %d", nonce, ok, expected)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := keypair.nextSendNonce(); ok {
+			t.Fatal("nonce handed out past RejectAfterMessages")
+		}
+		if !keypair.isExhausted() {
+			t.Fatal("keypair not marked as exhausted")
+		}
+	}
+	if keypair.sendNonce != RejectAfterMessages {
+		t.Fatalf("send nonce moved past the limit to %d", keypair.sendNonce)
+	}
+}
+
+func TestExhaustedKeypairRekeys(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+	keypair := newTestKeypair(t)
+	keypair.sendNonce = RejectAfterMessages - 1
+	peer.keypairs.Lock()
+	peer.keypairs.current = keypair
+	peer.keypairs.Unlock()
+
+	// the first packet takes the last nonce, the second initiates a handshake
+
+	for i := 0; i < 2; i++ {
+		elem := device.NewOutboundElement()
+		elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+1]
+		peer.queue.nonce <- elem
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if handshakeInitiated(peer) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no handshake initiated for exhausted keypair")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !keypair.isExhausted() {
+		t.Fatal("keypair not marked as exhausted")
+	}
+
+	// the second packet waits for the new keypair rather than being dropped
+
+	fresh := newTestKeypair(t)
+	peer.keypairs.Lock()
+	peer.keypairs.current = fresh
+	peer.keypairs.Unlock()
+	peer.signals.newKeypairArrived <- struct{}{}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&fresh.sendNonce) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("packet not sent over the new keypair")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRekeyAfterTime(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+	keypair := newTestKeypair(t)
+	keypair.isInitiator = true
+	keypair.created = time.Now().Add(-RekeyAfterTime)
+	peer.keypairs.Lock()
+	peer.keypairs.current = keypair
+	peer.keypairs.Unlock()
+
+	expiredRekey(peer)
+	if handshakeInitiated(peer) {
+		t.Fatal("rekeyed unused keypair")
+	}
+
+	keypair.sendNonce = 1
+	expiredRekey(peer)
+	if !handshakeInitiated(peer) {
+		t.Fatal("did not rekey keypair after RekeyAfterTime")
+	}
+}
+
+func TestSweepIndices(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+	now := time.Now()
+
+	// map one index to a fresh keypair, one to a rejected keypair
+
+	indices := make(map[uint32]*Keypair)
+	for _, age := range []time.Duration{0, RejectAfterTime} {
+		index, err := device.indexTable.NewIndexForHandshake(peer, &peer.handshake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keypair := newTestKeypair(t)
+		keypair.created = now.Add(-age)
+		keypair.localIndex = index
+		device.indexTable.SwapIndexForKeypair(index, keypair)
+		indices[index] = keypair
+	}
+
+	if reaped := device.sweepIndices(now); reaped != 1 {
+		t.Fatalf("reaped %d indices, expected 1", reaped)
+	}
+	if reaped := device.Stats().IndicesReaped; reaped != 1 {
+		t.Fatalf("counted %d reaped indices, expected 1", reaped)
+	}
+	for index, keypair := range indices {
+		fresh := keypair.created.Equal(now)
+		if entry := device.indexTable.Lookup(index); (entry.keypair != nil) != fresh {
+			t.Fatalf("index of keypair created %v ago not kept %v", now.Sub(keypair.created), fresh)
+		}
+	}
+
+	// deleting a reaped keypair leaves its index to a later owner
+
+	for index, keypair := range indices {
+		if keypair.created.Equal(now) {
+			continue
+		}
+		device.indexTable.Lock()
+		device.indexTable.table[index] = IndexTableEntry{peer: peer, handshake: &peer.handshake}
+		device.indexTable.Unlock()
+		device.DeleteKeypair(keypair)
+		if device.indexTable.Lookup(index).handshake == nil {
+			t.Fatal("deleting a reaped keypair deleted the index of its successor")
+		}
+	}
+}
+
+func TestKeypairInfo(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+	if info := peer.Stats().Keypair; info != nil {
+		t.Fatalf("keypair reported before any handshake: %+v", info)
+	}
+
+	keypair := newTestKeypair(t)
+	keypair.created = time.Now().Add(-RekeyAfterTime)
+	keypair.sendNonce = RejectAfterMessages - 10
+	peer.keypairs.Lock()
+	peer.keypairs.current = keypair
+	peer.keypairs.Unlock()
+
+	info := peer.Stats().Keypair
+	if info == nil || info.Age < RekeyAfterTime || info.Lifetime > RejectAfterTime-RekeyAfterTime || info.MessagesLeft != 10 {
+		t.Fatalf("unexpected keypair info: %+v", info)
+	}
+
+	// past its limits, nothing is left
+
+	keypair.created = time.Now().Add(-RejectAfterTime - time.Second)
+	keypair.sendNonce = RejectAfterMessages
+	if info := peer.Stats().Keypair; info.Lifetime != 0 || info.MessagesLeft != 0 {
+		t.Fatalf("unexpected keypair info of expired keypair: %+v", info)
+	}
+}
+
+func TestHasActiveSession(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+	if peer.HasActiveSession() {
+		t.Fatal("active session reported before any handshake")
+	}
+
+	// a fresh keypair is only active once used
+
+	keypair := newTestKeypair(t)
+	peer.keypairs.Lock()
+	peer.keypairs.current = keypair
+	peer.keypairs.Unlock()
+	if peer.HasActiveSession() {
+		t.Fatal("active session reported for an unused keypair")
+	}
+	device.decryptSucceeded(keypair)
+	if !peer.HasActiveSession() || !device.Peers()[0].ActiveSession {
+		t.Fatal("no active session reported after a decryption")
+	}
+
+	sent := newTestKeypair(t)
+	sent.sendNonce = 1
+	peer.keypairs.Lock()
+	peer.keypairs.current = sent
+	peer.keypairs.Unlock()
+	if !peer.HasActiveSession() {
+		t.Fatal("no active session reported after a send")
+	}
+
+	// expired or exhausted keypairs are not
+
+	sent.created = time.Now().Add(-RejectAfterTime)
+	if peer.HasActiveSession() {
+		t.Fatal("active session reported for an expired keypair")
+	}
+	sent.created = time.Now()
+	sent.sendNonce = RejectAfterMessages
+	if peer.HasActiveSession() || device.Peers()[0].ActiveSession {
+		t.Fatal("active session reported for an exhausted keypair")
+	}
+}
+
+func TestHandshakeLatency(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+
+	if stats := peer.Stats(); stats.HandshakeLatency != 0 || stats.HandshakeLatencyAvg != 0 {
+		t.Fatalf("handshake latency reported before any handshake: %+v", stats)
+	}
+	peer.observeHandshakeLatency(100 * time.Millisecond)
+	if stats := peer.Stats(); stats.HandshakeLatency != 100*time.Millisecond || stats.HandshakeLatencyAvg != 100*time.Millisecond {
+		t.Fatalf("unexpected latency of the first handshake: %+v", stats)
+	}
+
+	// the average follows the latest latency only by its weight
+
+	peer.observeHandshakeLatency(600 * time.Millisecond)
+	stats := peer.Stats()
+	expected := 100*time.Millisecond + time.Duration(float64(500*time.Millisecond)*rateAverageWeight)
+	if stats.HandshakeLatency != 600*time.Millisecond || stats.HandshakeLatencyAvg != expected {
+		t.Fatalf("unexpected latencies %v, average %v, expected average %v", stats.HandshakeLatency, stats.HandshakeLatencyAvg, expected)
+	}
+}
@@ -6,10 +6,13 @@
 package device
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"sync"
+	"time"
 )
 
 const (
@@ -57,3 +60,186 @@ func NewLogger(level int, prepend string) *Logger {
 	)
 	return logger
 }
+
+/* Receives log messages along with structured fields,
+ * given as alternating keys and values
+ */
+type LogSink interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+/* Adapts a Logger to a LogSink, appending the fields
+ * to the message as key=value pairs
+ */
+func (logger *Logger) Sink() LogSink {
+	return loggerSink{logger}
+}
+
+type loggerSink struct {
+	logger *Logger
+}
+
+/* The methods of loggerSink only format the fields of messages which are
+ * logged, those of discarded levels cost no more than the call
+ */
+func (sink loggerSink) Debug(msg string, keyvals ...interface{}) {
+	if sink.enabled(LogLevelDebug) {
+		sink.logger.Debug.Println(formatKeyvals(msg, keyvals)...)
+	}
+}
+
+func (sink loggerSink) Info(msg string, keyvals ...interface{}) {
+	if sink.enabled(LogLevelInfo) {
+		sink.logger.Info.Println(formatKeyvals(msg, keyvals)...)
+	}
+}
+
+func (sink loggerSink) Error(msg string, keyvals ...interface{}) {
+	if sink.enabled(LogLevelError) {
+		sink.logger.Error.Println(formatKeyvals(msg, keyvals)...)
+	}
+}
+
+func (sink loggerSink) enabled(level int) bool {
+	switch level {
+	case LogLevelDebug:
+		return sink.logger.Debug.Writer() != ioutil.Discard
+	case LogLevelInfo:
+		return sink.logger.Info.Writer() != ioutil.Discard
+	default:
+		return sink.logger.Error.Writer() != ioutil.Discard
+	}
+}
+
+/* Implemented by sinks which can tell whether they discard the messages
+ * of a level; others are taken to log all levels
+ */
+type leveledSink interface {
+	enabled(level int) bool
+}
+
+func logEnabled(sink LogSink, level int) bool {
+	leveled, ok := sink.(leveledSink)
+	return !ok || leveled.enabled(level)
+}
+
+func formatKeyvals(msg string, keyvals []interface{}) []interface{} {
+	args := make([]interface{}, 1, 1+(len(keyvals)+1)/2)
+	args[0] = msg
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 == len(keyvals) {
+			args = append(args, fmt.Sprintf("%v=(missing)", keyvals[i]))
+			break
+		}
+		args = append(args, fmt.Sprintf("%v=%v", keyvals[i], keyvals[i+1]))
+	}
+	return args
+}
+
+/* Limits how often messages with the same template are logged, so that
+ * packets arriving at line rate, as during an attack, do not flood the log
+ *
+ * Once a template exceeds its burst within an interval, further messages
+ * are counted instead, and a summary of them is logged when the interval
+ * ends. Templates are the constant messages of the call sites, which
+ * bounds the number of entries.
+ */
+type logLimiter struct {
+	sync.Mutex
+	entries map[string]*logLimiterEntry
+}
+
+type logLimiterEntry struct {
+	start      time.Time
+	logged     int
+	suppressed int
+	log        func(msg string, keyvals ...interface{}) // logs the summary
+}
+
+func (limiter *logLimiter) allow(msg string, log func(string, ...interface{}), now time.Time) bool {
+	limiter.Lock()
+	entry, ok := limiter.entries[msg]
+	if !ok {
+		if limiter.entries == nil {
+			limiter.entries = make(map[string]*logLimiterEntry)
+		}
+		entry = &logLimiterEntry{start: now}
+		limiter.entries[msg] = entry
+	}
+	summary, suppressed := entry.log, 0
+	if now.Sub(entry.start) >= logLimitInterval {
+		suppressed = entry.suppressed
+		entry.start, entry.logged, entry.suppressed = now, 0, 0
+	}
+	allowed := entry.logged < logLimitBurst
+	if allowed {
+		entry.logged++
+	} else {
+		entry.suppressed++
+		entry.log = log
+	}
+	limiter.Unlock()
+
+	if suppressed > 0 {
+		summary(fmt.Sprintf("%s (%d suppressed)", msg, suppressed))
+	}
+	return allowed
+}
+
+/* Logs the summaries of intervals which have ended,
+ * forgetting templates which were not logged during them
+ */
+func (limiter *logLimiter) flush(now time.Time) {
+	type summary struct {
+		msg        string
+		suppressed int
+		log        func(string, ...interface{})
+	}
+	var summaries []summary
+
+	limiter.Lock()
+	for msg, entry := range limiter.entries {
+		if now.Sub(entry.start) < logLimitInterval {
+			continue
+		}
+		if entry.suppressed == 0 {
+			delete(limiter.entries, msg)
+			continue
+		}
+		summaries = append(summaries, summary{msg, entry.suppressed, entry.log})
+		entry.start, entry.logged, entry.suppressed = now, 0, 0
+	}
+	limiter.Unlock()
+
+	for _, s := range summaries {
+		s.log(fmt.Sprintf("%s (%d suppressed)", s.msg, s.suppressed))
+	}
+}
+
+type limitedSink struct {
+	sink    LogSink
+	limiter *logLimiter
+}
+
+/* The methods of limitedSink check the level first, so that messages which
+ * are discarded anyway do not contend for the limiter
+ */
+func (sink limitedSink) Debug(msg string, keyvals ...interface{}) {
+	if logEnabled(sink.sink, LogLevelDebug) && sink.limiter.allow(msg, sink.sink.Debug, time.Now()) {
+		sink.sink.Debug(msg, keyvals...)
+	}
+}
+
+func (sink limitedSink) Info(msg string, keyvals ...interface{}) {
+	if logEnabled(sink.sink, LogLevelInfo) && sink.limiter.allow(msg, sink.sink.Info, time.Now()) {
+		sink.sink.Info(msg, keyvals...)
+	}
+}
+
+func (sink limitedSink) Error(msg string, keyvals ...interface{}) {
+	if logEnabled(sink.sink, LogLevelError) && sink.limiter.allow(msg, sink.sink.Error, time.Now()) {
+		sink.sink.Error(msg, keyvals...)
+	}
+}
@@ -0,0 +1,83 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogLimiter(t *testing.T) {
+	var (
+		limiter logLimiter
+		sink    recordingSink
+	)
+	start := time.Now()
+
+	// a burst is logged, the rest of the interval suppressed
+
+	logged := 0
+	for i := 0; i < 3*logLimitBurst; i++ {
+		if limiter.allow("noisy", sink.Info, start) {
+			logged++
+		}
+	}
+	if logged != logLimitBurst {
+		t.Fatalf("logged %d messages, expected %d", logged, logLimitBurst)
+	}
+	if !limiter.allow("other", sink.Info, start) {
+		t.Fatal("message of another template suppressed")
+	}
+
+	// the summary follows once the interval has ended
+
+	limiter.flush(start.Add(logLimitInterval / 2))
+	if len(sink.infos) != 0 {
+		t.Fatal("summary logged before the interval ended")
+	}
+	limiter.flush(start.Add(logLimitInterval))
+	if len(sink.infos) != 1 || sink.infos[0]["msg"] != "noisy (10 suppressed)" {
+		t.Fatalf("unexpected summaries: %v", sink.infos)
+	}
+	if _, ok := limiter.entries["other"]; ok {
+		t.Fatal("idle template not forgotten")
+	}
+
+	// without a flush, the next message logs the summary
+
+	for i := 0; i < logLimitBurst+2; i++ {
+		limiter.allow("noisy", sink.Info, start.Add(logLimitInterval))
+	}
+	if !limiter.allow("noisy", sink.Info, start.Add(2*logLimitInterval)) {
+		t.Fatal("message suppressed in a new interval")
+	}
+	if len(sink.infos) != 2 || sink.infos[1]["msg"] != "noisy (2 suppressed)" {
+		t.Fatalf("unexpected summaries: %v", sink.infos)
+	}
+}
+
+func TestLimitedSinkLevel(t *testing.T) {
+	var limiter logLimiter
+	sink := limitedSink{NewLogger(LogLevelError, "").Sink(), &limiter}
+
+	// messages below the level of the logger do not reach the limiter
+
+	sink.Debug("debug")
+	sink.Info("info")
+	if len(limiter.entries) != 0 {
+		t.Fatalf("discarded messages reached the limiter: %v", limiter.entries)
+	}
+	sink.Error("error")
+	if _, ok := limiter.entries["error"]; !ok {
+		t.Fatal("logged message did not reach the limiter")
+	}
+
+	// sinks which cannot tell their level log everything
+
+	if !logEnabled(new(recordingSink), LogLevelDebug) {
+		t.Fatal("sink without level discards messages")
+	}
+}
@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/poly1305"
+)
+
+/* Parsers of the messages received, free of any state of the device,
+ * so they can be fuzzed on their own (see fuzz.go)
+ *
+ * Handshake related messages must have exactly their size, transport
+ * messages at least the size of an empty one, as checkMessageSize
+ * enforces before messages are queued.
+ */
+
+// the fields of a transport message lie within the smallest one, so
+// slicing them from a message of at least that size cannot fail
+const _ = uint(MessageTransportSize - MessageTransportOffsetContent - poly1305.TagSize)
+
+func checkMessage(packet []byte, msgType uint32, size int) error {
+	if len(packet) < 4 {
+		return fmt.Errorf("message of %d bytes too short for its type", len(packet))
+	}
+	if t := binary.LittleEndian.Uint32(packet[:4]); t != msgType {
+		return fmt.Errorf("message of type %d, expected %d", t, msgType)
+	}
+	if msgType == MessageTransportType {
+		if len(packet) < size {
+			return fmt.Errorf("transport message of %d bytes, expected at least %d", len(packet), size)
+		}
+	} else if len(packet) != size {
+		return fmt.Errorf("message of %d bytes, expected %d", len(packet), size)
+	}
+	return nil
+}
+
+func ParseInitiation(packet []byte) (MessageInitiation, error) {
+	var msg MessageInitiation
+	if err := checkMessage(packet, MessageInitiationType, MessageInitiationSize); err != nil {
+		return msg, err
+	}
+	err := binary.Read(bytes.NewReader(packet), binary.LittleEndian, &msg)
+	return msg, err
+}
+
+func ParseResponse(packet []byte) (MessageResponse, error) {
+	var msg MessageResponse
+	if err := checkMessage(packet, MessageResponseType, MessageResponseSize); err != nil {
+		return msg, err
+	}
+	err := binary.Read(bytes.NewReader(packet), binary.LittleEndian, &msg)
+	return msg, err
+}
+
+func ParseCookieReply(packet []byte) (MessageCookieReply, error) {
+	var msg MessageCookieReply
+	if err := checkMessage(packet, MessageCookieReplyType, MessageCookieReplySize); err != nil {
+		return msg, err
+	}
+	err := binary.Read(bytes.NewReader(packet), binary.LittleEndian, &msg)
+	return msg, err
+}
+
+/* Parses the header of a transport message, the content referring to the
+ * encrypted remainder of the packet, authentication tag included
+ */
+func ParseTransport(packet []byte) (MessageTransport, error) {
+	var msg MessageTransport
+	if err := checkMessage(packet, MessageTransportType, MessageTransportSize); err != nil {
+		return msg, err
+	}
+	msg.Type = MessageTransportType
+	msg.Receiver = binary.LittleEndian.Uint32(packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter])
+	msg.Counter = binary.LittleEndian.Uint64(packet[MessageTransportOffsetCounter:MessageTransportOffsetContent])
+	msg.Content = packet[MessageTransportOffsetContent:]
+	return msg, nil
+}
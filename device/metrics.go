@@ -0,0 +1,60 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/* Receives the measurements of the device as they are taken, so they can
+ * be exported to any metrics backend without the device depending on it
+ *
+ * The methods are called from the hot paths of the receive and send
+ * routines, concurrently, and must neither block nor allocate much.
+ */
+type Metrics interface {
+	IncDrop(reason DropReason)               // a received packet was dropped
+	AddRxBytes(peer *Peer, n int)            // an authenticated message was received from the peer
+	AddTxBytes(peer *Peer, n int)            // a message was sent to the peer
+	ObserveHandshakeLatency(d time.Duration) // between sending an initiation and receiving its response
+}
+
+/* Discards all measurements, the default Metrics of a device
+ */
+type NoopMetrics struct{}
+
+func (NoopMetrics) IncDrop(DropReason)                    {}
+func (NoopMetrics) AddRxBytes(*Peer, int)                 {}
+func (NoopMetrics) AddTxBytes(*Peer, int)                 {}
+func (NoopMetrics) ObserveHandshakeLatency(time.Duration) {}
+
+type metricsHolder struct {
+	Metrics
+}
+
+func (device *Device) metrics() Metrics {
+	return device.exporter.Load().(metricsHolder).Metrics
+}
+
+/* Replaces the Metrics of the device, nil restores NoopMetrics
+ */
+func (device *Device) SetMetrics(metrics Metrics) {
+	if metrics == nil {
+		metrics = NoopMetrics{}
+	}
+	device.exporter.Store(metricsHolder{metrics})
+}
+
+func (peer *Peer) addRxBytes(n int) {
+	atomic.AddUint64(&peer.stats.rxBytes, uint64(n))
+	peer.device.metrics().AddRxBytes(peer, n)
+}
+
+func (peer *Peer) addTxBytes(n int) {
+	atomic.AddUint64(&peer.stats.txBytes, uint64(n))
+	peer.device.metrics().AddTxBytes(peer, n)
+}
@@ -9,12 +9,14 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/blake2s"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/poly1305"
 
+	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/tai64n"
 )
 
@@ -248,6 +250,14 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 }
 
 func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
+	return device.consumeMessageInitiation(msg, nil)
+}
+
+/* Consumes an initiation received from the endpoint, which is dropped
+ * before it changes the handshake state if the endpoint of the peer is
+ * pinned elsewhere; a nil endpoint skips that check
+ */
+func (device *Device) consumeMessageInitiation(msg *MessageInitiation, endpoint conn.Endpoint) *Peer {
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
@@ -286,6 +296,9 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	if peer == nil {
 		return nil
 	}
+	if endpoint != nil && !device.checkEndpoint(peer, endpoint) {
+		return nil
+	}
 
 	handshake := &peer.handshake
 
@@ -299,6 +312,16 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 		handshake.mutex.RUnlock()
 		return nil
 	}
+
+	// protect against flood, before spending any more work on the message
+
+	if time.Since(handshake.lastInitiationConsumption) <= HandshakeInitationRate {
+		handshake.mutex.RUnlock()
+		atomic.AddUint64(&peer.stats.handshakesThrottled, 1)
+		device.log.Debug.Printf("%v - ConsumeMessageInitiation: handshake flood\n", peer)
+		return nil
+	}
+
 	KDF2(
 		&chainKey,
 		&key,
@@ -309,23 +332,20 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
 	if err != nil {
 		handshake.mutex.RUnlock()
+		atomic.AddUint64(&peer.stats.handshakesFailed, 1)
 		return nil
 	}
 	mixHash(&hash, &hash, msg.Timestamp[:])
 
-	// protect against replay & flood
+	// protect against replay, only strictly newer timestamps are accepted
 
 	replay := !timestamp.After(handshake.lastTimestamp)
-	flood := time.Since(handshake.lastInitiationConsumption) <= HandshakeInitationRate
 	handshake.mutex.RUnlock()
 	if replay {
+		atomic.AddUint64(&peer.stats.handshakesFailed, 1)
 		device.log.Debug.Printf("%v - ConsumeMessageInitiation: handshake replay @ %v\n", peer, timestamp)
 		return nil
 	}
-	if flood {
-		device.log.Debug.Printf("%v - ConsumeMessageInitiation: handshake flood\n", peer)
-		return nil
-	}
 
 	// update handshake state
 
@@ -349,6 +369,10 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	setZero(hash[:])
 	setZero(chainKey[:])
 
+	if callback := peer.Callbacks().InitiationTimestamp; callback != nil {
+		callback(peer, timestamp)
+	}
+
 	return peer
 }
 
@@ -419,6 +443,13 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 }
 
 func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
+	return device.consumeMessageResponse(msg, nil)
+}
+
+/* Consumes a response received from the endpoint, see
+ * consumeMessageInitiation
+ */
+func (device *Device) consumeMessageResponse(msg *MessageResponse, endpoint conn.Endpoint) *Peer {
 	if msg.Type != MessageResponseType {
 		return nil
 	}
@@ -430,6 +461,9 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	if handshake == nil {
 		return nil
 	}
+	if endpoint != nil && !device.checkEndpoint(lookup.peer, endpoint) {
+		return nil
+	}
 
 	var (
 		hash     [blake2s.Size]byte
@@ -494,6 +528,7 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	}()
 
 	if !ok {
+		atomic.AddUint64(&lookup.peer.stats.handshakesFailed, 1)
 		return nil
 	}
 
@@ -561,14 +596,17 @@ func (peer *Peer) BeginSymmetricSession() error {
 	keypair := new(Keypair)
 	keypair.send, _ = chacha20poly1305.New(sendKey[:])
 	keypair.receive, _ = chacha20poly1305.New(recvKey[:])
+	keypair.sendKey = sendKey
+	keypair.receiveKey = recvKey
 
 	setZero(sendKey[:])
 	setZero(recvKey[:])
 
-	keypair.created = time.Now()
+	keypair.created = device.now()
 	keypair.sendNonce = 0
-	keypair.replayFilter.Init()
+	keypair.replayFilter.InitWindow(uint64(device.options.ReplayWindowSize))
 	keypair.isInitiator = isInitiator
+	keypair.peer = peer
 	keypair.localIndex = peer.handshake.localIndex
 	keypair.remoteIndex = peer.handshake.remoteIndex
 
@@ -7,8 +7,13 @@ package device
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tai64n"
 )
 
 func TestCurveWrappers(t *testing.T) {
@@ -142,3 +147,263 @@ func TestNoiseHandshake(t *testing.T) {
 		assertEqual(t, out, testMsg)
 	}()
 }
+
+func TestNoiseHandshakePresharedKey(t *testing.T) {
+	var psk1, psk2 NoiseSymmetricKey
+	_, err := rand.Read(psk1[:])
+	assertNil(t, err)
+	_, err = rand.Read(psk2[:])
+	assertNil(t, err)
+
+	handshake := func(psk1, psk2 NoiseSymmetricKey) (*Peer, *Peer, bool) {
+		dev1 := randDevice(t)
+		dev2 := randDevice(t)
+
+		defer dev1.Close()
+		defer dev2.Close()
+
+		peer1, _ := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+		peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+		peer1.SetPresharedKey(psk1)
+		peer2.SetPresharedKey(psk2)
+
+		msg1, err := dev1.CreateMessageInitiation(peer2)
+		assertNil(t, err)
+		if dev2.ConsumeMessageInitiation(msg1) == nil {
+			t.Fatal("handshake failed at initiation message")
+		}
+		msg2, err := dev2.CreateMessageResponse(peer1)
+		assertNil(t, err)
+		return peer1, peer2, dev1.ConsumeMessageResponse(msg2) != nil
+	}
+
+	// mismatching preshared keys
+
+	t.Log("mismatching preshared keys")
+
+	if _, _, ok := handshake(psk1, psk2); ok {
+		t.Fatal("handshake succeeded with mismatching preshared keys")
+	}
+	if _, _, ok := handshake(psk1, NoiseSymmetricKey{}); ok {
+		t.Fatal("handshake succeeded with preshared key on one side only")
+	}
+
+	// matching preshared keys
+
+	t.Log("matching preshared keys")
+
+	peer1, peer2, ok := handshake(psk1, psk1)
+	if !ok {
+		t.Fatal("handshake failed with matching preshared keys")
+	}
+
+	assertNil(t, peer1.BeginSymmetricSession())
+	assertNil(t, peer2.BeginSymmetricSession())
+
+	key1 := peer1.keypairs.loadNext()
+	key2 := peer2.keypairs.current
+
+	testMsg := []byte("wireguard test message")
+	var nonce [12]byte
+	out := key1.send.Seal(nil, nonce[:], testMsg, nil)
+	out, err = key2.receive.Open(out[:0], nonce[:], out, nil)
+	assertNil(t, err)
+	assertEqual(t, out, testMsg)
+}
+
+func TestNoiseInitiationReplay(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, _ := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+
+	msg, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if dev2.ConsumeMessageInitiation(msg) == nil {
+		t.Fatal("handshake failed at initiation message")
+	}
+
+	// a flood is rejected before the timestamp is even decrypted
+
+	if dev2.ConsumeMessageInitiation(msg) != nil {
+		t.Fatal("initiation flood accepted")
+	}
+
+	// once the flood window passes, the stale timestamp is still rejected
+
+	time.Sleep(HandshakeInitationRate + time.Millisecond)
+	if dev2.ConsumeMessageInitiation(msg) != nil {
+		t.Fatal("replayed initiation accepted")
+	}
+
+	if failed := peer1.Stats().HandshakesFailed; failed != 1 {
+		t.Errorf("got %d failed handshakes, expected 1", failed)
+	}
+	if throttled := peer1.Stats().HandshakesThrottled; throttled != 1 {
+		t.Errorf("got %d throttled handshakes, expected 1", throttled)
+	}
+}
+
+func TestNoisePinnedEndpoint(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, _ := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+
+	pinned, err := conn.CreateEndpoint("192.0.2.1:51820")
+	assertNil(t, err)
+	foreign, err := conn.CreateEndpoint("192.0.2.2:51820")
+	assertNil(t, err)
+	for _, peer := range []*Peer{peer1, peer2} {
+		peer.Lock()
+		peer.endpoint = pinned
+		peer.Unlock()
+		peer.SetEndpointPinned(true)
+	}
+
+	// copies from elsewhere, arriving first, leave the handshake untouched
+
+	msg1, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if dev2.consumeMessageInitiation(msg1, foreign) != nil {
+		t.Fatal("initiation from other than the pinned endpoint accepted")
+	}
+	if dev2.consumeMessageInitiation(msg1, pinned) == nil {
+		t.Fatal("initiation rejected after a copy from elsewhere")
+	}
+
+	msg2, err := dev2.CreateMessageResponse(peer1)
+	assertNil(t, err)
+	if dev1.consumeMessageResponse(msg2, foreign) != nil {
+		t.Fatal("response from other than the pinned endpoint accepted")
+	}
+	if dev1.consumeMessageResponse(msg2, pinned) == nil {
+		t.Fatal("response rejected after a copy from elsewhere")
+	}
+
+	for _, dev := range []*Device{dev1, dev2} {
+		if mismatches := dev.DropStats().EndpointMismatch; mismatches != 1 {
+			t.Errorf("got %d endpoint mismatches, expected 1", mismatches)
+		}
+	}
+}
+
+func TestInitiationTimestampRestore(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, _ := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+
+	var persisted tai64n.Timestamp
+	peer1.SetCallbacks(PeerCallbacks{
+		InitiationTimestamp: func(peer *Peer, timestamp tai64n.Timestamp) { persisted = timestamp },
+	})
+
+	captured, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if dev2.ConsumeMessageInitiation(captured) == nil {
+		t.Fatal("handshake failed at initiation message")
+	}
+	if persisted != peer1.InitiationTimestamp() || persisted == (tai64n.Timestamp{}) {
+		t.Fatal("timestamp of initiation not passed on for persisting")
+	}
+
+	// after a restart, which forgets the timestamp, restoring it
+	// rejects the captured initiation
+
+	dev3 := NewDevice(newDummyTUN("dummy"), NewLogger(LogLevelError, ""))
+	defer dev3.Close()
+	dev3.SetPrivateKey(dev2.staticIdentity.privateKey)
+	peer3, _ := dev3.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	peer3.RestoreInitiationTimestamp(persisted)
+	peer3.RestoreInitiationTimestamp(tai64n.Timestamp{})
+	if dev3.ConsumeMessageInitiation(captured) != nil {
+		t.Fatal("captured initiation replayed after restart")
+	}
+}
+
+func TestParseMessages(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+	msg, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+
+	var writer bytes.Buffer
+	assertNil(t, binary.Write(&writer, binary.LittleEndian, msg))
+	packet := writer.Bytes()
+
+	parsed, err := ParseInitiation(packet)
+	assertNil(t, err)
+	if parsed != *msg {
+		t.Fatal("parsed initiation differs from the one sent")
+	}
+
+	// truncated or extended messages, and those of another type, are rejected
+
+	for size := 0; size < len(packet); size++ {
+		if _, err := ParseInitiation(packet[:size]); err == nil {
+			t.Fatalf("parsed initiation truncated to %d bytes", size)
+		}
+	}
+	if _, err := ParseInitiation(append(packet, 0)); err == nil {
+		t.Fatal("parsed initiation with trailing byte")
+	}
+	if _, err := ParseResponse(packet[:MessageResponseSize]); err == nil {
+		t.Fatal("parsed initiation as response")
+	}
+
+	// the content of transport messages is the remainder
+
+	transport := make([]byte, MessageTransportSize+5)
+	binary.LittleEndian.PutUint32(transport[0:], MessageTransportType)
+	binary.LittleEndian.PutUint32(transport[MessageTransportOffsetReceiver:], 42)
+	binary.LittleEndian.PutUint64(transport[MessageTransportOffsetCounter:], 7)
+	header, err := ParseTransport(transport)
+	assertNil(t, err)
+	if header.Receiver != 42 || header.Counter != 7 || len(header.Content) != MessageTransportSize+5-MessageTransportOffsetContent {
+		t.Fatalf("unexpected transport header: %+v", header)
+	}
+	if _, err := ParseTransport(transport[:MessageTransportSize-1]); err == nil {
+		t.Fatal("parsed transport message shorter than a keepalive")
+	}
+
+	// random input parses where its size is valid, and never panics
+
+	buffer := make([]byte, MessageHandshakeSize)
+	for i := 0; i < 1000; i++ {
+		msgType, size := uint32(1+i%4), 4+i%(len(buffer)-3)
+		rand.Read(buffer[:size])
+		binary.LittleEndian.PutUint32(buffer, msgType)
+		input := buffer[:size]
+		_, valid := checkMessageSize(msgType, size)
+		var err error
+		switch msgType {
+		case MessageInitiationType:
+			_, err = ParseInitiation(input)
+		case MessageResponseType:
+			_, err = ParseResponse(input)
+		case MessageCookieReplyType:
+			_, err = ParseCookieReply(input)
+		case MessageTransportType:
+			_, err = ParseTransport(input)
+		}
+		if (err == nil) != valid {
+			t.Fatalf("message of type %d and %d bytes: parsed %v, valid %v", msgType, size, err == nil, valid)
+		}
+	}
+}
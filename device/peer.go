@@ -6,14 +6,17 @@
 package device
 
 import (
+	"bytes"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tai64n"
 )
 
 const (
@@ -27,7 +30,7 @@ type Peer struct {
 	handshake                   Handshake
 	device                      *Device
 	endpoint                    conn.Endpoint
-	persistentKeepaliveInterval uint16
+	persistentKeepaliveInterval uint32 // accessed atomically
 
 	// These fields are accessed with atomic operations, which must be
 	// 64-bit aligned even on 32-bit platforms. Go guarantees that an
@@ -35,9 +38,19 @@ type Peer struct {
 	// atomically-accessed fields up front, so that they can share in
 	// this alignment before smaller fields throw it off.
 	stats struct {
-		txBytes           uint64 // bytes send to peer (endpoint)
-		rxBytes           uint64 // bytes received from peer
-		lastHandshakeNano int64  // nano seconds since epoch
+		txBytes             uint64 // bytes send to peer (endpoint)
+		rxBytes             uint64 // bytes received from peer
+		lastHandshakeNano   int64  // nano seconds since epoch
+		lastReceiveNano     int64  // nano seconds since epoch
+		handshakeRTTNano    int64  // of the last handshake initiated, from initiation to response
+		handshakeRTTAvgNano int64  // moving average of handshakeRTTNano
+		rxKeepalives        uint64 // keepalives received from peer
+		handshakesCompleted uint64
+		handshakesFailed    uint64 // invalid messages or keypairs, attributable to peer
+		handshakesThrottled uint64 // initiations dropped unread, as they came too fast
+		decryptFailures     uint64 // transport messages failing authentication
+		roamsSuppressed     uint64 // endpoint changes by roaming within the hold time
+		decryptAlarm        AtomicBool
 	}
 
 	timers struct {
@@ -46,6 +59,10 @@ type Peer struct {
 		newHandshake            *Timer
 		zeroKeyMaterial         *Timer
 		persistentKeepalive     *Timer
+		rekey                   *Timer
+		disconnect              *Timer
+		resolveEndpoint         *Timer
+		liveness                *Timer
 		handshakeAttempts       uint32
 		needAnotherKeepalive    AtomicBool
 		sentLastMinuteHandshake AtomicBool
@@ -71,6 +88,185 @@ type Peer struct {
 	}
 
 	cookieGenerator CookieGenerator
+
+	connected AtomicBool   // authenticated transport packets arrive
+	pinned    AtomicBool   // packets are only accepted from the endpoint, see SetEndpointPinned
+	callbacks atomic.Value // PeerCallbacks
+	liveness  atomic.Value // PeerLiveness
+	timeouts  atomic.Value // PeerTimeouts
+	roamed    time.Time    // when the endpoint last changed by roaming, guarded by the lock
+
+	resolve struct {
+		sync.Mutex
+		host     string // endpoint as host and port, empty if given as address
+		interval time.Duration
+		last     string // address the host last resolved to
+	}
+}
+
+/* Callbacks on changes of the connection state of a peer, which are called
+ * from the routines of the peer and must not block
+ *
+ * A peer is connected once an authenticated transport message, data or
+ * keepalive, is received after a handshake, and disconnected once none has
+ * been received for DisconnectTimeout, or when the peer is stopped.
+ *
+ * InitiationTimestamp is called with each new greatest timestamp of the
+ * handshake initiations of the peer, for persisting it, see
+ * RestoreInitiationTimestamp.
+ */
+type PeerCallbacks struct {
+	Connected           func(peer *Peer)
+	Disconnected        func(peer *Peer)
+	DisconnectTimeout   time.Duration // zero selects DefaultDisconnectTimeout
+	InitiationTimestamp func(peer *Peer, timestamp tai64n.Timestamp)
+}
+
+func (peer *Peer) Callbacks() PeerCallbacks {
+	return peer.callbacks.Load().(PeerCallbacks)
+}
+
+func (peer *Peer) SetCallbacks(callbacks PeerCallbacks) {
+	if callbacks.DisconnectTimeout == 0 {
+		callbacks.DisconnectTimeout = DefaultDisconnectTimeout
+	}
+	peer.callbacks.Store(callbacks)
+}
+
+/* Declares a peer dead once nothing authenticated has been received from
+ * it for KeepaliveTimeout plus RekeyTimeout after data was sent to it,
+ * which, with the keepalives the peer answers data with, means its
+ * endpoint stopped responding
+ *
+ * A dead peer has its keypairs expired, or cleared with ClearKeypairs,
+ * and a new handshake initiated, which a peer that rebooted answers
+ * from wherever it now is.
+ */
+type PeerLiveness struct {
+	KeepaliveTimeout time.Duration // zero disables the check
+	ClearKeypairs    bool
+}
+
+func (peer *Peer) Liveness() PeerLiveness {
+	liveness, _ := peer.liveness.Load().(PeerLiveness)
+	return liveness
+}
+
+func (peer *Peer) SetLiveness(liveness PeerLiveness) {
+	peer.liveness.Store(liveness)
+	if liveness.KeepaliveTimeout == 0 && peer.isRunning.Get() {
+		peer.timers.liveness.Del()
+	}
+}
+
+/* Overrides of the timers of a peer, to run aggressive ones on flaky links
+ * and relaxed ones on stable links; zero fields keep the defaults, the
+ * handshake timeout of the device for RekeyAttemptTime
+ */
+type PeerTimeouts struct {
+	RekeyTimeout     time.Duration // between retransmissions of a handshake initiation
+	KeepaliveTimeout time.Duration // until received data is answered with a keepalive
+	RekeyAttemptTime time.Duration // of retransmissions, before giving up on a handshake
+}
+
+func (timeouts PeerTimeouts) withDefaults(handshakeTimeout time.Duration) PeerTimeouts {
+	if timeouts.RekeyTimeout == 0 {
+		timeouts.RekeyTimeout = RekeyTimeout
+	}
+	if timeouts.KeepaliveTimeout == 0 {
+		timeouts.KeepaliveTimeout = KeepaliveTimeout
+	}
+	if timeouts.RekeyAttemptTime == 0 {
+		timeouts.RekeyAttemptTime = handshakeTimeout
+	}
+	return timeouts
+}
+
+/* Checks that the timeouts given are no shorter than peerTimeoutMin, and
+ * that with the defaults filled in they leave the initiator of a keypair
+ * time to replace it before RejectAfterTime
+ */
+func (timeouts PeerTimeouts) validate(handshakeTimeout time.Duration) error {
+	for _, timeout := range []time.Duration{timeouts.RekeyTimeout, timeouts.KeepaliveTimeout, timeouts.RekeyAttemptTime} {
+		if timeout != 0 && timeout < peerTimeoutMin {
+			return fmt.Errorf("peer timeouts shorter than %v: %+v", peerTimeoutMin, timeouts)
+		}
+	}
+	timeouts = timeouts.withDefaults(handshakeTimeout)
+	if timeouts.KeepaliveTimeout+timeouts.RekeyTimeout > RejectAfterTime-RekeyAfterTime {
+		return fmt.Errorf("keepalive timeout %v and rekey timeout %v leave no time to rekey before keypairs expire",
+			timeouts.KeepaliveTimeout, timeouts.RekeyTimeout)
+	}
+	if timeouts.RekeyAttemptTime < timeouts.RekeyTimeout {
+		return fmt.Errorf("rekey attempt time %v shorter than the rekey timeout %v", timeouts.RekeyAttemptTime, timeouts.RekeyTimeout)
+	}
+	if timeouts.RekeyAttemptTime > RejectAfterTime {
+		return fmt.Errorf("rekey attempt time %v longer than keypairs last", timeouts.RekeyAttemptTime)
+	}
+	return nil
+}
+
+func (peer *Peer) Timeouts() PeerTimeouts {
+	timeouts, _ := peer.timeouts.Load().(PeerTimeouts)
+	return timeouts
+}
+
+/* Overrides the timers of the peer, which apply as they are next armed
+ */
+func (peer *Peer) SetTimeouts(timeouts PeerTimeouts) error {
+	if err := timeouts.validate(peer.device.HandshakeTimeout()); err != nil {
+		return err
+	}
+	peer.timeouts.Store(timeouts)
+	return nil
+}
+
+func (peer *Peer) effectiveTimeouts() PeerTimeouts {
+	return peer.Timeouts().withDefaults(peer.device.HandshakeTimeout())
+}
+
+func (peer *Peer) rekeyTimeout() time.Duration {
+	if timeout := peer.Timeouts().RekeyTimeout; timeout != 0 {
+		return timeout
+	}
+	return RekeyTimeout
+}
+
+func (peer *Peer) keepaliveTimeout() time.Duration {
+	if timeout := peer.Timeouts().KeepaliveTimeout; timeout != 0 {
+		return timeout
+	}
+	return KeepaliveTimeout
+}
+
+func (peer *Peer) IsConnected() bool {
+	return peer.connected.Get()
+}
+
+/* Reports whether the peer has a session traffic flows over: a current
+ * keypair, not yet expired, with which a message was decrypted or sent
+ */
+func (peer *Peer) HasActiveSession() bool {
+	keypair := peer.keypairs.Current()
+	return keypair != nil && keypair.isActive(peer.device.now())
+}
+
+func (peer *Peer) setConnected(connected bool) {
+	if peer.connected.Swap(connected) == connected {
+		return
+	}
+	callbacks := peer.Callbacks()
+	if connected {
+		peer.device.log.Debug.Println(peer, "- Connected")
+		if callbacks.Connected != nil {
+			callbacks.Connected(peer)
+		}
+	} else {
+		peer.device.log.Debug.Println(peer, "- Disconnected")
+		if callbacks.Disconnected != nil {
+			callbacks.Disconnected(peer)
+		}
+	}
 }
 
 func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
@@ -92,23 +288,41 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 		return nil, errors.New("too many peers")
 	}
 
-	// create peer
+	// map public key
 
-	peer := new(Peer)
+	_, ok := device.peers.keyMap[pk]
+	if ok {
+		return nil, errors.New("adding existing peer")
+	}
+
+	// create and add peer
+
+	peer := unsafeNewPeer(device, pk)
 	peer.Lock()
 	defer peer.Unlock()
 
-	peer.cookieGenerator.Init(pk)
-	peer.device = device
-	peer.isRunning.Set(false)
+	device.peers.keyMap[pk] = peer
 
-	// map public key
+	// start peer
 
-	_, ok := device.peers.keyMap[pk]
-	if ok {
-		return nil, errors.New("adding existing peer")
+	if peer.device.isUp.Get() {
+		peer.Start()
 	}
 
+	return peer, nil
+}
+
+/* Creates a stopped peer, which is not yet known to the device
+ *
+ * Must hold device.staticIdentity.RLock
+ */
+func unsafeNewPeer(device *Device, pk NoisePublicKey) *Peer {
+	peer := new(Peer)
+	peer.cookieGenerator.Init(pk)
+	peer.device = device
+	peer.isRunning.Set(false)
+	peer.SetCallbacks(PeerCallbacks{})
+
 	// pre-compute DH
 
 	handshake := &peer.handshake
@@ -117,24 +331,71 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	handshake.remoteStatic = pk
 	handshake.mutex.Unlock()
 
-	// reset endpoint
+	return peer
+}
 
-	peer.endpoint = nil
+/* An allowed IP of a peer, normalized for insertion into AllowedIPs
+ */
+type allowedIP struct {
+	ip   net.IP
+	cidr uint
+}
 
-	// add
+func parseAllowedIPs(allowedIPs []net.IPNet) ([]allowedIP, error) {
+	networks := make([]allowedIP, 0, len(allowedIPs))
+	for _, network := range allowedIPs {
+		ones, bits := network.Mask.Size()
+		ip := network.IP.To4()
+		if bits != net.IPv4len*8 {
+			ip = network.IP.To16()
+		}
+		if ip == nil || len(ip)*8 != bits {
+			return nil, fmt.Errorf("invalid allowed ip: %v", network.String())
+		}
+		networks = append(networks, allowedIP{ip.Mask(network.Mask), uint(ones)})
+	}
+	return networks, nil
+}
 
-	device.peers.keyMap[pk] = peer
+/* Adds a peer at runtime, routing the given allowed IPs to it
+ *
+ * The endpoint may be nil, in which case the peer learns it from
+ * its first authenticated packet. The peer is started if the device is up;
+ * use RemovePeer to stop and remove it again.
+ */
+func (device *Device) AddPeer(pk NoisePublicKey, endpoint conn.Endpoint, allowedIPs []net.IPNet) (*Peer, error) {
 
-	// start peer
+	// validate allowed IPs before changing any state
 
-	if peer.device.isUp.Get() {
-		peer.Start()
+	networks, err := parseAllowedIPs(allowedIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	peer, err := device.NewPeer(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	peer.Lock()
+	peer.endpoint = endpoint
+	peer.Unlock()
+
+	for _, network := range networks {
+		device.allowedips.Insert(network.ip, network.cidr, peer)
 	}
 
 	return peer, nil
 }
 
 func (peer *Peer) SendBuffer(buffer []byte) error {
+	return peer.sendBuffer(buffer, 0)
+}
+
+/* Sends the buffer to the endpoint of the peer,
+ * overriding the type of service of the outer packet unless tos is zero.
+ */
+func (peer *Peer) sendBuffer(buffer []byte, tos uint8) error {
 	peer.device.net.RLock()
 	defer peer.device.net.RUnlock()
 
@@ -149,9 +410,17 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 		return errors.New("no known endpoint for peer")
 	}
 
-	err := peer.device.net.bind.Send(buffer, peer.endpoint)
+	bind, err := peer.device.unsafeSendBind(peer.endpoint)
+	if err != nil {
+		return err
+	}
+	if sender, ok := bind.(conn.BindSendTOS); ok && tos != 0 {
+		err = sender.SendTOS(buffer, peer.endpoint, tos)
+	} else {
+		err = bind.Send(buffer, peer.endpoint)
+	}
 	if err == nil {
-		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
+		peer.addTxBytes(len(buffer))
 	}
 	return err
 }
@@ -195,12 +464,12 @@ func (peer *Peer) Start() {
 
 	// prepare queues
 
-	peer.queue.nonce = make(chan *QueueOutboundElement, QueueOutboundSize)
-	peer.queue.outbound = make(chan *QueueOutboundElement, QueueOutboundSize)
-	peer.queue.inbound = make(chan *QueueInboundElement, QueueInboundSize)
+	peer.queue.nonce = make(chan *QueueOutboundElement, device.options.QueueOutboundSize)
+	peer.queue.outbound = make(chan *QueueOutboundElement, device.options.QueueOutboundSize)
+	peer.queue.inbound = make(chan *QueueInboundElement, device.options.QueueInboundSize)
 
 	peer.timersInit()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.lastSentHandshake = time.Now().Add(-(peer.rekeyTimeout() + time.Second))
 	peer.signals.newKeypairArrived = make(chan struct{}, 1)
 	peer.signals.flushNonceQueue = make(chan struct{}, 1)
 
@@ -212,6 +481,14 @@ func (peer *Peer) Start() {
 
 	peer.routines.starting.Wait()
 	peer.isRunning.Set(true)
+
+	// resolve the endpoint, if given by name, once results are applied
+
+	peer.resolve.Lock()
+	if peer.resolve.host != "" {
+		peer.timers.resolveEndpoint.Mod(0)
+	}
+	peer.resolve.Unlock()
 }
 
 func (peer *Peer) ZeroAndFlushAll() {
@@ -246,15 +523,15 @@ func (peer *Peer) ExpireCurrentKeypairs() {
 	peer.device.indexTable.Delete(handshake.localIndex)
 	handshake.Clear()
 	handshake.mutex.Unlock()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.lastSentHandshake = time.Now().Add(-(peer.rekeyTimeout() + time.Second))
 
 	keypairs := &peer.keypairs
 	keypairs.Lock()
 	if keypairs.current != nil {
-		keypairs.current.sendNonce = RejectAfterMessages
+		atomic.StoreUint64(&keypairs.current.sendNonce, RejectAfterMessages)
 	}
-	if keypairs.next != nil {
-		keypairs.loadNext().sendNonce = RejectAfterMessages
+	if next := keypairs.loadNext(); next != nil {
+		atomic.StoreUint64(&next.sendNonce, RejectAfterMessages)
 	}
 	keypairs.Unlock()
 }
@@ -275,6 +552,7 @@ func (peer *Peer) Stop() {
 	peer.device.log.Debug.Println(peer, "- Stopping...")
 
 	peer.timersStop()
+	peer.setConnected(false)
 
 	// stop & wait for ongoing peer routines
 
@@ -285,18 +563,245 @@ func (peer *Peer) Stop() {
 
 	close(peer.queue.nonce)
 	close(peer.queue.outbound)
-	close(peer.queue.inbound)
+
+	// the inbound queue is left open, as the receive routines may still be
+	// queuing a packet they read before the peer stopped running
 
 	peer.ZeroAndFlushAll()
 }
 
+/* Sets the optional preshared key mixed into handshakes with the peer,
+ * an all zero key being equivalent to no preshared key.
+ *
+ * The new key is used from the next handshake onwards.
+ */
+func (peer *Peer) SetPresharedKey(psk NoiseSymmetricKey) {
+	peer.handshake.mutex.Lock()
+	peer.handshake.presharedKey = psk
+	peer.handshake.mutex.Unlock()
+}
+
+/* Returns the greatest timestamp of the handshake initiations received
+ * from the peer; initiations are only accepted with a greater one
+ */
+func (peer *Peer) InitiationTimestamp() tai64n.Timestamp {
+	peer.handshake.mutex.RLock()
+	defer peer.handshake.mutex.RUnlock()
+	return peer.handshake.lastTimestamp
+}
+
+/* Restores the greatest timestamp of the handshake initiations received
+ * from the peer, as persisted before a restart, so initiations captured
+ * earlier cannot be replayed afterwards. A smaller timestamp is ignored.
+ */
+func (peer *Peer) RestoreInitiationTimestamp(timestamp tai64n.Timestamp) {
+	peer.handshake.mutex.Lock()
+	defer peer.handshake.mutex.Unlock()
+	if timestamp.After(peer.handshake.lastTimestamp) {
+		peer.handshake.lastTimestamp = timestamp
+	}
+}
+
+/* Returns the persistent keepalive interval of the peer in seconds,
+ * zero meaning that persistent keepalives are disabled.
+ */
+func (peer *Peer) PersistentKeepaliveInterval() uint16 {
+	return uint16(atomic.LoadUint32(&peer.persistentKeepaliveInterval))
+}
+
+/* Sets the persistent keepalive interval of the peer in seconds,
+ * zero disables persistent keepalives.
+ *
+ * When persistent keepalives are turned on while the device is up,
+ * a keepalive is sent immediately to open up the path through any NAT.
+ * The following ones are sent ahead of the interval by a jitter, stable
+ * for each peer, see PersistentKeepaliveJitter.
+ */
+func (peer *Peer) SetPersistentKeepaliveInterval(secs uint16) {
+	old := atomic.SwapUint32(&peer.persistentKeepaliveInterval, uint32(secs))
+	if old == 0 && secs != 0 && peer.device.isUp.Get() {
+		peer.SendKeepalive()
+	}
+}
+
 var RoamingDisabled bool
 
-func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
-	if RoamingDisabled {
+func (device *Device) RoamingHoldTime() time.Duration {
+	return device.roaming.Load().(time.Duration)
+}
+
+/* Sets the least time between changes of the endpoint of a peer by
+ * roaming, DefaultRoamingHoldTime by default, zero not holding them back
+ *
+ * A peer roaming again within the hold time keeps its endpoint until a
+ * packet arrives from its new address after the hold time, counted in
+ * PeerStats.RoamsSuppressed meanwhile.
+ */
+func (device *Device) SetRoamingHoldTime(hold time.Duration) error {
+	if hold < 0 {
+		return fmt.Errorf("invalid roaming hold time: %v", hold)
+	}
+	device.roaming.Store(hold)
+	return nil
+}
+
+/* Sets the endpoint of the peer to a host name and port, which is resolved
+ * in the background while the peer runs, right away and again every
+ * interval, zero selecting EndpointResolveInterval, so the peer follows
+ * changes of its address in the DNS
+ *
+ * Only a malformed host is refused, as resolving may take long; until the
+ * host first resolves, the peer keeps its endpoint. Failing to resolve
+ * keeps the last address; the endpoint only changes when the host resolves
+ * to a new one, so roaming is not undone.
+ */
+func (peer *Peer) SetEndpointHost(host string, interval time.Duration) error {
+	if interval <= 0 {
+		interval = EndpointResolveInterval
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return err
+	}
+
+	peer.resolve.Lock()
+	peer.resolve.host = host
+	peer.resolve.interval = interval
+	peer.resolve.last = ""
+	peer.resolve.Unlock()
+
+	if peer.isRunning.Get() {
+		peer.timers.resolveEndpoint.Mod(0)
+	}
+	return nil
+}
+
+/* Stops resolving the endpoint, as it was given as an address
+ */
+func (peer *Peer) clearEndpointHost() {
+	peer.resolve.Lock()
+	peer.resolve.host = ""
+	peer.resolve.Unlock()
+}
+
+var lookupEndpoint = func(host string) (string, error) {
+	addr, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+/* Resolves the host of the endpoint, if given by name, which may block
+ * for long, so it must not be called from the timers of the peer:
+ * stopping the peer waits for them. The result is only applied while the
+ * peer runs, and the host is unchanged.
+ */
+func (peer *Peer) resolveEndpoint() {
+	peer.resolve.Lock()
+	host := peer.resolve.host
+	peer.resolve.Unlock()
+	if host == "" {
+		return
+	}
+
+	addr, err := lookupEndpoint(host)
+	if err != nil {
+		peer.device.log.Info.Println(peer, "- Failed to resolve endpoint", host+", keeping last address:", err)
+		return
+	}
+	endpoint, err := conn.CreateEndpoint(addr)
+	if err != nil {
+		peer.device.log.Info.Println(peer, "- Resolved endpoint", host, "to invalid address", addr+":", err)
+		return
+	}
+
+	peer.resolve.Lock()
+	defer peer.resolve.Unlock()
+	if peer.resolve.host != host || peer.resolve.last == addr {
 		return
 	}
 	peer.Lock()
+	if !peer.isRunning.Get() {
+		peer.Unlock()
+		return
+	}
 	peer.endpoint = endpoint
 	peer.Unlock()
+	peer.resolve.last = addr
+	peer.device.log.Info.Println(peer, "- Endpoint", host, "now resolves to", addr)
+}
+
+/* Sets the endpoint of the peer to the source of an authenticated packet,
+ * and reports whether the packet may be accepted from there, which it may
+ * unless the endpoint of the peer is pinned to another address
+ *
+ * Peers configured without an endpoint cannot be sent to until they have
+ * been heard from this way, which lets them listen for peers of unknown
+ * address. That first endpoint is learnt even with roaming disabled.
+ *
+ * Changes of the address are held back for the roaming hold time after the
+ * last one, see Device.SetRoamingHoldTime, so that packets from varying
+ * sources cannot make the endpoint flap.
+ */
+func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) bool {
+	peer.Lock()
+	defer peer.Unlock()
+
+	pinned := peer.pinned.Get()
+	if peer.endpoint == nil {
+		if pinned {
+			return false
+		}
+		peer.endpoint = endpoint
+		return true
+	}
+	same := bytes.Equal(peer.endpoint.DstToBytes(), endpoint.DstToBytes())
+	if pinned && !same {
+		return false
+	}
+	if RoamingDisabled {
+		return true
+	}
+
+	// the same address may still come with another source address
+
+	if same {
+		peer.endpoint = endpoint
+		return true
+	}
+	now := peer.device.now()
+	if now.Sub(peer.roamed) < peer.device.RoamingHoldTime() {
+		atomic.AddUint64(&peer.stats.roamsSuppressed, 1)
+		return true
+	}
+	peer.endpoint = endpoint
+	peer.roamed = now
+	return true
+}
+
+/* Reports whether an authenticated packet from the endpoint may be
+ * accepted, as SetEndpointFromPacket does, without updating the endpoint
+ */
+func (peer *Peer) endpointAccepted(endpoint conn.Endpoint) bool {
+	if !peer.pinned.Get() {
+		return true
+	}
+	peer.RLock()
+	defer peer.RUnlock()
+	return peer.endpoint != nil && bytes.Equal(peer.endpoint.DstToBytes(), endpoint.DstToBytes())
+}
+
+func (peer *Peer) EndpointPinned() bool {
+	return peer.pinned.Get()
+}
+
+/* Pins the endpoint of the peer, for deployments where its mobility is a
+ * threat rather than a feature: authenticated packets from any other
+ * address and port than that of its configured endpoint are dropped and
+ * counted in DropStats.EndpointMismatch, and the endpoint never roams
+ *
+ * A pinned peer without endpoint accepts no packets at all.
+ */
+func (peer *Peer) SetEndpointPinned(pinned bool) {
+	peer.pinned.Set(pinned)
 }
@@ -6,9 +6,20 @@
 package device
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 	"unsafe"
+
+	"golang.zx2c4.com/wireguard/conn"
 )
 
 func checkAlignment(t *testing.T, name string, offset uintptr) {
@@ -41,3 +52,630 @@ func TestPeerAlignment(t *testing.T) {
 	checkAlignment(t, "Peer.stats", unsafe.Offsetof(p.stats))
 	checkAlignment(t, "Peer.isRunning", unsafe.Offsetof(p.isRunning))
 }
+
+func TestAddRemovePeer(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	device.Up()
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+
+	_, invalid, _ := net.ParseCIDR("10.0.0.0/24")
+	invalid.IP = invalid.IP[:2]
+	if _, err := device.AddPeer(pk, nil, []net.IPNet{*invalid}); err == nil {
+		t.Fatal("added peer with invalid allowed ip")
+	}
+	if device.LookupPeer(pk) != nil {
+		t.Fatal("failed add left peer behind")
+	}
+
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	peer, err := device.AddPeer(pk, nil, []net.IPNet{*network})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peer.isRunning.Get() {
+		t.Fatal("peer added to running device was not started")
+	}
+	if device.allowedips.LookupIPv4(net.IPv4(10, 0, 0, 1).To4()) != peer {
+		t.Fatal("allowed ip not routed to peer")
+	}
+
+	// install a keypair, as if a handshake had completed
+
+	keypair := newTestKeypair(t)
+	keypair.localIndex, err = device.indexTable.NewIndexForHandshake(peer, &peer.handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.indexTable.SwapIndexForKeypair(keypair.localIndex, keypair)
+	peer.keypairs.Lock()
+	peer.keypairs.current = keypair
+	peer.keypairs.Unlock()
+
+	device.RemovePeer(pk)
+
+	if device.LookupPeer(pk) != nil {
+		t.Fatal("peer still present after removal")
+	}
+	if peer.isRunning.Get() {
+		t.Fatal("removed peer still running")
+	}
+	if device.allowedips.LookupIPv4(net.IPv4(10, 0, 0, 1).To4()) != nil {
+		t.Fatal("allowed ip still routed after removal")
+	}
+	if device.indexTable.Lookup(keypair.localIndex).keypair != nil {
+		t.Fatal("keypair of removed peer still resolves")
+	}
+}
+
+func TestHandshakeEventsDropped(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+
+	// a consumer which falls behind never blocks the handshake
+
+	for i := 0; i < HandshakeEventQueueSize+3; i++ {
+		peer.timersHandshakeComplete()
+	}
+	if dropped := device.Stats().EventsDropped; dropped != 3 {
+		t.Fatalf("got %d dropped events, expected 3", dropped)
+	}
+	if queued := len(device.HandshakeEvents()); queued != HandshakeEventQueueSize {
+		t.Fatalf("got %d queued events, expected %d", queued, HandshakeEventQueueSize)
+	}
+}
+
+func TestEndpointHostResolution(t *testing.T) {
+	var mutex sync.Mutex
+	addrs := map[string]string{"peer.example:51820": "192.0.2.1:51820"}
+	lookup := lookupEndpoint
+	lookupEndpoint = func(host string) (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		addr, ok := addrs[host]
+		if !ok {
+			return "", errors.New("no such host")
+		}
+		return addr, nil
+	}
+	defer func() { lookupEndpoint = lookup }()
+
+	device := randDevice(t)
+	defer device.Close()
+	device.Up()
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+
+	endpoint := func() string {
+		peer.RLock()
+		defer peer.RUnlock()
+		if peer.endpoint == nil {
+			return ""
+		}
+		return peer.endpoint.DstToString()
+	}
+	waitEndpoint := func(expected string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for endpoint() != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("endpoint %q, expected %q", endpoint(), expected)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if err := peer.SetEndpointHost("peer.example", 0); err == nil {
+		t.Fatal("set endpoint to a host without port")
+	}
+	if err := peer.SetEndpointHost("peer.example:51820", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	waitEndpoint("192.0.2.1:51820")
+
+	// the endpoint follows the address of the host
+
+	mutex.Lock()
+	addrs["peer.example:51820"] = "192.0.2.2:51820"
+	mutex.Unlock()
+	waitEndpoint("192.0.2.2:51820")
+
+	// failures keep the last address
+
+	mutex.Lock()
+	delete(addrs, "peer.example:51820")
+	mutex.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	waitEndpoint("192.0.2.2:51820")
+
+	// an address stops the resolution
+
+	if err := device.IpcSetOperation(bufio.NewReader(strings.NewReader(fmt.Sprintf(
+		"public_key=%x\nendpoint=192.0.2.3:51820\n", peer.handshake.remoteStatic[:])))); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	addrs["peer.example:51820"] = "192.0.2.4:51820"
+	mutex.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	waitEndpoint("192.0.2.3:51820")
+}
+
+func TestEndpointHostResolutionBlocking(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	lookup := lookupEndpoint
+	lookupEndpoint = func(host string) (string, error) {
+		close(started)
+		<-release
+		return "192.0.2.1:51820", nil
+	}
+	defer func() { lookupEndpoint = lookup }()
+
+	device := randDevice(t)
+	defer device.Close()
+	device.Up()
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+
+	// neither setting the host nor removing the peer waits for the lookup
+
+	done := make(chan struct{})
+	go func() {
+		if err := peer.SetEndpointHost("peer.example:51820", 0); err != nil {
+			t.Error(err)
+		}
+		<-started
+		device.RemovePeer(peer.handshake.remoteStatic)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked by a pending lookup")
+	}
+
+	// and its late result is not applied to the removed peer
+
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	peer.RLock()
+	defer peer.RUnlock()
+	if peer.endpoint != nil {
+		t.Fatal("endpoint of a removed peer resolved")
+	}
+}
+
+func TestPeersSnapshot(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	device.Up()
+	peer1 := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+	peer2 := newTestPeer(t, device, net.IPv4(1, 0, 0, 3))
+
+	endpoint, err := conn.CreateEndpoint("192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer1.Lock()
+	peer1.endpoint = endpoint
+	peer1.Unlock()
+	peer1.SetPersistentKeepaliveInterval(25)
+	atomic.AddUint64(&peer1.stats.rxBytes, 100)
+
+	peers := device.Peers()
+	if len(peers) != 2 {
+		t.Fatalf("got %d peers, expected 2", len(peers))
+	}
+	if bytes.Compare(peers[0].PublicKey[:], peers[1].PublicKey[:]) >= 0 {
+		t.Fatal("peers not ordered by public key")
+	}
+	for _, info := range peers {
+		switch info.PublicKey {
+		case peer1.handshake.remoteStatic:
+			if info.Endpoint != "192.0.2.1:51820" || info.PersistentKeepalive != 25*time.Second || info.RxBytes != 100 {
+				t.Errorf("unexpected snapshot of peer with endpoint: %+v", info)
+			}
+		case peer2.handshake.remoteStatic:
+			if info.Endpoint != "" || info.PersistentKeepalive != 0 || info.Connected {
+				t.Errorf("unexpected snapshot of idle peer: %+v", info)
+			}
+		default:
+			t.Errorf("snapshot of unknown peer: %+v", info)
+		}
+	}
+
+	// snapshots do not race with roaming
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			peer2.SetEndpointFromPacket(endpoint)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		device.Peers()
+	}
+	<-done
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+	endpoint, err := conn.CreateEndpoint("192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.Lock()
+	peer.endpoint = endpoint
+	peer.Unlock()
+
+	if err := device.SetHandshakeTimeout(time.Second); err == nil {
+		t.Fatal("accepted timeout shorter than a retransmission")
+	}
+	if err := device.SetHandshakeTimeout(3 * RekeyTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// retries up to the timeout are silent, then the failure is reported
+
+	atomic.StoreUint32(&peer.timers.handshakeAttempts, 3)
+	expiredRetransmitHandshake(peer)
+	if len(device.HandshakeEvents()) != 0 {
+		t.Fatal("handshake failure reported before the timeout")
+	}
+	expiredRetransmitHandshake(peer)
+	select {
+	case event := <-device.HandshakeEvents():
+		if !event.Failed || event.PublicKey != peer.handshake.remoteStatic || event.Endpoint != endpoint {
+			t.Fatalf("unexpected handshake event: %+v", event)
+		}
+	default:
+		t.Fatal("handshake failure not reported")
+	}
+}
+
+func TestPeerTimeouts(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+	endpoint, err := conn.CreateEndpoint("192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.Lock()
+	peer.endpoint = endpoint
+	peer.Unlock()
+
+	for _, timeouts := range []PeerTimeouts{
+		{RekeyTimeout: -time.Second},
+		{KeepaliveTimeout: time.Second / 2},
+		{KeepaliveTimeout: RejectAfterTime - RekeyAfterTime},
+		{RekeyTimeout: 10 * time.Second, RekeyAttemptTime: 5 * time.Second},
+		{RekeyAttemptTime: RejectAfterTime + time.Second},
+	} {
+		if err := peer.SetTimeouts(timeouts); err == nil {
+			t.Errorf("accepted insane timeouts: %+v", timeouts)
+		}
+	}
+	if peer.rekeyTimeout() != RekeyTimeout || peer.keepaliveTimeout() != KeepaliveTimeout {
+		t.Fatal("rejected timeouts applied")
+	}
+
+	// retransmissions follow the overrides
+
+	if err := peer.SetTimeouts(PeerTimeouts{RekeyTimeout: 2 * time.Second, RekeyAttemptTime: 4 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if peer.rekeyTimeout() != 2*time.Second || peer.keepaliveTimeout() != KeepaliveTimeout {
+		t.Fatalf("unexpected timeouts: %+v", peer.effectiveTimeouts())
+	}
+	atomic.StoreUint32(&peer.timers.handshakeAttempts, 2)
+	expiredRetransmitHandshake(peer)
+	if len(device.HandshakeEvents()) != 0 {
+		t.Fatal("handshake failure reported before the rekey attempt time")
+	}
+	expiredRetransmitHandshake(peer)
+	select {
+	case event := <-device.HandshakeEvents():
+		if !event.Failed {
+			t.Fatalf("unexpected handshake event: %+v", event)
+		}
+	default:
+		t.Fatal("handshake failure not reported")
+	}
+
+	// the overrides are configured through UAPI, zero restoring defaults
+
+	config := func(lines string) error {
+		return device.IpcSetOperation(bufio.NewReader(strings.NewReader(fmt.Sprintf(
+			"public_key=%x\n%s", peer.handshake.remoteStatic[:], lines))))
+	}
+	if err := config("keepalive_timeout=20\nrekey_attempt_time=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	expected := PeerTimeouts{RekeyTimeout: 2 * time.Second, KeepaliveTimeout: 20 * time.Second}
+	if timeouts := peer.Timeouts(); timeouts != expected {
+		t.Fatalf("unexpected timeouts after UAPI set: %+v", timeouts)
+	}
+	if err := config("keepalive_timeout=60\n"); err == nil {
+		t.Fatal("UAPI accepted insane keepalive timeout")
+	}
+
+	// the timeouts of a block are validated together, in any order
+
+	if err := config("rekey_attempt_time=4\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := config("rekey_timeout=6\nrekey_attempt_time=12\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := config("rekey_attempt_time=3\nrekey_timeout=2\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := config("rekey_timeout=5\nrekey_attempt_time=12\nrekey_attempt_time=4\n"); err == nil {
+		t.Fatal("UAPI accepted insane timeouts at the end of the block")
+	}
+	expected.RekeyAttemptTime = 3 * time.Second
+	if timeouts := peer.Timeouts(); timeouts != expected {
+		t.Fatalf("unexpected timeouts after UAPI set: %+v", timeouts)
+	}
+	if err := config("rekey_attempt_time=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	writer := bufio.NewWriter(&buffer)
+	if err := device.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	if get := buffer.String(); !strings.Contains(get, "rekey_timeout=2\nkeepalive_timeout=20\n") || strings.Contains(get, "rekey_attempt_time") {
+		t.Fatalf("unexpected timeouts in UAPI get:\n%s", get)
+	}
+}
+
+func TestPersistentKeepaliveJitter(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	delays := make(map[time.Duration]bool)
+	for i := 0; i < 16; i++ {
+		peer := newTestPeer(t, device, net.IPv4(1, 0, 0, byte(i+2)))
+		delay := peer.persistentKeepaliveDelay(25)
+		if delay < 23*time.Second || delay > 25*time.Second {
+			t.Fatalf("keepalive delay %v beyond the jitter", delay)
+		}
+		if again := peer.persistentKeepaliveDelay(25); again != delay {
+			t.Fatalf("keepalive delay changed from %v to %v", delay, again)
+		}
+		if short := peer.persistentKeepaliveDelay(1); short < 750*time.Millisecond || short > time.Second {
+			t.Fatalf("keepalive delay %v beyond a quarter of the interval", short)
+		}
+		delays[delay] = true
+	}
+	if len(delays) < 2 {
+		t.Fatal("all peers share the same keepalive delay")
+	}
+}
+
+func TestEndpointLearnt(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+	if err := peer.SendBuffer([]byte{0}); err == nil {
+		t.Fatal("sent to a peer without endpoint")
+	}
+
+	endpoints := make([]conn.Endpoint, 2)
+	for i := range endpoints {
+		endpoint, err := conn.CreateEndpoint(fmt.Sprintf("127.0.0.1:%d", 51820+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoints[i] = endpoint
+	}
+	current := func() conn.Endpoint {
+		peer.RLock()
+		defer peer.RUnlock()
+		return peer.endpoint
+	}
+
+	// the first endpoint is learnt even with roaming disabled, but kept
+
+	RoamingDisabled = true
+	defer func() { RoamingDisabled = false }()
+	peer.SetEndpointFromPacket(endpoints[0])
+	peer.SetEndpointFromPacket(endpoints[1])
+	if current() != endpoints[0] {
+		t.Fatalf("endpoint %v, expected the first one learnt", current().DstToString())
+	}
+
+	RoamingDisabled = false
+	peer.SetEndpointFromPacket(endpoints[1])
+	if current() != endpoints[1] {
+		t.Fatalf("endpoint %v, expected the peer to roam", current().DstToString())
+	}
+}
+
+func TestRoamingHoldTime(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	if err := device.SetRoamingHoldTime(-time.Second); err == nil {
+		t.Fatal("accepted negative roaming hold time")
+	}
+	if hold := device.RoamingHoldTime(); hold != DefaultRoamingHoldTime {
+		t.Fatalf("roaming hold time %v by default", hold)
+	}
+
+	var offset int64 // nanoseconds the clock is ahead, accessed atomically
+	device.SetClock(func() time.Time {
+		return time.Now().Add(time.Duration(atomic.LoadInt64(&offset)))
+	})
+
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+	endpoints := make([]conn.Endpoint, 3)
+	for i := range endpoints {
+		endpoint, err := conn.CreateEndpoint(fmt.Sprintf("127.0.0.%d:51820", 1+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoints[i] = endpoint
+	}
+	current := func() string {
+		peer.RLock()
+		defer peer.RUnlock()
+		return peer.endpoint.DstToString()
+	}
+
+	// the first roam is taken, the flaps right after it are not
+
+	peer.SetEndpointFromPacket(endpoints[0])
+	peer.SetEndpointFromPacket(endpoints[1])
+	peer.SetEndpointFromPacket(endpoints[2])
+	peer.SetEndpointFromPacket(endpoints[0])
+	if current() != endpoints[1].DstToString() {
+		t.Fatalf("endpoint %s, expected the first roam to be taken", current())
+	}
+	if suppressed := peer.Stats().RoamsSuppressed; suppressed != 2 {
+		t.Fatalf("%d roams suppressed, expected 2", suppressed)
+	}
+
+	// after the hold time the peer roams again
+
+	atomic.StoreInt64(&offset, int64(DefaultRoamingHoldTime))
+	peer.SetEndpointFromPacket(endpoints[2])
+	if current() != endpoints[2].DstToString() {
+		t.Fatalf("endpoint %s, expected the peer to roam after the hold time", current())
+	}
+
+	// no hold time takes every roam
+
+	if err := device.SetRoamingHoldTime(0); err != nil {
+		t.Fatal(err)
+	}
+	peer.SetEndpointFromPacket(endpoints[0])
+	if current() != endpoints[0].DstToString() {
+		t.Fatalf("endpoint %s, expected the peer to roam without hold time", current())
+	}
+}
+
+func TestEndpointPinned(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+	endpoints := make([]conn.Endpoint, 2)
+	for i := range endpoints {
+		endpoint, err := conn.CreateEndpoint(fmt.Sprintf("127.0.0.%d:51820", 1+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoints[i] = endpoint
+	}
+	current := func() conn.Endpoint {
+		peer.RLock()
+		defer peer.RUnlock()
+		return peer.endpoint
+	}
+
+	// without endpoint, a pinned peer accepts nothing
+
+	if err := device.IpcSetOperation(bufio.NewReader(strings.NewReader(fmt.Sprintf(
+		"public_key=%x\npin_endpoint=true\n", peer.handshake.remoteStatic[:])))); err != nil {
+		t.Fatal(err)
+	}
+	if !peer.EndpointPinned() {
+		t.Fatal("endpoint not pinned through UAPI")
+	}
+	if device.acceptEndpoint(peer, endpoints[0]) || current() != nil {
+		t.Fatal("pinned peer without endpoint learnt one")
+	}
+
+	// with one, only packets from its address are accepted
+
+	peer.Lock()
+	peer.endpoint = endpoints[0]
+	peer.Unlock()
+	if device.acceptEndpoint(peer, endpoints[1]) || current() != endpoints[0] {
+		t.Fatal("pinned peer accepted a packet from elsewhere")
+	}
+	same, err := conn.CreateEndpoint(endpoints[0].DstToString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !device.acceptEndpoint(peer, same) {
+		t.Fatal("pinned peer rejected a packet from its endpoint")
+	}
+	if mismatches := device.DropStats().EndpointMismatch; mismatches != 2 {
+		t.Fatalf("%d endpoint mismatches counted, expected 2", mismatches)
+	}
+
+	// unpinned, it roams again
+
+	peer.SetEndpointPinned(false)
+	if !device.acceptEndpoint(peer, endpoints[1]) || current() != endpoints[1] {
+		t.Fatal("unpinned peer did not roam")
+	}
+}
+
+func TestEndpointMappedIPv4(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+
+	// a dual-stack conn may report an IPv4 source either way
+
+	var network sync.Map
+	pc := newTestPacketConn(&network, 1001)
+	bind := conn.CreatePacketConnBind(pc)
+	defer bind.Close()
+	receive := func(ip net.IP) conn.Endpoint {
+		pc.inbound <- testDatagram{data: []byte{0}, addr: &net.UDPAddr{IP: ip, Port: 51820}}
+		_, endpoint, err := bind.ReceiveIPv4(make([]byte, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return endpoint
+	}
+	mapped := receive(net.ParseIP("::ffff:127.0.0.1"))
+	plain := receive(net.IPv4(127, 0, 0, 1).To4())
+	if mapped.DstToString() != "127.0.0.1:51820" || len(mapped.DstIP()) != net.IPv4len {
+		t.Fatalf("IPv4-mapped address presented as %s", mapped.DstToString())
+	}
+	if !bytes.Equal(mapped.DstToBytes(), plain.DstToBytes()) {
+		t.Fatal("both representations differ in bytes")
+	}
+
+	// the pinned endpoint accepts either representation
+
+	peer.Lock()
+	peer.endpoint = plain
+	peer.Unlock()
+	peer.SetEndpointPinned(true)
+	if !device.acceptEndpoint(peer, mapped) {
+		t.Fatal("pinned peer rejected its endpoint as IPv4-mapped address")
+	}
+
+	// a cookie issued to one representation is valid for the other
+
+	var generator CookieGenerator
+	generator.Init(device.staticIdentity.publicKey)
+	msg := make([]byte, MessageInitiationSize)
+	generator.AddMacs(msg)
+	reply, err := device.cookieChecker.CreateReply(msg, 1377, mapped.DstToBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !generator.ConsumeReply(reply) {
+		t.Fatal("cookie reply rejected")
+	}
+	generator.AddMacs(msg)
+	if !device.cookieChecker.CheckMAC2(msg, plain.DstToBytes()) {
+		t.Fatal("cookie of IPv4-mapped address rejected for plain address")
+	}
+}
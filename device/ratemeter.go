@@ -0,0 +1,125 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Measures the rate of events per second over a sliding window of one second
+ *
+ * Events are counted in fixed one second windows; the rate is estimated by
+ * weighting the count of the previous window by how much of it still
+ * overlaps the sliding window. This smooths out the edges of a burst
+ * without keeping a timestamp per event.
+ */
+type rateMeter struct {
+	mutex    sync.Mutex
+	start    time.Time // start of the current window
+	current  uint64
+	previous uint64
+}
+
+func (meter *rateMeter) rotate(now time.Time) {
+	elapsed := now.Sub(meter.start)
+	if elapsed < time.Second {
+		return
+	}
+	if meter.start.IsZero() || elapsed >= 2*time.Second {
+		meter.previous = 0
+		meter.start = now
+	} else {
+		meter.previous = meter.current
+		meter.start = meter.start.Add(time.Second)
+	}
+	meter.current = 0
+}
+
+func (meter *rateMeter) Add(now time.Time) {
+	meter.mutex.Lock()
+	defer meter.mutex.Unlock()
+	meter.rotate(now)
+	meter.current++
+}
+
+func (meter *rateMeter) Rate(now time.Time) float64 {
+	meter.mutex.Lock()
+	defer meter.mutex.Unlock()
+	meter.rotate(now)
+	overlap := 1 - float64(now.Sub(meter.start))/float64(time.Second)
+	if overlap < 0 {
+		overlap = 0
+	}
+	return float64(meter.previous)*overlap + float64(meter.current)
+}
+
+/* Maintains an exponentially weighted moving average of events per second
+ *
+ * Events are only counted when they happen; a periodic sampler folds the
+ * count into the average, so neither side takes a lock.
+ */
+type rateAverage struct {
+	count   uint64 // events since the last sample
+	average uint64 // bits of the float64 moving average
+}
+
+func (avg *rateAverage) Add() {
+	atomic.AddUint64(&avg.count, 1)
+}
+
+func (avg *rateAverage) sample(interval time.Duration, weight float64) {
+	rate := float64(atomic.SwapUint64(&avg.count, 0)) / interval.Seconds()
+	old := math.Float64frombits(atomic.LoadUint64(&avg.average))
+	atomic.StoreUint64(&avg.average, math.Float64bits(old+weight*(rate-old)))
+}
+
+func (avg *rateAverage) Rate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&avg.average))
+}
+
+func (device *Device) RoutineSampleRates() {
+	logDebug := device.log.Debug
+
+	ticker := time.NewTicker(rateSampleInterval)
+	defer func() {
+		ticker.Stop()
+		logDebug.Println("Routine: rate sampler - stopped")
+		device.state.stopping.Done()
+	}()
+
+	beat := device.startHeartbeat("rate sampler", nil)
+	defer device.stopHeartbeat(beat)
+
+	logDebug.Println("Routine: rate sampler - started")
+	device.state.starting.Done()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			beat.beat()
+			device.stats.initiations.sample(rateSampleInterval, rateAverageWeight)
+			device.logLimiter.flush(now)
+		case <-device.signals.stop:
+			return
+		}
+	}
+}
+
+/* Returns the moving average of handshake initiations received per second
+ */
+func (device *Device) HandshakeRate() float64 {
+	return device.stats.initiations.Rate()
+}
+
+/* Returns the rate of handshake messages received over the last second, as
+ * compared to UnderLoadThresholds.HandshakeRate
+ */
+func (device *Device) HandshakeMessageRate() float64 {
+	return device.rate.handshakes.Rate(time.Now())
+}
@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateMeterSliding(t *testing.T) {
+	var meter rateMeter
+	start := time.Now()
+
+	for i := 0; i < 100; i++ {
+		meter.Add(start)
+	}
+
+	tests := []struct {
+		after time.Duration
+		rate  float64
+	}{
+		{0, 100},
+		{time.Second + time.Second/2, 50},
+		{time.Second + time.Second*3/4, 25},
+		{2 * time.Second, 0},
+	}
+	for _, test := range tests {
+		rate := meter.Rate(start.Add(test.after))
+		if rate < test.rate-0.001 || rate > test.rate+0.001 {
+			t.Errorf("rate after %v: got %f, expected %f", test.after, rate, test.rate)
+		}
+	}
+}
+
+func TestRateAverage(t *testing.T) {
+	var avg rateAverage
+
+	// a steady rate is approached, a silence decays
+
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 200; j++ {
+			avg.Add()
+		}
+		avg.sample(2*time.Second, 0.2)
+	}
+	if rate := avg.Rate(); rate < 99.9 || rate > 100.1 {
+		t.Fatalf("rate %f after steady sampling, expected 100", rate)
+	}
+	avg.sample(2*time.Second, 0.2)
+	if rate := avg.Rate(); rate < 79.9 || rate > 80.1 {
+		t.Fatalf("rate %f after one silent sample, expected 80", rate)
+	}
+}
+
+func TestUnderLoadHandshakeFlood(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	if err := device.SetUnderLoadThresholds(UnderLoadThresholds{QueueSize: 0}); err == nil {
+		t.Fatal("accepted queue size of zero")
+	}
+	if err := device.SetUnderLoadThresholds(UnderLoadThresholds{QueueSize: 1, HoldTime: time.Hour}); err == nil {
+		t.Fatal("accepted hold time longer than the lifetime of a cookie")
+	}
+	err := device.SetUnderLoadThresholds(UnderLoadThresholds{
+		QueueSize:     QueueHandshakeSize,
+		HandshakeRate: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hold := device.UnderLoadThresholds().HoldTime; hold != UnderLoadAfterTime {
+		t.Fatalf("hold time %v, expected default %v", hold, UnderLoadAfterTime)
+	}
+
+	// a few handshakes do not demand cookies
+
+	for i := 0; i < 10; i++ {
+		device.rate.handshakes.Add(time.Now())
+	}
+	if device.IsUnderLoad() {
+		t.Fatal("under load after a handful of handshakes")
+	}
+
+	// a flood does, even though the handshake queue is empty
+
+	for i := 0; i < 1000; i++ {
+		device.rate.handshakes.Add(time.Now())
+	}
+	if !device.IsUnderLoad() {
+		t.Fatal("not under load during a handshake flood")
+	}
+	if rate := device.HandshakeMessageRate(); rate < 1000 {
+		t.Fatalf("handshake message rate %v during a flood of 1010", rate)
+	}
+
+	// the device remains under load for the hold time
+
+	until := device.rate.underLoadUntil.Load().(time.Time)
+	if hold := time.Until(until); hold <= 0 || hold > UnderLoadAfterTime {
+		t.Fatalf("under load for %v, expected up to %v", hold, UnderLoadAfterTime)
+	}
+}
+
+func TestCookiePolicy(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	if device.CookiePolicy() != CookiePolicyAuto {
+		t.Fatal("cookie policy not automatic by default")
+	}
+	if err := device.SetCookiePolicy(CookiePolicyNever + 1); err == nil {
+		t.Fatal("accepted invalid cookie policy")
+	}
+
+	tests := []struct {
+		policy    CookiePolicy
+		underLoad bool
+		demand    bool
+	}{
+		{CookiePolicyAuto, false, false},
+		{CookiePolicyAuto, true, true},
+		{CookiePolicyAlways, false, true},
+		{CookiePolicyAlways, true, true},
+		{CookiePolicyNever, false, false},
+		{CookiePolicyNever, true, false},
+	}
+	for _, test := range tests {
+		if err := device.SetCookiePolicy(test.policy); err != nil {
+			t.Fatal(err)
+		}
+		if demand := device.demandsCookie(test.underLoad); demand != test.demand {
+			t.Errorf("policy %d under load %v: demands cookie %v, want %v", test.policy, test.underLoad, demand, test.demand)
+		}
+	}
+}
@@ -6,12 +6,13 @@
 package device
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"net"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
@@ -45,6 +46,25 @@ func (elem *QueueInboundElement) IsDropped() bool {
 	return atomic.LoadInt32(&elem.dropped) == AtomicTrue
 }
 
+/* Returns an element, which is no longer referenced by any queue,
+ * to the pools.
+ *
+ * The same element is shared by the decryption workers and the sequential
+ * receiver, hence this must only be called by the latter once the element
+ * has been unlocked. The buffer of a dropped element is owned by whoever
+ * dropped it, so it is only recycled for elements that were not dropped.
+ */
+func (device *Device) releaseInboundElement(elem *QueueInboundElement) {
+	if !elem.IsDropped() {
+		device.PutMessageBuffer(elem.buffer)
+	}
+	elem.buffer = nil
+	elem.packet = nil
+	elem.keypair = nil
+	elem.endpoint = nil
+	device.PutInboundElement(elem)
+}
+
 func (device *Device) addToInboundAndDecryptionQueues(inboundQueue chan *QueueInboundElement, decryptionQueue chan *QueueInboundElement, element *QueueInboundElement) bool {
 	select {
 	case inboundQueue <- element:
@@ -52,11 +72,13 @@ func (device *Device) addToInboundAndDecryptionQueues(inboundQueue chan *QueueIn
 		case decryptionQueue <- element:
 			return true
 		default:
+			device.countDrop(DropQueueOverflow)
 			element.Drop()
 			element.Unlock()
 			return false
 		}
 	default:
+		device.countDrop(DropQueueOverflow)
 		device.PutInboundElement(element)
 		return false
 	}
@@ -67,6 +89,26 @@ func (device *Device) addToHandshakeQueue(queue chan QueueHandshakeElement, elem
 	case queue <- element:
 		return true
 	default:
+	}
+	if device.HandshakeQueuePolicy() != HandshakeQueueDropOldest {
+		device.countDrop(DropHandshakeQueueOverflow)
+		return false
+	}
+
+	// make room by dropping the oldest message, unless a handshake
+	// routine just did, and try once more
+
+	select {
+	case oldest := <-queue:
+		device.countDrop(DropHandshakeQueueOverflow)
+		device.PutMessageBuffer(oldest.buffer)
+	default:
+	}
+	select {
+	case queue <- element:
+		return true
+	default:
+		device.countDrop(DropHandshakeQueueOverflow)
 		return false
 	}
 }
@@ -75,17 +117,96 @@ func (device *Device) addToHandshakeQueue(queue chan QueueHandshakeElement, elem
  *
  * NOTE: Not thread safe, but called by sequential receiver!
  */
-func (peer *Peer) keepKeyFreshReceiving() {
+func (peer *Peer) keepKeyFreshReceiving(keypair *Keypair, counter uint64) {
 	if peer.timers.sentLastMinuteHandshake.Get() {
 		return
 	}
-	keypair := peer.keypairs.Current()
-	if keypair != nil && keypair.isInitiator && time.Since(keypair.created) > (RejectAfterTime-KeepaliveTimeout-RekeyTimeout) {
+	current := peer.keypairs.Current()
+	if current == nil {
+		return
+	}
+
+	// the sender is expected to rekey after RekeyAfterMessages,
+	// but should it fail to do so, initiate before the keypair is exhausted
+
+	exhausting := keypair == current && counter > RekeyAfterMessages
+	expiring := current.isInitiator && peer.device.now().Sub(current.created) > (RejectAfterTime-peer.keepaliveTimeout()-peer.rekeyTimeout())
+	if exhausting || expiring {
 		peer.timers.sentLastMinuteHandshake.Set(true)
 		peer.SendHandshakeInitiation(false)
 	}
 }
 
+/* Reports whether a receive error is worth retrying rather than meaning
+ * the socket is gone, as when the bind was closed by a reconfiguration
+ *
+ * Errors reported for earlier sends (ICMP unreachables) and temporary
+ * resource shortages are transient; anything else is fatal.
+ */
+func isTransientReceiveError(err error) bool {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EINTR, syscall.EAGAIN, syscall.ENOBUFS, syscall.ENOMEM,
+			syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout() || netErr.Temporary()
+	}
+	return false
+}
+
+/* Reports whether a message of the type may have the size, handshake
+ * messages having a fixed size and transport messages a minimum one,
+ * and otherwise the reason to count its drop under
+ */
+func checkMessageSize(msgType uint32, size int) (DropReason, bool) {
+	switch msgType {
+	case MessageTransportType:
+		return DropSizeTransport, size >= MessageTransportSize
+	case MessageInitiationType:
+		return DropSizeInitiation, size == MessageInitiationSize
+	case MessageResponseType:
+		return DropSizeResponse, size == MessageResponseSize
+	case MessageCookieReplyType:
+		return DropSizeCookieReply, size == MessageCookieReplySize
+	}
+	return DropUnknownType, false
+}
+
+/* Updates the endpoint of the peer from an authenticated packet, counting
+ * the packet as dropped when the endpoint of the peer is pinned elsewhere
+ */
+func (device *Device) acceptEndpoint(peer *Peer, endpoint conn.Endpoint) bool {
+	if peer.SetEndpointFromPacket(endpoint) {
+		return true
+	}
+	device.DropEndpointMismatch(peer, endpoint)
+	return false
+}
+
+/* Checks the source of an authenticated packet against the pinned
+ * endpoint of the peer like acceptEndpoint, without updating the endpoint
+ */
+func (device *Device) checkEndpoint(peer *Peer, endpoint conn.Endpoint) bool {
+	if peer.endpointAccepted(endpoint) {
+		return true
+	}
+	device.DropEndpointMismatch(peer, endpoint)
+	return false
+}
+
+func (device *Device) DropEndpointMismatch(peer *Peer, endpoint conn.Endpoint) {
+	device.countDrop(DropEndpointMismatch)
+	if device.debugEnabled() {
+		device.limitedLogSink().Debug("Received packet from other than the pinned endpoint", "peer", peer, "src", endpoint.DstToString())
+	}
+}
+
 /* Receives incoming datagrams for the device
  *
  * Every time the bind is updated a new routine is started for
@@ -93,146 +214,330 @@ func (peer *Peer) keepKeyFreshReceiving() {
  */
 func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 
-	logDebug := device.log.Debug
 	defer func() {
-		logDebug.Println("Routine: receive incoming IPv" + strconv.Itoa(IP) + " - stopped")
+		device.logSink().Debug("Routine: receive incoming - stopped", "ip", "IPv"+strconv.Itoa(IP))
 		device.net.stopping.Done()
 	}()
 
-	logDebug.Println("Routine: receive incoming IPv" + strconv.Itoa(IP) + " - started")
+	// use batched reads when supported by the bind, and those of
+	// coalesced datagrams, which are also batched, when it may coalesce
+
+	batchSize := device.net.batchSize
+	batchBind, ok := bind.(conn.BatchReceiver)
+	if !ok || batchSize < 1 {
+		batchSize = 1
+	}
+	groBind, gro := bind.(conn.GROReceiver)
+
+	beat := device.startHeartbeat("receive incoming IPv"+strconv.Itoa(IP), nil)
+	defer device.stopHeartbeat(beat)
+
+	device.logSink().Debug("Routine: receive incoming - started", "ip", "IPv"+strconv.Itoa(IP))
 	device.net.starting.Done()
 
 	// receive datagrams until conn is closed
 
-	buffer := device.GetMessageBuffer()
+	buffers := make([]*[MaxMessageSize]byte, batchSize)
+	buffs := make([][]byte, batchSize)
+	sizes := make([]int, batchSize)
+	segs := make([]int, batchSize)
+	endpoints := make([]conn.Endpoint, batchSize)
+	for i := range buffers {
+		buffers[i] = device.GetMessageBuffer()
+	}
+
+	defer func() {
+		for _, buffer := range buffers {
+			device.PutMessageBuffer(buffer)
+		}
+	}()
 
 	var (
-		err      error
-		size     int
-		endpoint conn.Endpoint
+		err     error
+		count   int
+		backoff time.Duration
 	)
 
 	for {
 
-		// read next datagram
+		// read next datagrams
+
+		for i, buffer := range buffers {
+			buffs[i] = buffer[:]
+		}
 
 		switch IP {
 		case ipv4.Version:
-			size, endpoint, err = bind.ReceiveIPv4(buffer[:])
+			if gro {
+				count, err = groBind.ReceiveIPv4GRO(buffs, sizes, segs, endpoints)
+			} else if batchSize > 1 {
+				count, err = batchBind.ReceiveIPv4Batch(buffs, sizes, endpoints)
+			} else {
+				sizes[0], endpoints[0], err = bind.ReceiveIPv4(buffs[0])
+				count = 1
+			}
 		case ipv6.Version:
-			size, endpoint, err = bind.ReceiveIPv6(buffer[:])
+			if gro {
+				count, err = groBind.ReceiveIPv6GRO(buffs, sizes, segs, endpoints)
+			} else if batchSize > 1 {
+				count, err = batchBind.ReceiveIPv6Batch(buffs, sizes, endpoints)
+			} else {
+				sizes[0], endpoints[0], err = bind.ReceiveIPv6(buffs[0])
+				count = 1
+			}
 		default:
 			panic("invalid IP version")
 		}
 
 		if err != nil {
-			device.PutMessageBuffer(buffer)
-			return
-		}
 
-		if size < MinMessageSize {
+			// fall back to single reads where the kernel lacks batched ones
+
+			if (gro || batchSize > 1) && (errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EOPNOTSUPP)) {
+				device.logSink().Debug("Routine: receive incoming - batched reads unsupported", "ip", "IPv"+strconv.Itoa(IP), "err", err)
+				if gro {
+					if err := groBind.DisableGRO(); err != nil { // single reads do not split coalesced datagrams
+						device.logSink().Error("Routine: receive incoming - unable to disable GRO", "ip", "IPv"+strconv.Itoa(IP), "err", err)
+					}
+				}
+				gro, batchSize = false, 1
+				continue
+			}
+			if !isTransientReceiveError(err) {
+				device.logSink().Debug("Routine: receive incoming - socket failed", "ip", "IPv"+strconv.Itoa(IP), "err", err)
+				if !errors.Is(err, syscall.EAFNOSUPPORT) { // a family without socket is nothing to fix
+					go device.reopenBind(bind)
+				}
+				return
+			}
+			if backoff == 0 {
+				backoff = receiveBackoffMin
+			} else if backoff *= 2; backoff > receiveBackoffMax {
+				backoff = receiveBackoffMax
+			}
+			device.logSink().Debug("Transient receive error", "ip", "IPv"+strconv.Itoa(IP), "err", err, "backoff", backoff)
+			time.Sleep(backoff)
 			continue
 		}
+		backoff = 0
+		beat.beat()
+
+		for i := 0; i < count; i++ {
+			endpoint := endpoints[i]
+			endpoints[i] = nil
+			if device.handleCoalesced(buffers[i], sizes[i], segs[i], endpoint) {
+				buffers[i] = device.GetMessageBuffer()
+			}
+			segs[i] = 0
+		}
+	}
+}
 
-		// check size of packet
-
-		packet := buffer[:size]
-		msgType := binary.LittleEndian.Uint32(packet[:4])
+/* Dispatches the datagrams the kernel coalesced in the buffer, all of the
+ * segment size but the last, in their order, and reports whether the
+ * buffer was queued, like handleDatagram
+ *
+ * The datagrams following the first are copied to buffers of their own
+ * before the first is queued, as its buffer may be recycled as soon as
+ * it has been processed.
+ */
+func (device *Device) handleCoalesced(buffer *[MaxMessageSize]byte, size int, segment int, endpoint conn.Endpoint) bool {
 
-		var okay bool
+	// no datagram fills the buffer, as it exceeds the largest UDP payload,
+	// so one which does was truncated by a read which could not tell
 
-		switch msgType {
+	if size >= len(buffer) {
+		device.countDrop(DropTruncated)
+		if device.debugEnabled() {
+			device.limitedLogSink().Debug("Received truncated datagram", "size", size, "src", endpoint.DstToString())
+		}
+		return false
+	}
 
-		// check if transport
+	if segment <= 0 || segment >= size {
+		return device.handleDatagram(buffer, size, endpoint)
+	}
 
-		case MessageTransportType:
+	type datagram struct {
+		buffer *[MaxMessageSize]byte
+		size   int
+	}
+	rest := make([]datagram, 0, (size-1)/segment)
+	for offset := segment; offset < size; offset += segment {
+		end := offset + segment
+		if end > size {
+			end = size
+		}
+		if end-offset < MinMessageSize {
+			device.countDrop(DropShortPacket)
+			continue
+		}
+		copied := device.GetMessageBuffer()
+		rest = append(rest, datagram{copied, copy(copied[:], buffer[offset:end])})
+	}
 
-			// check size
+	queued := device.handleDatagram(buffer, segment, endpoint)
+	for _, datagram := range rest {
+		if !device.handleDatagram(datagram.buffer, datagram.size, endpoint) {
+			device.PutMessageBuffer(datagram.buffer)
+		}
+	}
+	return queued
+}
 
-			if len(packet) < MessageTransportSize {
-				continue
-			}
+/* Dispatches a datagram received from the endpoint by its type, queueing
+ * transport messages for decryption and handshake related messages for
+ * the handshake workers, and reports whether it was queued; the buffer
+ * then belongs to the queue, and the receiver must take another
+ */
+func (device *Device) handleDatagram(buffer *[MaxMessageSize]byte, size int, endpoint conn.Endpoint) bool {
+	if size < MinMessageSize {
+		device.countDrop(DropShortPacket)
+		return false
+	}
 
-			// lookup key pair
+	// check size of packet, before it takes a queue slot
 
-			receiver := binary.LittleEndian.Uint32(
-				packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
-			)
-			value := device.indexTable.Lookup(receiver)
-			keypair := value.keypair
-			if keypair == nil {
-				continue
-			}
+	packet := buffer[:size]
+	msgType := binary.LittleEndian.Uint32(packet[:4])
 
-			// check keypair expiry
+	if reason, ok := checkMessageSize(msgType, len(packet)); !ok {
+		device.countDrop(reason)
+		if reason == DropUnknownType && device.debugEnabled() {
+			device.limitedLogSink().Debug("Received message with unknown type", "type", msgType, "src", endpoint.DstToString())
+		}
+		return false
+	}
 
-			if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
-				continue
-			}
+	// check if transport
 
-			// create work element
-			peer := value.peer
-			elem := device.GetInboundElement()
-			elem.packet = packet
-			elem.buffer = buffer
-			elem.keypair = keypair
-			elem.dropped = AtomicFalse
-			elem.endpoint = endpoint
-			elem.counter = 0
-			elem.Mutex = sync.Mutex{}
-			elem.Lock()
+	if msgType == MessageTransportType {
 
-			// add to decryption queues
+		// lookup key pair
 
-			if peer.isRunning.Get() {
-				if device.addToInboundAndDecryptionQueues(peer.queue.inbound, device.queue.decryption, elem) {
-					buffer = device.GetMessageBuffer()
-				}
+		transport, err := ParseTransport(packet)
+		if err != nil {
+			device.countDrop(DropSizeTransport)
+			return false
+		}
+		receiver := transport.Receiver
+		value := device.indexTable.Lookup(receiver)
+		keypair := value.keypair
+		peer := value.peer
+		if keypair == nil || peer == nil {
+
+			// normal for a keypair just replaced, while a flood
+			// means scanning or peers out of sync
+
+			device.countDrop(DropUnknownIndex)
+			if device.debugEnabled() {
+				device.limitedLogSink().Debug("Received transport message for unknown index", "src", endpoint.DstToString(), "index", receiver)
 			}
+			return false
+		}
 
-			continue
+		// check keypair expiry
 
-		// otherwise it is a fixed size & handshake related packet
+		if keypair.created.Add(RejectAfterTime).Before(device.now()) {
+			return false
+		}
 
-		case MessageInitiationType:
-			okay = len(packet) == MessageInitiationSize
+		// check message limit, before spending time on decryption
 
-		case MessageResponseType:
-			okay = len(packet) == MessageResponseSize
+		counter := transport.Counter
+		if counter >= RejectAfterMessages {
+			device.countDrop(DropReplay)
+			return false
+		}
 
-		case MessageCookieReplyType:
-			okay = len(packet) == MessageCookieReplySize
+		// drop counters which are already behind the replay window,
+		// the sequential receiver performs the authoritative check
 
-		default:
-			logDebug.Println("Received message with unknown type")
+		if keypair.replayFilter.IsStale(counter) {
+			device.countDrop(DropReplay)
+			return false
 		}
 
-		if okay {
-			if (device.addToHandshakeQueue(
-				device.queue.handshake,
-				QueueHandshakeElement{
-					msgType:  msgType,
-					buffer:   buffer,
-					packet:   packet,
-					endpoint: endpoint,
-				},
-			)) {
-				buffer = device.GetMessageBuffer()
-			}
+		// create work element
+
+		if !peer.isRunning.Get() {
+			return false
+		}
+
+		elem := device.GetInboundElement()
+		elem.packet = packet
+		elem.buffer = buffer
+		elem.keypair = keypair
+		elem.dropped = AtomicFalse
+		elem.endpoint = endpoint
+		elem.counter = 0
+		elem.Mutex = sync.Mutex{}
+		elem.Lock()
+
+		// add to decryption queues
+
+		return device.addToInboundAndDecryptionQueues(peer.queue.inbound, device.queue.decryption, elem)
+	}
+
+	// otherwise it is a fixed size & handshake related packet
+
+	if msgType != MessageCookieReplyType {
+		device.rate.handshakes.Add(time.Now())
+	}
+	if device.addToHandshakeQueue(
+		device.queue.handshake,
+		QueueHandshakeElement{
+			msgType:  msgType,
+			buffer:   buffer,
+			packet:   packet,
+			endpoint: endpoint,
+		},
+	) {
+		if msgType == MessageInitiationType {
+			device.stats.initiations.Add()
 		}
+		return true
 	}
+	return false
 }
 
+/* Decrypts transport messages from the decryption queue
+ *
+ * One worker is started per CPU, all consuming the same queue,
+ * so elements complete out of order. This is safe because every element
+ * is also placed, in order of arrival, on the inbound queue of its peer
+ * and remains locked until decrypted (or dropped): the sequential receiver
+ * waits on the lock of the element at the head of that queue,
+ * which restores the ordering for each peer.
+ *
+ * Elements left in the queue when the workers stop are dropped and
+ * unlocked, so that no sequential receiver waits on them forever.
+ */
 func (device *Device) RoutineDecryption() {
 
 	var nonce [chacha20poly1305.NonceSize]byte
 
-	logDebug := device.log.Debug
 	defer func() {
-		logDebug.Println("Routine: decryption worker - stopped")
+		for {
+			select {
+			case elem, ok := <-device.queue.decryption:
+				if ok && !elem.IsDropped() {
+					elem.Drop()
+					device.PutMessageBuffer(elem.buffer)
+					elem.Unlock()
+				}
+			default:
+				goto out
+			}
+		}
+	out:
+		device.logSink().Debug("Routine: decryption worker - stopped")
 		device.state.stopping.Done()
 	}()
-	logDebug.Println("Routine: decryption worker - started")
+	beat := device.startHeartbeat("decryption worker", nil)
+	defer device.stopHeartbeat(beat)
+
+	device.logSink().Debug("Routine: decryption worker - started")
 	device.state.starting.Done()
 
 	for {
@@ -245,6 +550,7 @@ func (device *Device) RoutineDecryption() {
 			if !ok {
 				return
 			}
+			beat.beat()
 
 			// check if dropped
 
@@ -252,8 +558,16 @@ func (device *Device) RoutineDecryption() {
 				continue
 			}
 
-			// split message into fields
+			// split message into fields, the size was checked on receipt,
+			// but a bad slice must never panic the worker
 
+			if len(elem.packet) < MessageTransportSize {
+				device.countDrop(DropSizeTransport)
+				elem.Drop()
+				device.PutMessageBuffer(elem.buffer)
+				elem.Unlock()
+				continue
+			}
 			counter := elem.packet[MessageTransportOffsetCounter:MessageTransportOffsetContent]
 			content := elem.packet[MessageTransportOffsetContent:]
 
@@ -280,8 +594,12 @@ func (device *Device) RoutineDecryption() {
 				nil,
 			)
 			if err != nil {
+				device.countDrop(DropDecryptFail)
+				device.decryptFailed(elem.keypair)
 				elem.Drop()
 				device.PutMessageBuffer(elem.buffer)
+			} else {
+				device.decryptSucceeded(elem.keypair)
 			}
 			elem.Unlock()
 		}
@@ -292,22 +610,21 @@ func (device *Device) RoutineDecryption() {
  */
 func (device *Device) RoutineHandshake() {
 
-	logInfo := device.log.Info
-	logError := device.log.Error
-	logDebug := device.log.Debug
-
 	var elem QueueHandshakeElement
 	var ok bool
 
 	defer func() {
-		logDebug.Println("Routine: handshake worker - stopped")
+		device.logSink().Debug("Routine: handshake worker - stopped")
 		device.state.stopping.Done()
 		if elem.buffer != nil {
 			device.PutMessageBuffer(elem.buffer)
 		}
 	}()
 
-	logDebug.Println("Routine: handshake worker - started")
+	beat := device.startHeartbeat("handshake worker", nil)
+	defer device.stopHeartbeat(beat)
+
+	device.logSink().Debug("Routine: handshake worker - started")
 	device.state.starting.Done()
 
 	for {
@@ -325,6 +642,7 @@ func (device *Device) RoutineHandshake() {
 		if !ok {
 			return
 		}
+		beat.beat()
 
 		// handle cookie fields and ratelimiting
 
@@ -334,12 +652,14 @@ func (device *Device) RoutineHandshake() {
 
 			// unmarshal packet
 
-			var reply MessageCookieReply
-			reader := bytes.NewReader(elem.packet)
-			err := binary.Read(reader, binary.LittleEndian, &reply)
+			reply, err := ParseCookieReply(elem.packet)
 			if err != nil {
-				logDebug.Println("Failed to decode cookie reply")
-				return
+				device.countDrop(DropCookieFail)
+				atomic.AddUint64(&device.stats.cookiesRejected, 1)
+				if device.debugEnabled() {
+					device.limitedLogSink().Debug("Failed to decode cookie reply", "src", elem.endpoint.DstToString())
+				}
+				continue
 			}
 
 			// lookup peer from index
@@ -347,15 +667,24 @@ func (device *Device) RoutineHandshake() {
 			entry := device.indexTable.Lookup(reply.Receiver)
 
 			if entry.peer == nil {
+				atomic.AddUint64(&device.stats.cookiesRejected, 1)
 				continue
 			}
 
 			// consume reply
 
 			if peer := entry.peer; peer.isRunning.Get() {
-				logDebug.Println("Receiving cookie response from ", elem.endpoint.DstToString())
-				if !peer.cookieGenerator.ConsumeReply(&reply) {
-					logDebug.Println("Could not decrypt invalid cookie response")
+				if device.debugEnabled() {
+					device.logSink().Debug("Receiving cookie response", "peer", peer, "src", elem.endpoint.DstToString())
+				}
+				if peer.cookieGenerator.ConsumeReply(&reply) {
+					atomic.AddUint64(&device.stats.cookiesAccepted, 1)
+				} else {
+					device.countDrop(DropCookieFail)
+					atomic.AddUint64(&device.stats.cookiesRejected, 1)
+					if device.debugEnabled() {
+						device.limitedLogSink().Debug("Could not decrypt invalid cookie response", "peer", peer)
+					}
 				}
 			}
 
@@ -366,30 +695,43 @@ func (device *Device) RoutineHandshake() {
 			// check mac fields and maybe ratelimit
 
 			if !device.cookieChecker.CheckMAC1(elem.packet) {
-				logDebug.Println("Received packet with invalid mac1")
+				if elem.msgType == MessageInitiationType {
+					device.countDrop(DropMAC1FailInitiation)
+				} else {
+					device.countDrop(DropMAC1FailResponse)
+				}
+				if device.debugEnabled() {
+					device.limitedLogSink().Debug("Received packet with invalid mac1", "src", elem.endpoint.DstToString())
+				}
 				continue
 			}
 
 			// endpoints destination address is the source of the datagram
 
-			if device.IsUnderLoad() {
+			underLoad := device.IsUnderLoad()
+
+			// verify MAC2 field, as the cookie policy demands
+
+			if device.demandsCookie(underLoad) && !device.cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
+				device.countDrop(DropCookieFail)
 
-				// verify MAC2 field
+				// limit replies to prevent reflection
 
-				if !device.cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
+				if device.rate.cookieReplyLimiter.Allow(elem.endpoint.DstIP()) {
 					device.SendHandshakeCookie(&elem)
-					continue
 				}
+				continue
+			}
 
-				// check ratelimiter
+			// check ratelimiter
 
-				if !device.rate.limiter.Allow(elem.endpoint.DstIP()) {
-					continue
-				}
+			if underLoad && !device.rate.limiter.Allow(elem.endpoint.DstIP()) {
+				continue
 			}
 
 		default:
-			logError.Println("Invalid packet ended up in the handshake queue")
+			device.countDrop(DropUnknownType)
+			device.logSink().Error("Invalid packet ended up in the handshake queue", "type", elem.msgType)
 			continue
 		}
 
@@ -400,22 +742,22 @@ func (device *Device) RoutineHandshake() {
 
 			// unmarshal
 
-			var msg MessageInitiation
-			reader := bytes.NewReader(elem.packet)
-			err := binary.Read(reader, binary.LittleEndian, &msg)
+			msg, err := ParseInitiation(elem.packet)
 			if err != nil {
-				logError.Println("Failed to decode initiation message")
+				device.limitedLogSink().Error("Failed to decode initiation message", "src", elem.endpoint.DstToString())
 				continue
 			}
 
 			// consume initiation
 
-			peer := device.ConsumeMessageInitiation(&msg)
+			peer := device.consumeMessageInitiation(&msg, elem.endpoint)
 			if peer == nil {
-				logInfo.Println(
-					"Received invalid initiation message from",
-					elem.endpoint.DstToString(),
-				)
+				device.limitedLogSink().Info("Received invalid initiation message", "src", elem.endpoint.DstToString())
+				continue
+			}
+
+			// update endpoint
+			if !device.acceptEndpoint(peer, elem.endpoint) {
 				continue
 			}
 
@@ -424,11 +766,8 @@ func (device *Device) RoutineHandshake() {
 			peer.timersAnyAuthenticatedPacketTraversal()
 			peer.timersAnyAuthenticatedPacketReceived()
 
-			// update endpoint
-			peer.SetEndpointFromPacket(elem.endpoint)
-
-			logDebug.Println(peer, "- Received handshake initiation")
-			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
+			device.logSink().Debug("Received handshake initiation", "peer", peer)
+			peer.addRxBytes(len(elem.packet))
 
 			peer.SendHandshakeResponse()
 
@@ -436,30 +775,27 @@ func (device *Device) RoutineHandshake() {
 
 			// unmarshal
 
-			var msg MessageResponse
-			reader := bytes.NewReader(elem.packet)
-			err := binary.Read(reader, binary.LittleEndian, &msg)
+			msg, err := ParseResponse(elem.packet)
 			if err != nil {
-				logError.Println("Failed to decode response message")
+				device.limitedLogSink().Error("Failed to decode response message", "src", elem.endpoint.DstToString())
 				continue
 			}
 
 			// consume response
 
-			peer := device.ConsumeMessageResponse(&msg)
+			peer := device.consumeMessageResponse(&msg, elem.endpoint)
 			if peer == nil {
-				logInfo.Println(
-					"Received invalid response message from",
-					elem.endpoint.DstToString(),
-				)
+				device.limitedLogSink().Info("Received invalid response message", "src", elem.endpoint.DstToString())
 				continue
 			}
 
 			// update endpoint
-			peer.SetEndpointFromPacket(elem.endpoint)
+			if !device.acceptEndpoint(peer, elem.endpoint) {
+				continue
+			}
 
-			logDebug.Println(peer, "- Received handshake response")
-			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
+			device.logSink().Debug("Received handshake response", "peer", peer)
+			peer.addRxBytes(len(elem.packet))
 
 			// update timers
 
@@ -471,10 +807,17 @@ func (device *Device) RoutineHandshake() {
 			err = peer.BeginSymmetricSession()
 
 			if err != nil {
-				logError.Println(peer, "- Failed to derive keypair:", err)
+				atomic.AddUint64(&peer.stats.handshakesFailed, 1)
+				device.logSink().Error("Failed to derive keypair", "peer", peer, "err", err)
 				continue
 			}
 
+			peer.handshake.mutex.RLock()
+			latency := time.Since(peer.handshake.lastSentHandshake)
+			peer.handshake.mutex.RUnlock()
+			device.metrics().ObserveHandshakeLatency(latency)
+			peer.observeHandshakeLatency(latency)
+
 			peer.timersSessionDerived()
 			peer.timersHandshakeComplete()
 			peer.SendKeepalive()
@@ -489,33 +832,39 @@ func (device *Device) RoutineHandshake() {
 func (peer *Peer) RoutineSequentialReceiver() {
 
 	device := peer.device
-	logInfo := device.log.Info
-	logError := device.log.Error
-	logDebug := device.log.Debug
 
 	var elem *QueueInboundElement
 
 	defer func() {
-		logDebug.Println(peer, "- Routine: sequential receiver - stopped")
-		peer.routines.stopping.Done()
 		if elem != nil {
-			if !elem.IsDropped() {
-				device.PutMessageBuffer(elem.buffer)
+			device.releaseInboundElement(elem)
+		}
+		for {
+			select {
+			case elem, ok := <-peer.queue.inbound:
+				if ok {
+					elem.Lock()
+					device.releaseInboundElement(elem)
+				}
+			default:
+				goto out
 			}
-			device.PutInboundElement(elem)
 		}
+	out:
+		device.logSink().Debug("Routine: sequential receiver - stopped", "peer", peer)
+		peer.routines.stopping.Done()
 	}()
 
-	logDebug.Println(peer, "- Routine: sequential receiver - started")
+	beat := device.startHeartbeat("sequential receiver", peer)
+	defer device.stopHeartbeat(beat)
+
+	device.logSink().Debug("Routine: sequential receiver - started", "peer", peer)
 
 	peer.routines.starting.Done()
 
 	for {
 		if elem != nil {
-			if !elem.IsDropped() {
-				device.PutMessageBuffer(elem.buffer)
-			}
-			device.PutInboundElement(elem)
+			device.releaseInboundElement(elem)
 			elem = nil
 		}
 
@@ -528,6 +877,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 				return
 			}
 		}
+		beat.beat()
 
 		// wait for decryption
 
@@ -537,14 +887,33 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			continue
 		}
 
+		// check keypair expiry again, as time passed since it was received
+
+		if elem.keypair.created.Add(RejectAfterTime).Before(device.now()) {
+			continue
+		}
+
+		// check the pinned endpoint before the counter is consumed, so that
+		// a copy from elsewhere of a packet dropped by pinning cannot replay
+		// it, but update the endpoint only after, so that a replayed packet
+		// cannot make the peer roam
+
+		if !device.checkEndpoint(peer, elem.endpoint) {
+			continue
+		}
+
 		// check for replay
 
 		if !elem.keypair.replayFilter.ValidateCounter(elem.counter, RejectAfterMessages) {
+			device.countDrop(DropReplay)
 			continue
 		}
 
 		// update endpoint
-		peer.SetEndpointFromPacket(elem.endpoint)
+
+		if !device.acceptEndpoint(peer, elem.endpoint) {
+			continue
+		}
 
 		// check if using new keypair
 		if peer.ReceivedWithKeypair(elem.keypair) {
@@ -555,15 +924,21 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			}
 		}
 
-		peer.keepKeyFreshReceiving()
+		peer.keepKeyFreshReceiving(elem.keypair, elem.counter)
 		peer.timersAnyAuthenticatedPacketTraversal()
 		peer.timersAnyAuthenticatedPacketReceived()
-		atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)+MinMessageSize))
+		peer.timersTransportPacketReceived()
+		peer.addRxBytes(len(elem.packet) + MinMessageSize)
+		atomic.StoreInt64(&peer.stats.lastReceiveNano, time.Now().UnixNano())
 
-		// check for keepalive
+		// check for keepalive, which is the only authenticated message
+		// without content: data is always padded to a non-zero length
 
 		if len(elem.packet) == 0 {
-			logDebug.Println(peer, "- Receiving keepalive packet")
+			if device.debugEnabled() {
+				device.logSink().Debug("Receiving keepalive packet", "peer", peer)
+			}
+			atomic.AddUint64(&peer.stats.rxKeepalives, 1)
 			continue
 		}
 		peer.timersDataReceived()
@@ -576,12 +951,18 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			// strip padding
 
 			if len(elem.packet) < ipv4.HeaderLen {
+				device.countDrop(DropMalformed)
 				continue
 			}
 
+			// the header length counts 32-bit words, and both it and the
+			// total length must fit into what was received
+
+			headerLen := int(elem.packet[0]&0x0f) << 2
 			field := elem.packet[IPv4offsetTotalLength : IPv4offsetTotalLength+2]
 			length := binary.BigEndian.Uint16(field)
-			if int(length) > len(elem.packet) || int(length) < ipv4.HeaderLen {
+			if int(length) > len(elem.packet) || headerLen < ipv4.HeaderLen || int(length) < headerLen {
+				device.countDrop(DropMalformed)
 				continue
 			}
 
@@ -591,10 +972,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 
 			src := elem.packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
 			if device.allowedips.LookupIPv4(src) != peer {
-				logInfo.Println(
-					"IPv4 packet with disallowed source address from",
-					peer,
-				)
+				device.limitedLogSink().Info("IPv4 packet with disallowed source address", "peer", peer, "src", append(net.IP(nil), src...))
 				continue
 			}
 
@@ -603,13 +981,17 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			// strip padding
 
 			if len(elem.packet) < ipv6.HeaderLen {
+				device.countDrop(DropMalformed)
 				continue
 			}
 
+			// the payload length excludes the fixed header, so compute the
+			// total length as an int to avoid wrapping around uint16
+
 			field := elem.packet[IPv6offsetPayloadLength : IPv6offsetPayloadLength+2]
-			length := binary.BigEndian.Uint16(field)
-			length += ipv6.HeaderLen
-			if int(length) > len(elem.packet) {
+			length := int(binary.BigEndian.Uint16(field)) + ipv6.HeaderLen
+			if length > len(elem.packet) {
+				device.countDrop(DropMalformed)
 				continue
 			}
 
@@ -619,30 +1001,107 @@ func (peer *Peer) RoutineSequentialReceiver() {
 
 			src := elem.packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
 			if device.allowedips.LookupIPv6(src) != peer {
-				logInfo.Println(
-					"IPv6 packet with disallowed source address from",
-					peer,
-				)
+				device.limitedLogSink().Info("IPv6 packet with disallowed source address", "peer", peer, "src", append(net.IP(nil), src...))
 				continue
 			}
 
 		default:
-			logInfo.Println("Packet with invalid IP version from", peer)
+			device.limitedLogSink().Info("Packet with invalid IP version", "peer", peer)
+			device.countDrop(DropMalformed)
 			continue
 		}
 
-		// write to tun device
+		// validate checksums, if enabled for diagnosis
 
-		offset := MessageTransportOffsetContent
-		_, err := device.tun.device.Write(elem.buffer[:offset+len(elem.packet)], offset)
-		if len(peer.queue.inbound) == 0 {
-			err = device.tun.device.Flush()
-			if err != nil {
-				peer.device.log.Error.Printf("Unable to flush packets: %v", err)
+		if !validChecksums(elem.packet, ChecksumValidation(atomic.LoadUint32(&device.checksums))) {
+			device.limitedLogSink().Info("Packet with invalid checksum", "peer", peer)
+			device.countDrop(DropChecksum)
+			continue
+		}
+
+		// drop what would not fit the TUN device, rather than failing the write
+
+		if len(elem.packet) > device.MTU() {
+			atomic.AddUint64(&device.stats.rxOversized, 1)
+			if device.debugEnabled() {
+				device.logSink().Debug("Dropping packet exceeding the MTU", "peer", peer, "size", len(elem.packet))
 			}
+			continue
+		}
+
+		// forward what is routed to another peer, in transit mode
+
+		if device.transit.Get() && device.forwardTransit(elem.packet, peer) {
+			continue
+		}
+
+		// hand over to the writer of the flow, if writing in parallel
+
+		if writers := device.queue.tunWriters; len(writers) > 0 {
+			select {
+			case writers[flowHash(elem.packet)%uint32(len(writers))] <- elem:
+				elem = nil
+			case <-device.signals.stop:
+			}
+			continue
+		}
+
+		// write to tun device
+
+		if device.deliverToTUN(elem, len(peer.queue.inbound) == 0) {
+			device.logSink().Error("TUN device closed, stopping receiving", "peer", peer)
+			return
 		}
-		if err != nil && !device.isClosed.Get() {
-			logError.Println("Failed to write packet to TUN device:", err)
+	}
+}
+
+/* Writes the packet of a received element to the TUN device, flushing if
+ * requested, and reports whether the TUN device has been closed
+ */
+func (device *Device) deliverToTUN(elem *QueueInboundElement, flush bool) bool {
+	offset := MessageTransportOffsetContent
+	err := device.writeToTUN(elem.buffer[:offset+len(elem.packet)], offset)
+	if flush {
+		if err := device.tunDevice().Flush(); err != nil {
+			device.logSink().Error("Unable to flush packets", "err", err)
+		}
+	}
+	if err == nil || device.isClosed.Get() {
+		return false
+	}
+
+	// a closed TUN device fails every write, the device is closing
+
+	if isClosedTUNError(err) {
+		return true
+	}
+	device.limitedLogSink().Error("Failed to write packet to TUN device", "err", err)
+	return false
+}
+
+/* Writes the packets of the flows assigned to it to the TUN device, when
+ * writing in parallel, see DeviceOptions
+ */
+func (device *Device) RoutineWriteToTUN(queue chan *QueueInboundElement) {
+	defer func() {
+		device.logSink().Debug("Routine: TUN writer - stopped")
+		device.state.stopping.Done()
+	}()
+
+	beat := device.startHeartbeat("TUN writer", nil)
+	defer device.stopHeartbeat(beat)
+
+	device.logSink().Debug("Routine: TUN writer - started")
+	device.state.starting.Done()
+
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+		case elem := <-queue:
+			beat.beat()
+			device.deliverToTUN(elem, len(queue) == 0)
+			device.releaseInboundElement(elem)
 		}
 	}
 }
@@ -0,0 +1,1342 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// testIPv4Packet returns a minimal IPv4 packet carrying payload.
+func testIPv4Packet(src, dst net.IP, payload []byte) []byte {
+	packet := make([]byte, ipv4.HeaderLen+len(payload))
+	packet[0] = ipv4.Version<<4 | ipv4.HeaderLen/4
+	binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(len(packet)))
+	copy(packet[IPv4offsetSrc:], src.To4())
+	copy(packet[IPv4offsetDst:], dst.To4())
+	copy(packet[ipv4.HeaderLen:], payload)
+	return packet
+}
+
+// newTestKeypair returns a keypair using the same random key in both
+// directions, so that it can decrypt what it encrypts.
+func newTestKeypair(t testing.TB) *Keypair {
+	var key [chacha20poly1305.KeySize]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	keypair := &Keypair{
+		send:    aead,
+		receive: aead,
+		created: time.Now(),
+	}
+	keypair.replayFilter.Init()
+	return keypair
+}
+
+// newTestPeer adds a running peer to the device, routing the given address.
+func newTestPeer(t testing.TB, device *Device, ip net.IP) *Peer {
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := device.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.allowedips.Insert(ip.To4(), 32, peer)
+	peer.Start()
+	return peer
+}
+
+// queueTransportPacket encrypts the plaintext with the keypair and queues
+// it for decryption, the same way RoutineReceiveIncoming does.
+func queueTransportPacket(device *Device, peer *Peer, keypair *Keypair, counter uint64, plaintext []byte) {
+	queueTransportPacketFrom(device, peer, keypair, counter, plaintext, nil)
+}
+
+// queueTransportPacketFrom is queueTransportPacket for a packet received
+// from the endpoint.
+func queueTransportPacketFrom(device *Device, peer *Peer, keypair *Keypair, counter uint64, plaintext []byte, endpoint conn.Endpoint) {
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+
+	buffer := device.GetMessageBuffer()
+	binary.LittleEndian.PutUint32(buffer[0:4], MessageTransportType)
+	binary.LittleEndian.PutUint32(buffer[MessageTransportOffsetReceiver:], keypair.localIndex)
+	binary.LittleEndian.PutUint64(buffer[MessageTransportOffsetCounter:], counter)
+	content := keypair.send.Seal(
+		buffer[MessageTransportOffsetContent:MessageTransportOffsetContent],
+		nonce[:],
+		plaintext,
+		nil,
+	)
+
+	elem := device.GetInboundElement()
+	elem.packet = buffer[:MessageTransportOffsetContent+len(content)]
+	elem.buffer = buffer
+	elem.keypair = keypair
+	elem.dropped = AtomicFalse
+	elem.endpoint = endpoint
+	elem.counter = 0
+	elem.Mutex = sync.Mutex{}
+	elem.Lock()
+
+	if !device.addToInboundAndDecryptionQueues(peer.queue.inbound, device.queue.decryption, elem) {
+		device.PutMessageBuffer(buffer)
+	}
+}
+
+// recordingSink is a LogSink which keeps the info messages it receives.
+type recordingSink struct {
+	sync.Mutex
+	infos []map[string]interface{}
+}
+
+func (sink *recordingSink) Debug(msg string, keyvals ...interface{}) {}
+func (sink *recordingSink) Error(msg string, keyvals ...interface{}) {}
+
+func (sink *recordingSink) Info(msg string, keyvals ...interface{}) {
+	fields := map[string]interface{}{"msg": msg}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields[keyvals[i].(string)] = keyvals[i+1]
+	}
+	sink.Lock()
+	sink.infos = append(sink.infos, fields)
+	sink.Unlock()
+}
+
+// TestDecryptionOrdering checks that packets decrypted by the parallel
+// decryption workers reach the TUN device in the order in which they were
+// received, for each peer.
+func TestDecryptionOrdering(t *testing.T) {
+	const count = 512
+
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+
+	local := net.IPv4(1, 0, 0, 1)
+	remotes := []net.IP{net.IPv4(1, 0, 0, 2), net.IPv4(1, 0, 0, 3)}
+	peers := make([]*Peer, len(remotes))
+	keypairs := make([]*Keypair, len(remotes))
+	for i, remote := range remotes {
+		peers[i] = newTestPeer(t, device, remote)
+		keypairs[i] = newTestKeypair(t)
+	}
+
+	go func() {
+		var payload [8]byte
+		for counter := uint64(0); counter < count; counter++ {
+			for i, remote := range remotes {
+				binary.BigEndian.PutUint64(payload[:], counter)
+				queueTransportPacket(device, peers[i], keypairs[i], counter, testIPv4Packet(remote, local, payload[:]))
+			}
+		}
+	}()
+
+	next := make(map[string]uint64)
+	for received := 0; received < count*len(remotes); received++ {
+		select {
+		case packet := <-tun.Inbound:
+			src := net.IP(packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]).String()
+			counter := binary.BigEndian.Uint64(packet[ipv4.HeaderLen:])
+			if counter != next[src] {
+				t.Fatalf("packet %d from %s received out of order, expected %d", counter, src, next[src])
+			}
+			next[src]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after receiving %d packets", received)
+		}
+	}
+}
+
+// batchTestBind is a bind reading batches of datagrams from a channel, or
+// failing batched reads like kernels without recvmmsg(2).
+type batchTestBind struct {
+	DummyBind
+	batches     chan [][]byte
+	unsupported bool
+	batchReads  int32
+}
+
+func (b *batchTestBind) LastMark() uint32 {
+	return 0
+}
+
+func (b *batchTestBind) ReceiveIPv4Batch(buffs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+	atomic.AddInt32(&b.batchReads, 1)
+	if b.unsupported {
+		return 0, syscall.ENOSYS
+	}
+	batch, ok := <-b.batches
+	if !ok {
+		return 0, syscall.EAFNOSUPPORT
+	}
+	for i, datagram := range batch {
+		sizes[i] = copy(buffs[i], datagram)
+		eps[i], _ = conn.CreateEndpoint("127.0.0.1:1")
+	}
+	return len(batch), nil
+}
+
+func (b *batchTestBind) ReceiveIPv6Batch(buffs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+	return 0, syscall.EAFNOSUPPORT
+}
+
+func (b *batchTestBind) ReceiveIPv4(buff []byte) (int, conn.Endpoint, error) {
+	batch, ok := <-b.batches
+	if !ok {
+		return 0, nil, syscall.EAFNOSUPPORT
+	}
+	endpoint, _ := conn.CreateEndpoint("127.0.0.1:1")
+	return copy(buff, batch[0]), endpoint, nil
+}
+
+func TestReceiveBatch(t *testing.T) {
+	packet := make([]byte, MessageTransportSize)
+	binary.LittleEndian.PutUint32(packet[:4], MessageTransportType)
+	binary.LittleEndian.PutUint32(packet[MessageTransportOffsetReceiver:], 0x1234)
+
+	for _, unsupported := range []bool{false, true} {
+		device := randDevice(t)
+		bind := &batchTestBind{batches: make(chan [][]byte, 2), unsupported: unsupported}
+		device.net.batchSize = 4
+
+		// batched reads take all datagrams read at once, single reads
+		// one at a time, until the bind runs dry
+
+		if unsupported {
+			bind.batches <- [][]byte{packet}
+			bind.batches <- [][]byte{packet}
+		} else {
+			bind.batches <- [][]byte{packet, packet}
+		}
+		close(bind.batches)
+		device.net.starting.Add(1)
+		device.net.stopping.Add(1)
+		go device.RoutineReceiveIncoming(ipv4.Version, bind)
+		device.net.starting.Wait()
+		device.net.stopping.Wait()
+
+		if left := len(bind.batches); left != 0 {
+			t.Errorf("unsupported %v: %d batches left unread", unsupported, left)
+		}
+		if reads := atomic.LoadInt32(&bind.batchReads); unsupported && reads != 1 || !unsupported && reads != 2 {
+			t.Errorf("unsupported %v: %d batched reads", unsupported, reads)
+		}
+		device.Close()
+	}
+}
+
+// TestDisallowedSourceDropped checks that decrypted packets are only
+// delivered when their source address is within the allowed IPs of the peer
+// which sent them.
+func TestDisallowedSourceDropped(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	other := net.IPv4(1, 0, 0, 3)
+	peer := newTestPeer(t, device, remote)
+	newTestPeer(t, device, other)
+	keypair := newTestKeypair(t)
+
+	sink := new(recordingSink)
+	device.SetLogSink(sink)
+
+	spoofed := testIPv4Packet(other, local, []byte("spoofed"))
+	allowed := testIPv4Packet(remote, local, []byte("allowed"))
+	queueTransportPacket(device, peer, keypair, 0, spoofed)
+	queueTransportPacket(device, peer, keypair, 1, allowed)
+
+	select {
+	case packet := <-tun.Inbound:
+		if !bytes.Equal(packet, allowed) {
+			t.Fatal("packet with disallowed source address was delivered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet with allowed source address was not delivered")
+	}
+
+	sink.Lock()
+	defer sink.Unlock()
+	if len(sink.infos) != 1 {
+		t.Fatalf("got %d info messages, expected 1", len(sink.infos))
+	}
+	if src, ok := sink.infos[0]["src"].(net.IP); !ok || !src.Equal(other) {
+		t.Errorf("got source %v, expected %v", sink.infos[0]["src"], other)
+	}
+	if sink.infos[0]["peer"] != peer {
+		t.Errorf("got peer %v, expected %v", sink.infos[0]["peer"], peer)
+	}
+}
+
+func TestMalformedPacketDropped(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(t, device, remote)
+	keypair := newTestKeypair(t)
+
+	badVersion := testIPv4Packet(remote, local, []byte("version"))
+	badVersion[0] = 0x55
+	shortHeader := testIPv4Packet(remote, local, []byte("header"))
+	shortHeader[0] = 0x44
+	longHeader := testIPv4Packet(remote, local, []byte("header"))
+	longHeader[0] = 0x4f
+	truncated := make([]byte, ipv6.HeaderLen-1)
+	truncated[0] = 0x60
+	valid := testIPv4Packet(remote, local, []byte("valid"))
+
+	for i, packet := range [][]byte{badVersion, shortHeader, longHeader, truncated, valid} {
+		queueTransportPacket(device, peer, keypair, uint64(i), packet)
+	}
+	if packet := <-tun.Inbound; !bytes.Equal(packet, valid) {
+		t.Fatal("malformed packet was delivered")
+	}
+	if malformed := device.DropStats().Malformed; malformed != 4 {
+		t.Fatalf("counted %d malformed packets, expected 4", malformed)
+	}
+}
+
+func TestChecksumValidation(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(t, device, remote)
+	keypair := newTestKeypair(t)
+
+	// a UDP datagram with valid checksums
+
+	udp := make([]byte, udpHeaderLen+len("datagram"))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[udpHeaderLen:], "datagram")
+	valid := testIPv4Packet(remote, local, udp)
+	valid[8] = 64
+	valid[9] = udpProtocolNumber
+	sum := pseudoHeaderSum(valid[IPv4offsetSrc:ipv4.HeaderLen], udpProtocolNumber, len(udp))
+	binary.BigEndian.PutUint16(valid[ipv4.HeaderLen+6:], checksum(valid[ipv4.HeaderLen:], sum))
+	binary.BigEndian.PutUint16(valid[10:], checksum(valid[:ipv4.HeaderLen], 0))
+
+	badHeader := append([]byte{}, valid...)
+	badHeader[10] ^= 0xff
+	badPayload := append([]byte{}, valid...)
+	badPayload[len(badPayload)-1] ^= 0xff
+
+	counter := uint64(0)
+	deliver := func(packets ...[]byte) {
+		for _, packet := range packets {
+			queueTransportPacket(device, peer, keypair, counter, packet)
+			counter++
+		}
+	}
+
+	// nothing is validated by default
+
+	deliver(badHeader)
+	if packet := <-tun.Inbound; !bytes.Equal(packet, badHeader) {
+		t.Fatal("packet not delivered without validation")
+	}
+
+	device.SetChecksumValidation(ChecksumValidationIP)
+	deliver(badHeader, badPayload)
+	if packet := <-tun.Inbound; !bytes.Equal(packet, badPayload) {
+		t.Fatal("packet with invalid header checksum delivered")
+	}
+
+	device.SetChecksumValidation(ChecksumValidationAll)
+	deliver(badHeader, badPayload, valid)
+	if packet := <-tun.Inbound; !bytes.Equal(packet, valid) {
+		t.Fatal("packet with invalid checksum delivered")
+	}
+	if dropped := device.DropStats().Checksum; dropped != 3 {
+		t.Fatalf("counted %d checksum failures, expected 3", dropped)
+	}
+}
+
+// TestCloseWithQueuedPackets checks that closing a device does not hang
+// while transport packets are still waiting to be decrypted or delivered.
+func TestCloseWithQueuedPackets(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(t, device, remote)
+	keypair := newTestKeypair(t)
+
+	// nothing reads from the TUN device, so packets pile up in the queues
+
+	packet := testIPv4Packet(remote, local, make([]byte, 1024))
+	for counter := uint64(0); counter < QueueInboundSize; counter++ {
+		queueTransportPacket(device, peer, keypair, counter, packet)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		device.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("device did not close with packets in flight")
+	}
+}
+
+// TestKeepaliveReceived checks that keepalives are accounted for,
+// but not written to the TUN device.
+func TestKeepaliveReceived(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(t, device, remote)
+	keypair := newTestKeypair(t)
+
+	data := testIPv4Packet(remote, local, []byte("data"))
+	queueTransportPacket(device, peer, keypair, 0, nil)
+	queueTransportPacket(device, peer, keypair, 1, data)
+
+	select {
+	case packet := <-tun.Inbound:
+		if !bytes.Equal(packet, data) {
+			t.Fatal("keepalive was written to the TUN device")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("data packet was not delivered")
+	}
+
+	stats := peer.Stats()
+	if stats.RxKeepalives != 1 {
+		t.Errorf("got %d keepalives, expected 1", stats.RxKeepalives)
+	}
+	if expected := uint64(2*MinMessageSize + len(data)); stats.RxBytes != expected {
+		t.Errorf("got %d bytes received, expected %d", stats.RxBytes, expected)
+	}
+	if stats.LastReceive.IsZero() {
+		t.Error("last receive time not updated")
+	}
+}
+
+// TestOversizedPacketDropped checks that decrypted packets exceeding the MTU
+// are dropped and counted, while the packets after them are still delivered.
+func TestOversizedPacketDropped(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+
+	if err := device.SetMTU(MaxContentSize + 1); err == nil {
+		t.Fatal("accepted MTU larger than the maximum content size")
+	}
+	if err := device.SetMTU(1280); err != nil {
+		t.Fatal(err)
+	}
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(t, device, remote)
+	keypair := newTestKeypair(t)
+
+	oversized := testIPv4Packet(remote, local, make([]byte, 1280))
+	fitting := testIPv4Packet(remote, local, make([]byte, 1280-ipv4.HeaderLen))
+	queueTransportPacket(device, peer, keypair, 0, oversized)
+	queueTransportPacket(device, peer, keypair, 1, fitting)
+
+	select {
+	case packet := <-tun.Inbound:
+		if len(packet) != len(fitting) {
+			t.Fatalf("got packet of %d bytes, expected %d", len(packet), len(fitting))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet fitting the MTU was not delivered")
+	}
+
+	if dropped := device.Stats().RxOversized; dropped != 1 {
+		t.Errorf("got %d oversized packets, expected 1", dropped)
+	}
+}
+
+// TestExpiredKeypairDropped checks that packets are not delivered once their
+// keypair has expired, even if it was still valid when they were received.
+func TestExpiredKeypairDropped(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(t, device, remote)
+	expired := newTestKeypair(t)
+	expired.created = time.Now().Add(-RejectAfterTime)
+	current := newTestKeypair(t)
+
+	stale := testIPv4Packet(remote, local, []byte("expired"))
+	fresh := testIPv4Packet(remote, local, []byte("current"))
+	queueTransportPacket(device, peer, expired, 0, stale)
+	queueTransportPacket(device, peer, current, 0, fresh)
+
+	select {
+	case packet := <-tun.Inbound:
+		if !bytes.Equal(packet, fresh) {
+			t.Fatal("packet of expired keypair was delivered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet of current keypair was not delivered")
+	}
+}
+
+// TestReplayDoesNotRoam checks that a replayed packet from another address
+// neither makes the peer roam nor is delivered.
+func TestReplayDoesNotRoam(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(t, device, remote)
+	keypair := newTestKeypair(t)
+	endpoints := make([]conn.Endpoint, 2)
+	for i := range endpoints {
+		endpoint, err := conn.CreateEndpoint(fmt.Sprintf("127.0.0.%d:51820", 1+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoints[i] = endpoint
+	}
+	peer.Lock()
+	peer.endpoint = endpoints[0]
+	peer.Unlock()
+
+	first := testIPv4Packet(remote, local, []byte("first"))
+	second := testIPv4Packet(remote, local, []byte("second"))
+	queueTransportPacketFrom(device, peer, keypair, 0, first, endpoints[0])
+	queueTransportPacketFrom(device, peer, keypair, 0, first, endpoints[1])
+	queueTransportPacketFrom(device, peer, keypair, 1, second, endpoints[0])
+
+	for _, expected := range [][]byte{first, second} {
+		select {
+		case packet := <-tun.Inbound:
+			if !bytes.Equal(packet, expected) {
+				t.Fatal("replayed packet was delivered")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("packet was not delivered")
+		}
+	}
+
+	peer.RLock()
+	endpoint := peer.endpoint
+	peer.RUnlock()
+	if endpoint != endpoints[0] {
+		t.Fatalf("replayed packet moved the endpoint to %s", endpoint.DstToString())
+	}
+	if replays := device.DropStats().Replay; replays != 1 {
+		t.Errorf("got %d replays, expected 1", replays)
+	}
+}
+
+func TestClockExpiresKeypair(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+
+	var offset int64 // nanoseconds the clock is ahead, accessed atomically
+	device.SetClock(func() time.Time {
+		return time.Now().Add(time.Duration(atomic.LoadInt64(&offset)))
+	})
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(t, device, remote)
+	keypair := newTestKeypair(t)
+	keypair.created = device.now()
+	peer.keypairs.Lock()
+	peer.keypairs.current = keypair
+	peer.keypairs.Unlock()
+
+	// only the clock of the device makes the keypair expire
+
+	atomic.StoreInt64(&offset, int64(RejectAfterTime+time.Second))
+	if info := peer.Stats().Keypair; info == nil || info.Lifetime != 0 {
+		t.Fatalf("keypair not expired by the clock: %+v", info)
+	}
+	current := newTestKeypair(t)
+	current.created = device.now()
+
+	stale := testIPv4Packet(remote, local, []byte("expired"))
+	fresh := testIPv4Packet(remote, local, []byte("current"))
+	queueTransportPacket(device, peer, keypair, 0, stale)
+	queueTransportPacket(device, peer, current, 0, fresh)
+
+	select {
+	case packet := <-tun.Inbound:
+		if !bytes.Equal(packet, fresh) {
+			t.Fatal("packet of keypair expired by the clock was delivered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet of current keypair was not delivered")
+	}
+}
+
+// TestDropStats checks that dropped packets are counted by reason.
+func TestDropStats(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+	metrics := new(testMetrics)
+	device.SetMetrics(metrics)
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(t, device, remote)
+	keypair := newTestKeypair(t)
+
+	// a replayed transport message
+
+	packet := testIPv4Packet(remote, local, []byte("replayed"))
+	queueTransportPacket(device, peer, keypair, 0, packet)
+	queueTransportPacket(device, peer, keypair, 0, packet)
+	<-tun.Inbound
+
+	// a handshake message without a valid mac1
+
+	endpoint, err := conn.CreateEndpoint("127.0.0.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := device.GetMessageBuffer()
+	binary.LittleEndian.PutUint32(buffer[:4], MessageInitiationType)
+	device.queue.handshake <- QueueHandshakeElement{
+		msgType:  MessageInitiationType,
+		buffer:   buffer,
+		packet:   buffer[:MessageInitiationSize],
+		endpoint: endpoint,
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := device.DropStats()
+		if stats.Replay == 1 && stats.MAC1Fail == 1 && stats.MAC1FailInitiation == 1 && stats.MAC1FailResponse == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected drop statistics: %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	if metrics.drops[DropReplay] != 1 || metrics.drops[DropMAC1FailInitiation] != 1 {
+		t.Errorf("unexpected drops reported to metrics: %v", metrics.drops)
+	}
+	if name := DropMAC1FailInitiation.String(); name != "mac1_fail_initiation" {
+		t.Errorf("unexpected name of drop reason: %q", name)
+	}
+}
+
+func TestCookieReplyStats(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+	index, err := device.indexTable.NewIndexForHandshake(peer, &peer.handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := conn.CreateEndpoint("127.0.0.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer replies to an initiation of ours with a cookie
+
+	initiation := make([]byte, MessageInitiationSize)
+	peer.cookieGenerator.AddMacs(initiation)
+	var checker CookieChecker
+	checker.Init(peer.handshake.remoteStatic)
+
+	queueReply := func(receiver uint32, tamper bool) {
+		reply, err := checker.CreateReply(initiation, receiver, endpoint.DstToBytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tamper {
+			reply.Cookie[0] ^= 1
+		}
+		var writer bytes.Buffer
+		binary.Write(&writer, binary.LittleEndian, reply)
+		buffer := device.GetMessageBuffer()
+		packet := buffer[:copy(buffer[:], writer.Bytes())]
+		device.queue.handshake <- QueueHandshakeElement{
+			msgType:  MessageCookieReplyType,
+			buffer:   buffer,
+			packet:   packet,
+			endpoint: endpoint,
+		}
+	}
+	queueReply(index, false)
+	queueReply(index+1, false)
+	queueReply(index, true)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := device.Stats()
+		if stats.CookieRepliesAccepted == 1 && stats.CookieRepliesRejected == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected cookie reply statistics: %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// receiveDatagram feeds the datagram to the device as if it was received
+// from src, reporting whether it was queued.
+func receiveDatagram(t *testing.T, device *Device, datagram []byte, src string) bool {
+	endpoint, err := conn.CreateEndpoint(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := device.GetMessageBuffer()
+	size := copy(buffer[:], datagram)
+	if !device.handleDatagram(buffer, size, endpoint) {
+		device.PutMessageBuffer(buffer)
+		return false
+	}
+	return true
+}
+
+// waitDropStats waits for the drop statistics to satisfy ok.
+func waitDropStats(t *testing.T, device *Device, ok func(DropStats) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := device.DropStats()
+		if ok(stats) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected drop statistics: %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHandleDatagram(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.SetPrivateKey(sk)
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(t, device, remote)
+	const src = "127.0.0.1:51820"
+
+	message := func(msgType uint32, size int) []byte {
+		datagram := make([]byte, size)
+		binary.LittleEndian.PutUint32(datagram, msgType)
+		return datagram
+	}
+	transport := func(keypair *Keypair, counter uint64, plaintext []byte) []byte {
+		var nonce [chacha20poly1305.NonceSize]byte
+		binary.LittleEndian.PutUint64(nonce[4:], counter)
+		datagram := message(MessageTransportType, MessageTransportOffsetContent)
+		binary.LittleEndian.PutUint32(datagram[MessageTransportOffsetReceiver:], keypair.localIndex)
+		binary.LittleEndian.PutUint64(datagram[MessageTransportOffsetCounter:], counter)
+		return keypair.send.Seal(datagram, nonce[:], plaintext, nil)
+	}
+	register := func(keypair *Keypair) {
+		index, err := device.indexTable.NewIndexForHandshake(peer, &peer.handshake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keypair.localIndex = index
+		device.indexTable.SwapIndexForKeypair(index, keypair)
+	}
+
+	t.Run("malformed", func(t *testing.T) {
+		tests := []struct {
+			datagram []byte
+			ok       func(DropStats) bool
+		}{
+			{message(MessageTransportType, MinMessageSize-1), func(s DropStats) bool { return s.ShortPacket-s.SizeInitiation-s.SizeResponse == 1 }},
+			{message(9, MessageTransportSize), func(s DropStats) bool { return s.UnknownType == 1 }},
+			{message(MessageInitiationType, MessageInitiationSize-1), func(s DropStats) bool { return s.SizeInitiation == 1 }},
+			{message(MessageResponseType, MessageResponseSize+1), func(s DropStats) bool { return s.SizeResponse == 1 }},
+			{message(MessageTransportType, MessageTransportSize), func(s DropStats) bool { return s.UnknownIndex == 1 }},
+		}
+		for _, test := range tests {
+			if receiveDatagram(t, device, test.datagram, src) {
+				t.Fatalf("queued malformed datagram %x", test.datagram)
+			}
+		}
+		waitDropStats(t, device, func(s DropStats) bool {
+			for _, test := range tests {
+				if !test.ok(s) {
+					return false
+				}
+			}
+			return true
+		})
+	})
+
+	t.Run("transport", func(t *testing.T) {
+		expired := newTestKeypair(t)
+		expired.created = time.Now().Add(-RejectAfterTime)
+		register(expired)
+		if receiveDatagram(t, device, transport(expired, 0, []byte("expired")), src) {
+			t.Fatal("queued transport message of expired keypair")
+		}
+
+		current := newTestKeypair(t)
+		register(current)
+		replays := device.DropStats().Replay
+		if receiveDatagram(t, device, transport(current, RejectAfterMessages, []byte("exhausted")), src) {
+			t.Fatal("queued transport message past the message limit")
+		}
+		waitDropStats(t, device, func(s DropStats) bool { return s.Replay == replays+1 })
+
+		packet := testIPv4Packet(remote, local, []byte("current"))
+		if !receiveDatagram(t, device, transport(current, 0, packet), src) {
+			t.Fatal("transport message of current keypair not queued")
+		}
+		select {
+		case received := <-tun.Inbound:
+			if !bytes.Equal(received, packet) {
+				t.Fatal("transport message not delivered intact")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("transport message of current keypair not delivered")
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		endpoint, err := conn.CreateEndpoint(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buffer := device.GetMessageBuffer()
+		defer device.PutMessageBuffer(buffer)
+		binary.LittleEndian.PutUint32(buffer[:], MessageTransportType)
+		before := device.DropStats()
+		for _, segment := range []int{0, MessageTransportSize} {
+			if device.handleCoalesced(buffer, len(buffer), segment, endpoint) {
+				t.Fatal("queued datagram filling the whole buffer")
+			}
+		}
+		waitDropStats(t, device, func(s DropStats) bool {
+			return s.Truncated == before.Truncated+2 && s.UnknownIndex == before.UnknownIndex
+		})
+	})
+
+	t.Run("coalesced", func(t *testing.T) {
+		keypair := newTestKeypair(t)
+		register(keypair)
+		endpoint, err := conn.CreateEndpoint(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// datagrams of one size, then a short one as the kernel never sends
+
+		var packets [][]byte
+		buffer := device.GetMessageBuffer()
+		size, segment := 0, 0
+		for counter := uint64(0); counter < 3; counter++ {
+			packet := testIPv4Packet(remote, local, []byte{'a' + byte(counter)})
+			datagram := transport(keypair, counter, packet)
+			packets = append(packets, packet)
+			segment = len(datagram)
+			size += copy(buffer[size:], datagram)
+		}
+		size += MinMessageSize - 1
+		shorts := device.DropStats().ShortPacket
+
+		if !device.handleCoalesced(buffer, size, segment, endpoint) {
+			t.Fatal("first coalesced datagram not queued")
+		}
+		for _, packet := range packets {
+			select {
+			case received := <-tun.Inbound:
+				if !bytes.Equal(received, packet) {
+					t.Fatalf("coalesced datagrams delivered out of order or corrupted: %x", received)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("coalesced datagram not delivered")
+			}
+		}
+		waitDropStats(t, device, func(s DropStats) bool { return s.ShortPacket == shorts+1 })
+	})
+
+	t.Run("handshake", func(t *testing.T) {
+
+		// an initiation without valid mac1 is queued, then dropped
+
+		if !receiveDatagram(t, device, message(MessageInitiationType, MessageInitiationSize), src) {
+			t.Fatal("initiation not queued")
+		}
+		waitDropStats(t, device, func(s DropStats) bool { return s.MAC1FailInitiation == 1 })
+
+		// with cookies demanded, one with valid mac1 but no mac2 is dropped
+
+		if err := device.SetCookiePolicy(CookiePolicyAlways); err != nil {
+			t.Fatal(err)
+		}
+		var generator CookieGenerator
+		generator.Init(device.staticIdentity.publicKey)
+		initiation := message(MessageInitiationType, MessageInitiationSize)
+		generator.AddMacs(initiation)
+		cookieFails := device.DropStats().CookieFail
+		if !receiveDatagram(t, device, initiation, src) {
+			t.Fatal("initiation not queued")
+		}
+		waitDropStats(t, device, func(s DropStats) bool { return s.CookieFail == cookieFails+1 })
+	})
+}
+
+func TestCheckMessageSize(t *testing.T) {
+	tests := []struct {
+		msgType uint32
+		size    int
+		reason  DropReason
+		ok      bool
+	}{
+		{MessageTransportType, MessageTransportSize, DropSizeTransport, true},
+		{MessageTransportType, MaxMessageSize, DropSizeTransport, true},
+		{MessageTransportType, MessageTransportSize - 1, DropSizeTransport, false},
+		{MessageInitiationType, MessageInitiationSize, DropSizeInitiation, true},
+		{MessageInitiationType, MessageInitiationSize + 1, DropSizeInitiation, false},
+		{MessageResponseType, MessageResponseSize - 1, DropSizeResponse, false},
+		{MessageCookieReplyType, MessageCookieReplySize, DropSizeCookieReply, true},
+		{MessageCookieReplyType, MessageTransportSize, DropSizeCookieReply, false},
+		{5, MessageTransportSize, DropUnknownType, false},
+	}
+	for _, test := range tests {
+		reason, ok := checkMessageSize(test.msgType, test.size)
+		if ok != test.ok || reason != test.reason {
+			t.Errorf("type %d of size %d: got %v, %v, expected %v, %v", test.msgType, test.size, reason, ok, test.reason, test.ok)
+		}
+	}
+}
+
+func TestHandshakeQueuePolicy(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	if err := device.SetHandshakeQueuePolicy(HandshakeQueueDropOldest + 1); err == nil {
+		t.Fatal("accepted invalid handshake queue policy")
+	}
+
+	// a queue of its own, so that no handshake routine consumes it
+
+	queue := make(chan QueueHandshakeElement, 2)
+	element := func(sender byte) QueueHandshakeElement {
+		buffer := device.GetMessageBuffer()
+		buffer[4] = sender
+		return QueueHandshakeElement{msgType: MessageInitiationType, buffer: buffer, packet: buffer[:MessageInitiationSize]}
+	}
+	queued := func() (senders []byte) {
+		for len(queue) > 0 {
+			elem := <-queue
+			senders = append(senders, elem.buffer[4])
+			device.PutMessageBuffer(elem.buffer)
+		}
+		return senders
+	}
+
+	tests := []struct {
+		policy HandshakeQueuePolicy
+		queued []byte
+	}{
+		{HandshakeQueueDropNewest, []byte{1, 2}},
+		{HandshakeQueueDropOldest, []byte{2, 3}},
+	}
+	for i, test := range tests {
+		if err := device.SetHandshakeQueuePolicy(test.policy); err != nil {
+			t.Fatal(err)
+		}
+		for sender := byte(1); sender <= 3; sender++ {
+			elem := element(sender)
+			if !device.addToHandshakeQueue(queue, elem) {
+				device.PutMessageBuffer(elem.buffer)
+			}
+		}
+		if senders := queued(); !bytes.Equal(senders, test.queued) {
+			t.Errorf("policy %d: queued %v, expected %v", test.policy, senders, test.queued)
+		}
+		stats := device.DropStats()
+		if overflows := uint64(i + 1); stats.HandshakeQueueOverflow != overflows || stats.QueueOverflow != overflows {
+			t.Errorf("policy %d: unexpected drop statistics: %+v", test.policy, stats)
+		}
+	}
+}
+
+func TestUnknownIndexDropped(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	device.Up()
+	device.net.RLock()
+	port := device.net.port
+	device.net.RUnlock()
+
+	sender, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	packet := make([]byte, MessageTransportSize)
+	binary.LittleEndian.PutUint32(packet[:4], MessageTransportType)
+	binary.LittleEndian.PutUint32(packet[MessageTransportOffsetReceiver:], 0x1234)
+	if _, err := sender.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for device.DropStats().UnknownIndex != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected drop statistics: %+v", device.DropStats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDecryptFailureAlarm(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelSilent, ""))
+	defer device.Close()
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(t, device, remote)
+	keypair := newTestKeypair(t)
+	keypair.peer = peer
+
+	alarmed := make(chan *Peer, 1)
+	device.SetDecryptFailureAlarm(DecryptFailureAlarm{
+		Threshold: 4,
+		Window:    time.Minute,
+		Callback:  func(peer *Peer) { alarmed <- peer },
+	})
+
+	// packets sealed with another key fail to decrypt
+
+	keypair.send = newTestKeypair(t).send
+	packet := testIPv4Packet(remote, local, []byte("forged"))
+	for counter := uint64(0); counter < 4; counter++ {
+		queueTransportPacket(device, peer, keypair, counter, packet)
+	}
+	select {
+	case p := <-alarmed:
+		if p != peer {
+			t.Fatal("alarm raised for wrong peer")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("alarm not raised")
+	}
+	if stats := peer.Stats(); stats.DecryptFailures != 4 || !stats.DecryptFailureAlarm {
+		t.Fatalf("unexpected peer statistics: %+v", stats)
+	}
+
+	// a packet which authenticates clears the alarm
+
+	keypair.send = keypair.receive
+	queueTransportPacket(device, peer, keypair, 4, testIPv4Packet(remote, local, []byte("genuine")))
+	<-tun.Inbound
+	if peer.Stats().DecryptFailureAlarm {
+		t.Fatal("alarm not cleared by authenticated packet")
+	}
+
+	// as does one decrypted with another keypair of the peer
+
+	keypair.send = newTestKeypair(t).send
+	for counter := uint64(5); counter < 9; counter++ {
+		queueTransportPacket(device, peer, keypair, counter, packet)
+	}
+	select {
+	case <-alarmed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("alarm not raised again")
+	}
+	next := newTestKeypair(t)
+	next.peer = peer
+	queueTransportPacket(device, peer, next, 0, testIPv4Packet(remote, local, []byte("genuine")))
+	<-tun.Inbound
+	if peer.Stats().DecryptFailureAlarm {
+		t.Fatal("alarm not cleared by packet authenticated with another keypair")
+	}
+}
+
+func TestPeerCallbacks(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+	device.Up()
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(t, device, remote)
+	keypair := newTestKeypair(t)
+
+	connected := make(chan *Peer, 2)
+	disconnected := make(chan *Peer, 2)
+	peer.SetCallbacks(PeerCallbacks{
+		Connected:         func(peer *Peer) { connected <- peer },
+		Disconnected:      func(peer *Peer) { disconnected <- peer },
+		DisconnectTimeout: 100 * time.Millisecond,
+	})
+
+	wait := func(events chan *Peer, what string) {
+		t.Helper()
+		select {
+		case <-events:
+		case <-time.After(5 * time.Second):
+			t.Fatal("peer not", what)
+		}
+	}
+
+	// the first packet connects, further ones keep the peer connected
+
+	packet := testIPv4Packet(remote, local, []byte("hello"))
+	for counter := uint64(0); counter < 3; counter++ {
+		queueTransportPacket(device, peer, keypair, counter, packet)
+		<-tun.Inbound
+	}
+	wait(connected, "connected")
+	if !peer.IsConnected() || len(connected) != 0 {
+		t.Fatal("peer connected more than once")
+	}
+
+	// silence disconnects, the next packet connects again
+
+	wait(disconnected, "disconnected")
+	if peer.IsConnected() {
+		t.Fatal("peer still connected after timeout")
+	}
+	queueTransportPacket(device, peer, keypair, 3, packet)
+	<-tun.Inbound
+	wait(connected, "connected again")
+
+	// stopping the peer disconnects it
+
+	peer.Stop()
+	wait(disconnected, "disconnected when stopped")
+}
+
+func TestPeerLiveness(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelSilent, ""))
+	defer device.Close()
+	device.Up()
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(t, device, remote)
+	keypair := newTestKeypair(t)
+	peer.keypairs.Lock()
+	peer.keypairs.current = keypair
+	peer.keypairs.Unlock()
+
+	// without a timeout nothing is watched
+
+	peer.timersDataSent()
+	if peer.timers.liveness.IsPending() {
+		t.Fatal("liveness checked although disabled")
+	}
+
+	// sending data arms the check, receiving anything disarms it
+
+	peer.SetLiveness(PeerLiveness{KeepaliveTimeout: KeepaliveTimeout})
+	peer.timersDataSent()
+	if !peer.timers.liveness.IsPending() {
+		t.Fatal("sent packet did not arm liveness check")
+	}
+	queueTransportPacket(device, peer, keypair, 0, testIPv4Packet(remote, local, []byte("hello")))
+	<-tun.Inbound
+	if peer.timers.liveness.IsPending() {
+		t.Fatal("received packet did not disarm liveness check")
+	}
+	peer.timersDataSent()
+
+	// a dead peer needs a fresh handshake
+
+	expiredLiveness(peer)
+	if atomic.LoadUint64(&keypair.sendNonce) != RejectAfterMessages {
+		t.Fatal("keypair of dead peer not expired")
+	}
+
+	peer.SetLiveness(PeerLiveness{KeepaliveTimeout: KeepaliveTimeout, ClearKeypairs: true})
+	expiredLiveness(peer)
+	if peer.keypairs.Current() != nil {
+		t.Fatal("keypair of dead peer not cleared")
+	}
+
+	peer.SetLiveness(PeerLiveness{})
+	if peer.timers.liveness.IsPending() {
+		t.Fatal("liveness still checked after disabling")
+	}
+}
+
+// BenchmarkInboundPath measures decrypting a transport message and writing
+// it to the TUN device; buffers and elements are recycled once written,
+// so the allocations per message stay constant.
+func BenchmarkInboundPath(b *testing.B) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+	defer device.Close()
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(b, device, remote)
+	keypair := newTestKeypair(b)
+	packet := testIPv4Packet(remote, local, make([]byte, 1280))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		queueTransportPacket(device, peer, keypair, uint64(i), packet)
+		<-tun.Inbound
+	}
+}
+
+// BenchmarkInboundThroughput measures how many transport messages the
+// decryption workers and the sequential receiver get through, keeping
+// many in flight and writing them to a TUN device which discards them.
+func BenchmarkInboundThroughput(b *testing.B) {
+	sink := tuntest.NewSinkTUN()
+	device := NewDevice(sink, NewLogger(LogLevelError, ""))
+	defer device.Close()
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(b, device, remote)
+	keypair := newTestKeypair(b)
+	packet := testIPv4Packet(remote, local, make([]byte, 1280))
+	inFlight := uint64(QueueInboundSize / 2)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	for i := uint64(0); i < uint64(b.N); i++ {
+		for i-sink.Packets() >= inFlight {
+			runtime.Gosched()
+		}
+		queueTransportPacket(device, peer, keypair, i, packet)
+	}
+	for sink.Packets() < uint64(b.N) {
+		runtime.Gosched()
+	}
+}
+
+func TestTransientReceiveError(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("recvmsg", syscall.ECONNREFUSED)}, true},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("recvmsg", syscall.ENOBUFS)}, true},
+		{syscall.EINTR, true},
+		{syscall.EBADF, false},
+		{&net.OpError{Op: "read", Err: errors.New("use of closed network connection")}, false},
+		{errors.New("unexpected"), false},
+	}
+	for _, test := range tests {
+		if transient := isTransientReceiveError(test.err); transient != test.transient {
+			t.Errorf("%v: transient %v, expected %v", test.err, transient, test.transient)
+		}
+	}
+}
+
+// groTestBind fails reads of coalesced datagrams, like kernels without
+// recvmmsg(2), and records whether coalescing was turned off again.
+type groTestBind struct {
+	batchTestBind
+	groDisabled int32
+}
+
+func (b *groTestBind) ReceiveIPv4GRO(buffs [][]byte, sizes, segs []int, eps []conn.Endpoint) (int, error) {
+	return 0, syscall.ENOSYS
+}
+
+func (b *groTestBind) ReceiveIPv6GRO(buffs [][]byte, sizes, segs []int, eps []conn.Endpoint) (int, error) {
+	return 0, syscall.EAFNOSUPPORT
+}
+
+func (b *groTestBind) DisableGRO() error {
+	atomic.StoreInt32(&b.groDisabled, 1)
+	return nil
+}
+
+func TestReceiveGROFallback(t *testing.T) {
+	packet := make([]byte, MessageTransportSize)
+	binary.LittleEndian.PutUint32(packet[:4], MessageTransportType)
+	binary.LittleEndian.PutUint32(packet[MessageTransportOffsetReceiver:], 0x1234)
+
+	device := randDevice(t)
+	defer device.Close()
+	bind := &groTestBind{batchTestBind: batchTestBind{batches: make(chan [][]byte, 1), unsupported: true}}
+	device.net.batchSize = 4
+	device.net.starting.Add(1)
+	device.net.stopping.Add(1)
+	go device.RoutineReceiveIncoming(ipv4.Version, bind)
+	device.net.starting.Wait()
+
+	// single reads follow, which must not receive coalesced datagrams
+
+	bind.batches <- [][]byte{packet}
+	deadline := time.Now().Add(5 * time.Second)
+	for device.DropStats().UnknownIndex != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected drop statistics: %+v", device.DropStats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(bind.batches)
+	device.net.stopping.Wait()
+	if atomic.LoadInt32(&bind.groDisabled) == 0 {
+		t.Error("coalescing left on after falling back to single reads")
+	}
+}
@@ -0,0 +1,328 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+/* Outcome of Device.SelfTest
+ */
+type SelfTestResult struct {
+	Stage     string        // stage reached, the one which failed if any
+	Err       error         // why the stage failed, nil if all passed
+	Handshake time.Duration // until the first packet arrived, handshake included
+	RoundTrip time.Duration // of a packet and its reply over the established session
+}
+
+func (result SelfTestResult) Passed() bool {
+	return result.Err == nil
+}
+
+const (
+	selfTestStageSetup     = "setup"
+	selfTestStageHandshake = "handshake"
+	selfTestStageRoundTrip = "round trip"
+	selfTestStageReplay    = "replay"
+	selfTestStageDone      = "done"
+)
+
+var selfTestAddrs = [2]net.IP{net.IPv4(10, 255, 255, 1).To4(), net.IPv4(10, 255, 255, 2).To4()}
+
+/* Runs a handshake and packets both ways between two devices, with
+ * ephemeral keys and the options of this device, connected in memory
+ *
+ * This exercises the handshake, encryption and decryption workers and the
+ * sequential receivers on this build and hardware, including the padding
+ * of packets and their checksums, and checks that a replayed transport
+ * message is rejected. The device itself is left untouched.
+ */
+func (device *Device) SelfTest() SelfTestResult {
+	result := SelfTestResult{Stage: selfTestStageSetup}
+
+	options := device.given
+	options.AllowedIPs = nil // each device routes on its own
+	ends := newSelfTestEnds()
+	tuns := [2]*selfTestTUN{newSelfTestTUN(), newSelfTestTUN()}
+	var keys [2]NoisePrivateKey
+	var devices [2]*Device
+
+	for i := range devices {
+		end := ends[i]
+		options.ListenPacket = func(uint16) (net.PacketConn, error) {
+			return &selfTestConn{end: end, closed: make(chan struct{})}, nil
+		}
+		dev, err := NewDeviceWithOptions(tuns[i], NewLogger(LogLevelSilent, ""), options)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		defer dev.Close()
+		dev.SetChecksumValidation(ChecksumValidationAll)
+		devices[i] = dev
+
+		if keys[i], err = newPrivateKey(); err != nil {
+			result.Err = err
+			return result
+		}
+	}
+	for i, dev := range devices {
+		other := 1 - i
+		publicKey := keys[other].publicKey()
+		config := fmt.Sprintf("private_key=%x\npublic_key=%x\nallowed_ip=%s/32\nendpoint=%s\n",
+			keys[i][:], publicKey[:], selfTestAddrs[other], ends[other].addr)
+		if err := dev.IpcSetOperation(bufio.NewReader(strings.NewReader(config))); err != nil {
+			result.Err = err
+			return result
+		}
+		dev.Up()
+	}
+
+	// the first packet initiates the handshake
+
+	result.Stage = selfTestStageHandshake
+	start := time.Now()
+	if result.Err = selfTestTransfer(tuns, 0); result.Err != nil {
+		return result
+	}
+	result.Handshake = time.Since(start)
+
+	result.Stage = selfTestStageRoundTrip
+	start = time.Now()
+	if result.Err = selfTestTransfer(tuns, 1); result.Err != nil {
+		return result
+	}
+	if result.Err = selfTestTransfer(tuns, 0); result.Err != nil {
+		return result
+	}
+	result.RoundTrip = time.Since(start)
+
+	// the last transport message delivered again must be rejected
+
+	result.Stage = selfTestStageReplay
+	replays := devices[1].DropStats().Replay
+	if !ends[0].replayLast() {
+		result.Err = errors.New("no transport message to replay")
+		return result
+	}
+	deadline := time.Now().Add(selfTestTimeout)
+	for devices[1].DropStats().Replay == replays {
+		if time.Now().After(deadline) {
+			result.Err = errors.New("replayed transport message not rejected")
+			return result
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-tuns[1].inbound:
+		result.Err = errors.New("replayed transport message delivered")
+		return result
+	default:
+	}
+
+	result.Stage = selfTestStageDone
+	return result
+}
+
+/* Sends a packet through the devices from one side to the other,
+ * checking that it arrives intact
+ */
+func selfTestTransfer(tuns [2]*selfTestTUN, from int) error {
+	to := 1 - from
+	packet := selfTestPacket(selfTestAddrs[from], selfTestAddrs[to])
+	tuns[from].outbound <- packet
+	select {
+	case received := <-tuns[to].inbound:
+		if !bytes.Equal(received, packet) {
+			return fmt.Errorf("packet from %s corrupted in transit", selfTestAddrs[from])
+		}
+		return nil
+	case <-time.After(selfTestTimeout):
+		return fmt.Errorf("packet from %s not received", selfTestAddrs[from])
+	}
+}
+
+/* Builds a UDP packet with valid checksums, whose length is not a multiple
+ * of PaddingMultiple, so that it is padded in transit
+ */
+func selfTestPacket(src, dst net.IP) []byte {
+	payload := []byte("wireguard self-test")
+	packet := make([]byte, ipv4.HeaderLen+udpHeaderLen+len(payload))
+	packet[0] = ipv4.Version<<4 | ipv4.HeaderLen/4
+	binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(len(packet)))
+	packet[8] = 64 // time to live
+	packet[9] = udpProtocolNumber
+	copy(packet[IPv4offsetSrc:], src)
+	copy(packet[IPv4offsetDst:], dst)
+	binary.BigEndian.PutUint16(packet[10:], checksum(packet[:ipv4.HeaderLen], 0))
+
+	udp := packet[ipv4.HeaderLen:]
+	binary.BigEndian.PutUint16(udp[0:], 51820)
+	binary.BigEndian.PutUint16(udp[2:], 51820)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[udpHeaderLen:], payload)
+	sum := checksum(udp, pseudoHeaderSum(packet[IPv4offsetSrc:IPv4offsetDst+net.IPv4len], udpProtocolNumber, len(udp)))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return packet
+}
+
+/* One end of a pair of in-memory connections, delivering datagrams to
+ * the other end whatever their address
+ */
+type selfTestEnd struct {
+	addr    *net.UDPAddr
+	other   *selfTestEnd
+	inbound chan []byte
+
+	mutex sync.Mutex
+	last  []byte // last transport message sent
+}
+
+func newSelfTestEnds() [2]*selfTestEnd {
+	var ends [2]*selfTestEnd
+	for i := range ends {
+		ends[i] = &selfTestEnd{
+			addr:    &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1).To4(), Port: 1 + i},
+			inbound: make(chan []byte, QueueHandshakeSize),
+		}
+	}
+	ends[0].other, ends[1].other = ends[1], ends[0]
+	return ends
+}
+
+func (end *selfTestEnd) send(datagram []byte) {
+	if len(datagram) >= 4 && binary.LittleEndian.Uint32(datagram) == MessageTransportType {
+		end.mutex.Lock()
+		end.last = datagram
+		end.mutex.Unlock()
+	}
+	end.other.deliver(datagram)
+}
+
+func (end *selfTestEnd) deliver(datagram []byte) {
+	select {
+	case end.inbound <- datagram:
+	default: // dropped, as by a congested network
+	}
+}
+
+/* Delivers the last transport message sent once more
+ */
+func (end *selfTestEnd) replayLast() bool {
+	end.mutex.Lock()
+	last := end.last
+	end.mutex.Unlock()
+	if last == nil {
+		return false
+	}
+	end.other.deliver(last)
+	return true
+}
+
+/* A connection over an end, of which the device opens a new one whenever
+ * it (re)opens its sockets
+ */
+type selfTestConn struct {
+	end    *selfTestEnd
+	closed chan struct{}
+	close  sync.Once
+}
+
+func (pc *selfTestConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case datagram := <-pc.end.inbound:
+		return copy(b, datagram), pc.end.other.addr, nil
+	case <-pc.closed:
+		return 0, nil, errors.New("self-test conn closed")
+	}
+}
+
+func (pc *selfTestConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pc.end.send(append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (pc *selfTestConn) Close() error {
+	pc.close.Do(func() {
+		close(pc.closed)
+	})
+	return nil
+}
+
+func (pc *selfTestConn) LocalAddr() net.Addr                { return pc.end.addr }
+func (pc *selfTestConn) SetDeadline(t time.Time) error      { return nil }
+func (pc *selfTestConn) SetReadDeadline(t time.Time) error  { return nil }
+func (pc *selfTestConn) SetWriteDeadline(t time.Time) error { return nil }
+
+/* A TUN device of one side of the self-test, whose packets are exchanged
+ * over channels
+ */
+type selfTestTUN struct {
+	inbound  chan []byte // packets written by the device
+	outbound chan []byte // packets read by the device
+	events   chan tun.Event
+	closed   chan struct{}
+	close    sync.Once
+}
+
+func newSelfTestTUN() *selfTestTUN {
+	t := &selfTestTUN{
+		inbound:  make(chan []byte),
+		outbound: make(chan []byte),
+		events:   make(chan tun.Event, 1),
+		closed:   make(chan struct{}),
+	}
+	t.events <- tun.EventUp
+	return t
+}
+
+func (t *selfTestTUN) Read(data []byte, offset int) (int, error) {
+	select {
+	case packet := <-t.outbound:
+		return copy(data[offset:], packet), nil
+	case <-t.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (t *selfTestTUN) Write(data []byte, offset int) (int, error) {
+	packet := append([]byte(nil), data[offset:]...)
+	select {
+	case t.inbound <- packet:
+		return len(data) - offset, nil
+	case <-t.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (t *selfTestTUN) Close() error {
+	t.close.Do(func() {
+		close(t.closed)
+		close(t.events)
+	})
+	return nil
+}
+
+func (t *selfTestTUN) File() *os.File         { return nil }
+func (t *selfTestTUN) Flush() error           { return nil }
+func (t *selfTestTUN) MTU() (int, error)      { return DefaultMTU, nil }
+func (t *selfTestTUN) Name() (string, error)  { return "selftest", nil }
+func (t *selfTestTUN) Events() chan tun.Event { return t.events }
@@ -50,6 +50,7 @@ type QueueOutboundElement struct {
 	nonce   uint64                // nonce for encryption
 	keypair *Keypair              // keypair for encryption
 	peer    *Peer                 // related peer
+	tos     uint8                 // type of service of the outer packet (0 = default)
 }
 
 func (device *Device) NewOutboundElement() *QueueOutboundElement {
@@ -60,6 +61,7 @@ func (device *Device) NewOutboundElement() *QueueOutboundElement {
 	elem.nonce = 0
 	elem.keypair = nil
 	elem.peer = nil
+	elem.tos = 0
 	return elem
 }
 
@@ -128,15 +130,16 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 		atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
 	}
 
+	rekeyTimeout := peer.rekeyTimeout()
 	peer.handshake.mutex.RLock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if time.Since(peer.handshake.lastSentHandshake) < rekeyTimeout {
 		peer.handshake.mutex.RUnlock()
 		return nil
 	}
 	peer.handshake.mutex.RUnlock()
 
 	peer.handshake.mutex.Lock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if time.Since(peer.handshake.lastSentHandshake) < rekeyTimeout {
 		peer.handshake.mutex.Unlock()
 		return nil
 	}
@@ -207,20 +210,29 @@ func (peer *Peer) SendHandshakeResponse() error {
 
 func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement) error {
 
-	device.log.Debug.Println("Sending cookie response for denied handshake message for", initiatingElem.endpoint.DstToString())
+	if device.debugEnabled() {
+		device.limitedLogSink().Debug("Sending cookie response for denied handshake message", "src", initiatingElem.endpoint.DstToString())
+	}
 
 	sender := binary.LittleEndian.Uint32(initiatingElem.packet[4:8])
 	reply, err := device.cookieChecker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
 	if err != nil {
-		device.log.Error.Println("Failed to create cookie reply:", err)
+		device.limitedLogSink().Error("Failed to create cookie reply", "err", err)
 		return err
 	}
 
 	var buff [MessageCookieReplySize]byte
 	writer := bytes.NewBuffer(buff[:0])
 	binary.Write(writer, binary.LittleEndian, reply)
-	device.net.bind.Send(writer.Bytes(), initiatingElem.endpoint)
-	return nil
+
+	device.net.RLock()
+	defer device.net.RUnlock()
+
+	bind, err := device.unsafeSendBind(initiatingElem.endpoint)
+	if err != nil {
+		return err
+	}
+	return bind.Send(writer.Bytes(), initiatingElem.endpoint)
 }
 
 func (peer *Peer) keepKeyFreshSending() {
@@ -229,7 +241,7 @@ func (peer *Peer) keepKeyFreshSending() {
 		return
 	}
 	nonce := atomic.LoadUint64(&keypair.sendNonce)
-	if nonce > RekeyAfterMessages || (keypair.isInitiator && time.Since(keypair.created) > RekeyAfterTime) {
+	if nonce > RekeyAfterMessages || (keypair.isInitiator && peer.device.now().Sub(keypair.created) > RekeyAfterTime) {
 		peer.SendHandshakeInitiation(false)
 	}
 }
@@ -249,6 +261,9 @@ func (device *Device) RoutineReadFromTUN() {
 		device.state.stopping.Done()
 	}()
 
+	beat := device.startHeartbeat("TUN reader", nil)
+	defer device.stopHeartbeat(beat)
+
 	logDebug.Println("Routine: TUN reader - started")
 	device.state.starting.Done()
 
@@ -264,9 +279,16 @@ func (device *Device) RoutineReadFromTUN() {
 		// read packet
 
 		offset := MessageTransportHeaderSize
-		size, err := device.tun.device.Read(elem.buffer[:], offset)
+		tunDevice := device.tunDevice()
+		size, err := tunDevice.Read(elem.buffer[:], offset)
 
 		if err != nil {
+
+			// a replaced TUN device fails reads once closed, read the new one
+
+			if device.tunDevice() != tunDevice {
+				continue
+			}
 			if !device.isClosed.Get() {
 				logError.Println("Failed to read packet from TUN device:", err)
 				device.Close()
@@ -276,6 +298,7 @@ func (device *Device) RoutineReadFromTUN() {
 			return
 		}
 
+		beat.beat()
 		if size == 0 || size > MaxContentSize {
 			continue
 		}
@@ -292,6 +315,9 @@ func (device *Device) RoutineReadFromTUN() {
 			}
 			dst := elem.packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
 			peer = device.allowedips.LookupIPv4(dst)
+			if device.net.inheritDSCP.Get() {
+				elem.tos = innerDSCP(elem.packet)
+			}
 
 		case ipv6.Version:
 			if len(elem.packet) < ipv6.HeaderLen {
@@ -299,27 +325,42 @@ func (device *Device) RoutineReadFromTUN() {
 			}
 			dst := elem.packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
 			peer = device.allowedips.LookupIPv6(dst)
+			if device.net.inheritDSCP.Get() {
+				elem.tos = innerDSCP(elem.packet)
+			}
 
 		default:
 			logDebug.Println("Received packet with unknown IP version")
 		}
 
 		if peer == nil {
+			device.sendUnreachable(elem.packet)
 			continue
 		}
 
 		// insert into nonce/pre-handshake queue
 
-		if peer.isRunning.Get() {
-			if peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
-				peer.SendHandshakeInitiation(false)
-			}
-			addToNonceQueue(peer.queue.nonce, elem, device)
+		if peer.stagePacket(elem) {
 			elem = nil
 		}
 	}
 }
 
+/* Inserts a packet into the nonce/pre-handshake queue of a running peer,
+ * initiating a handshake if the queue awaits a key, and reports whether
+ * the peer took the element
+ */
+func (peer *Peer) stagePacket(elem *QueueOutboundElement) bool {
+	if !peer.isRunning.Get() {
+		return false
+	}
+	if peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
+		peer.SendHandshakeInitiation(false)
+	}
+	addToNonceQueue(peer.queue.nonce, elem, peer.device)
+	return true
+}
+
 func (peer *Peer) FlushNonceQueue() {
 	select {
 	case peer.signals.flushNonceQueue <- struct{}{}:
@@ -358,6 +399,9 @@ func (peer *Peer) RoutineNonce() {
 		peer.routines.stopping.Done()
 	}()
 
+	beat := device.startHeartbeat("nonce worker", peer)
+	defer device.stopHeartbeat(beat)
+
 	peer.routines.starting.Done()
 	logDebug.Println(peer, "- Routine: nonce worker - started")
 
@@ -378,17 +422,23 @@ func (peer *Peer) RoutineNonce() {
 			if !ok {
 				return
 			}
+			beat.beat()
 
 			// make sure to always pick the newest key
 
+			var nonce uint64
 			for {
 
-				// check validity of newest key pair
+				// check validity of newest key pair, the packet waits for
+				// a new one if this one runs out of nonces once picked
 
 				keypair = peer.keypairs.Current()
-				if keypair != nil && keypair.sendNonce < RejectAfterMessages {
-					if time.Since(keypair.created) < RejectAfterTime {
-						break
+				if keypair != nil && !keypair.isExhausted() {
+					if device.now().Sub(keypair.created) < RejectAfterTime {
+						if nonce, ok = keypair.nextSendNonce(); ok {
+							break
+						}
+						logDebug.Println(peer, "- Keypair exhausted, rekeying")
 					}
 				}
 				peer.queue.packetInNonceQueueIsAwaitingKey.Set(true)
@@ -427,16 +477,7 @@ func (peer *Peer) RoutineNonce() {
 			// populate work element
 
 			elem.peer = peer
-			elem.nonce = atomic.AddUint64(&keypair.sendNonce, 1) - 1
-
-			// double check in case of race condition added by future code
-
-			if elem.nonce >= RejectAfterMessages {
-				atomic.StoreUint64(&keypair.sendNonce, RejectAfterMessages)
-				device.PutMessageBuffer(elem.buffer)
-				device.PutOutboundElement(elem)
-				goto NextPacket
-			}
+			elem.nonce = nonce
 
 			elem.keypair = keypair
 			elem.dropped = AtomicFalse
@@ -492,6 +533,9 @@ func (device *Device) RoutineEncryption() {
 		device.state.stopping.Done()
 	}()
 
+	beat := device.startHeartbeat("encryption worker", nil)
+	defer device.stopHeartbeat(beat)
+
 	logDebug.Println("Routine: encryption worker - started")
 	device.state.starting.Done()
 
@@ -508,6 +552,7 @@ func (device *Device) RoutineEncryption() {
 			if !ok {
 				return
 			}
+			beat.beat()
 
 			// check if dropped
 
@@ -580,6 +625,9 @@ func (peer *Peer) RoutineSequentialSender() {
 		peer.routines.stopping.Done()
 	}()
 
+	beat := device.startHeartbeat("sequential sender", peer)
+	defer device.stopHeartbeat(beat)
+
 	logDebug.Println(peer, "- Routine: sequential sender - started")
 
 	peer.routines.starting.Done()
@@ -595,6 +643,7 @@ func (peer *Peer) RoutineSequentialSender() {
 			if !ok {
 				return
 			}
+			beat.beat()
 
 			elem.Lock()
 			if elem.IsDropped() {
@@ -607,7 +656,7 @@ func (peer *Peer) RoutineSequentialSender() {
 
 			// send message and return buffer to pool
 
-			err := peer.SendBuffer(elem.packet)
+			err := peer.sendBuffer(elem.packet, elem.tos)
 			if len(elem.packet) != MessageKeepaliveSize {
 				peer.timersDataSent()
 			}
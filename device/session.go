@@ -0,0 +1,241 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Live state of a keypair, see SessionState
+ */
+type KeypairState struct {
+	SendKey        [chacha20poly1305.KeySize]byte
+	ReceiveKey     [chacha20poly1305.KeySize]byte
+	SendCounter    uint64 // next counter to send with, past all counters handed out
+	ReceiveCounter uint64 // latest counter received, if Received
+	Received       bool   // whether a message was received with the keypair
+	IsInitiator    bool
+	Created        time.Time
+	LocalIndex     uint32
+	RemoteIndex    uint32
+}
+
+/* Live session of a peer, which a standby device can continue after the
+ * device it was exported from failed, without a new handshake
+ *
+ * The state holds the keys of the session in the clear: whoever obtains it
+ * can decrypt the traffic of the peer and impersonate either side until
+ * the keypairs expire, at most RejectAfterTime after they were created.
+ * Keep it in memory or on an authenticated and encrypted channel between
+ * primary and standby only, never write it to disk unencrypted, and
+ * discard it once the keypairs expired.
+ */
+type SessionState struct {
+	PublicKey NoisePublicKey
+	Endpoint  string        // as set over UAPI, empty if unknown
+	Current   *KeypairState // nil if absent
+	Previous  *KeypairState
+	Next      *KeypairState // derived as responder, not yet confirmed by the initiator
+}
+
+/* Exports the sessions of all peers which have any keypair, see
+ * ImportSessions
+ *
+ * Each peer is exported at one instant, while packets keep flowing:
+ * counters handed out for sending or validated when receiving by then are
+ * accounted for, but those of later packets are not. A standby importing
+ * an export of a primary which still ran must skip past them, see
+ * ImportSessions.
+ */
+func (device *Device) ExportSessions() []SessionState {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	var sessions []SessionState
+	for _, peer := range device.peers.keyMap {
+		if session, ok := peer.exportSession(); ok {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+func (peer *Peer) exportSession() (SessionState, bool) {
+	session := SessionState{PublicKey: peer.handshake.remoteStatic}
+
+	peer.keypairs.RLock()
+	session.Current = peer.keypairs.current.export()
+	session.Previous = peer.keypairs.previous.export()
+	session.Next = peer.keypairs.loadNext().export()
+	peer.keypairs.RUnlock()
+	if session.Current == nil && session.Next == nil {
+		return session, false
+	}
+
+	peer.RLock()
+	if peer.endpoint != nil {
+		session.Endpoint = peer.endpoint.DstToString()
+	}
+	peer.RUnlock()
+	return session, true
+}
+
+func (keypair *Keypair) export() *KeypairState {
+	if keypair == nil {
+		return nil
+	}
+
+	// the send counter past all nonces reserved, sent or not, so that
+	// none is ever reused
+
+	sendCounter := atomic.LoadUint64(&keypair.sendNonce)
+	if sendCounter > RejectAfterMessages {
+		sendCounter = RejectAfterMessages
+	}
+	return &KeypairState{
+		SendKey:        keypair.sendKey,
+		ReceiveKey:     keypair.receiveKey,
+		SendCounter:    sendCounter,
+		ReceiveCounter: keypair.replayFilter.Latest(),
+		Received:       keypair.decrypted.Get(),
+		IsInitiator:    keypair.isInitiator,
+		Created:        keypair.created,
+		LocalIndex:     keypair.localIndex,
+		RemoteIndex:    keypair.remoteIndex,
+	}
+}
+
+/* Continues the sessions exported from another device, replacing the
+ * keypairs of the peers; all peers must be configured, with the private
+ * key of the other device
+ *
+ * The counters of the sessions are advanced by skip before they are
+ * continued, which must exceed the number of packets the other device may
+ * have sent or received on a keypair since the export. Otherwise nonces it
+ * sent are reused, which breaks the encryption, and packets it received
+ * may be accepted again. Zero suffices if it was brought down or closed
+ * before the export. Received packets with counters skipped are dropped
+ * as replays.
+ *
+ * Nothing is imported if any session cannot be, as its peer is unknown,
+ * its endpoint invalid, or an index already taken on this device.
+ */
+func (device *Device) ImportSessions(sessions []SessionState, skip uint64) error {
+	device.peers.Lock()
+	defer device.peers.Unlock()
+
+	// validate all sessions before changing any state
+
+	peers := make([]*Peer, len(sessions))
+	endpoints := make([]conn.Endpoint, len(sessions))
+	for i, session := range sessions {
+		peer, ok := device.peers.keyMap[session.PublicKey]
+		if !ok {
+			return fmt.Errorf("session of unknown peer: %x", session.PublicKey[:])
+		}
+		peers[i] = peer
+		if session.Endpoint != "" {
+			create := conn.CreateEndpoint
+			if strings.HasPrefix(session.Endpoint, conn.TCPEndpointPrefix) {
+				create = conn.CreateTCPEndpoint
+			}
+			endpoint, err := create(session.Endpoint)
+			if err != nil {
+				return fmt.Errorf("invalid endpoint of %v: %w", peer, err)
+			}
+			endpoints[i] = endpoint
+		}
+	}
+
+	// register indices, which is what may fail, before swapping anything in
+
+	imported := make([][3]*Keypair, len(sessions))
+	for i, session := range sessions {
+		states := [3]*KeypairState{session.Current, session.Previous, session.Next}
+		for j, state := range states {
+			if state == nil {
+				continue
+			}
+			keypair := device.newImportedKeypair(peers[i], state, skip)
+			if !device.indexTable.InsertKeypair(keypair.localIndex, peers[i], keypair) {
+				for _, keypairs := range imported {
+					for _, keypair := range keypairs {
+						device.DeleteKeypair(keypair)
+					}
+				}
+				return errors.New("index of imported keypair already in use")
+			}
+			imported[i][j] = keypair
+		}
+	}
+
+	for i, peer := range peers {
+		keypairs := &peer.keypairs
+		keypairs.Lock()
+		device.DeleteKeypair(keypairs.current)
+		device.DeleteKeypair(keypairs.previous)
+		device.DeleteKeypair(keypairs.loadNext())
+		keypairs.current = imported[i][0]
+		keypairs.previous = imported[i][1]
+		keypairs.storeNext(imported[i][2])
+		keypairs.Unlock()
+
+		if endpoints[i] != nil {
+			peer.Lock()
+			peer.endpoint = endpoints[i]
+			peer.Unlock()
+			peer.clearEndpointHost()
+		}
+
+		// packets waiting for a key are sent with the imported one
+
+		peer.timersSessionDerived()
+		select {
+		case peer.signals.newKeypairArrived <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (device *Device) newImportedKeypair(peer *Peer, state *KeypairState, skip uint64) *Keypair {
+	keypair := new(Keypair)
+	keypair.send, _ = chacha20poly1305.New(state.SendKey[:])
+	keypair.receive, _ = chacha20poly1305.New(state.ReceiveKey[:])
+	keypair.sendKey = state.SendKey
+	keypair.receiveKey = state.ReceiveKey
+
+	// counters skipped beyond RejectAfterMessages leave the keypair exhausted
+
+	advance := func(counter uint64) uint64 {
+		if skip >= RejectAfterMessages || counter >= RejectAfterMessages-skip {
+			return RejectAfterMessages
+		}
+		return counter + skip
+	}
+	keypair.sendNonce = advance(state.SendCounter)
+	keypair.replayFilter.InitWindow(uint64(device.options.ReplayWindowSize))
+	if state.Received {
+		keypair.replayFilter.Restore(advance(state.ReceiveCounter))
+		keypair.decrypted.Set(true)
+	} else if skip > 0 {
+		keypair.replayFilter.Restore(advance(0) - 1)
+	}
+
+	keypair.isInitiator = state.IsInitiator
+	keypair.created = state.Created
+	keypair.localIndex = state.LocalIndex
+	keypair.remoteIndex = state.RemoteIndex
+	keypair.peer = peer
+	return keypair
+}
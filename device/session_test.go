@@ -0,0 +1,130 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestExportImportSessions(t *testing.T) {
+	var network sync.Map
+	sk1, _ := newPrivateKey()
+	sk2, _ := newPrivateKey()
+	pk1, pk2 := sk1.publicKey(), sk2.publicKey()
+	cfg1 := fmt.Sprintf("private_key=%x\npublic_key=%x\nallowed_ip=1.0.0.2/32\n", sk1[:], pk2[:])
+	cfg2 := fmt.Sprintf("private_key=%x\npublic_key=%x\nallowed_ip=1.0.0.1/32\nendpoint=127.0.0.1:1001\n", sk2[:], pk1[:])
+
+	newDevice := func(tun *tuntest.ChannelTUN, port uint16, config string) *Device {
+		dev, err := NewDeviceWithOptions(tun.TUN(), NewLogger(LogLevelError, ""), DeviceOptions{
+			ListenPacket: func(uint16) (net.PacketConn, error) {
+				return newTestPacketConn(&network, port), nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dev.Up()
+		if err := dev.IpcSetOperation(bufio.NewReader(strings.NewReader(config))); err != nil {
+			t.Fatal(err)
+		}
+		return dev
+	}
+	ping := func(from, to *tuntest.ChannelTUN, dst, src string) {
+		msg := tuntest.Ping(net.ParseIP(dst), net.ParseIP(src))
+		from.Outbound <- msg
+		select {
+		case msgRecv := <-to.Inbound:
+			if !bytes.Equal(msg, msgRecv) {
+				t.Fatalf("ping to %s did not transit correctly", dst)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ping to %s did not transit", dst)
+		}
+	}
+
+	tuns := []*tuntest.ChannelTUN{tuntest.NewChannelTUN(), tuntest.NewChannelTUN(), tuntest.NewChannelTUN()}
+	primary := newDevice(tuns[0], 1001, cfg1)
+	defer primary.Close()
+	other := newDevice(tuns[1], 1002, cfg2)
+	defer other.Close()
+	ping(tuns[1], tuns[0], "1.0.0.1", "1.0.0.2")
+	ping(tuns[0], tuns[1], "1.0.0.2", "1.0.0.1")
+
+	sessions := primary.ExportSessions()
+	if len(sessions) != 1 || sessions[0].PublicKey != pk2 || sessions[0].Current == nil || sessions[0].Endpoint != "127.0.0.1:1002" {
+		t.Fatalf("unexpected sessions exported: %+v", sessions)
+	}
+
+	// the standby takes over the port of the primary and continues its
+	// session both ways, without a handshake
+
+	primary.Close()
+	standby := newDevice(tuns[2], 1001, cfg1)
+	defer standby.Close()
+	if err := standby.ImportSessions(sessions, 0); err != nil {
+		t.Fatal(err)
+	}
+	ping(tuns[1], tuns[2], "1.0.0.1", "1.0.0.2")
+	ping(tuns[2], tuns[1], "1.0.0.2", "1.0.0.1")
+	if handshakes := standby.LookupPeer(pk2).Stats().HandshakesCompleted; handshakes != 0 {
+		t.Fatalf("standby completed %d handshakes", handshakes)
+	}
+	if handshakes := other.LookupPeer(pk1).Stats().HandshakesCompleted; handshakes != 1 {
+		t.Fatalf("peer completed %d handshakes, expected 1", handshakes)
+	}
+
+	// an import changes nothing if any session cannot be imported
+
+	current := standby.LookupPeer(pk2).keypairs.Current()
+	if err := standby.ImportSessions(sessions, 0); err == nil {
+		t.Fatal("imported a session whose indices are in use")
+	}
+	sessions[0].PublicKey = pk1
+	if err := standby.ImportSessions(sessions, 0); err == nil {
+		t.Fatal("imported a session of an unknown peer")
+	}
+	if standby.LookupPeer(pk2).keypairs.Current() != current {
+		t.Fatal("failed import replaced keypairs")
+	}
+}
+
+func TestImportSessionsSkip(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := newTestPeer(t, device, net.IPv4(1, 0, 0, 2))
+
+	state := KeypairState{SendCounter: 10, ReceiveCounter: 20, Received: true, Created: time.Now(), LocalIndex: 1}
+	session := SessionState{PublicKey: peer.handshake.remoteStatic, Current: &state}
+	if err := device.ImportSessions([]SessionState{session}, 100); err != nil {
+		t.Fatal(err)
+	}
+	keypair := peer.keypairs.Current()
+	if nonce, ok := keypair.nextSendNonce(); !ok || nonce != 110 {
+		t.Fatalf("sending continues at %d, expected 110", nonce)
+	}
+	if keypair.replayFilter.ValidateCounter(120, RejectAfterMessages) || !keypair.replayFilter.ValidateCounter(121, RejectAfterMessages) {
+		t.Fatal("receiving does not continue past the skipped counters")
+	}
+
+	// skipping past the last counter leaves the keypair exhausted
+
+	state.LocalIndex = 2
+	if err := device.ImportSessions([]SessionState{session}, RejectAfterMessages); err != nil {
+		t.Fatal(err)
+	}
+	if !peer.keypairs.Current().isExhausted() {
+		t.Fatal("keypair skipped past its last counter not exhausted")
+	}
+}
@@ -0,0 +1,419 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+/* Snapshot of the statistics of a peer
+ */
+type PeerStats struct {
+	TxBytes       uint64
+	RxBytes       uint64
+	RxKeepalives  uint64    // keepalives are counted in RxBytes, but not written to the TUN device
+	LastHandshake time.Time // zero if no handshake has completed
+	LastReceive   time.Time // last authenticated packet, including keepalives
+
+	HandshakesCompleted uint64
+	HandshakesFailed    uint64 // rejected handshake messages which identified the peer
+	HandshakesThrottled uint64 // initiations dropped within HandshakeInitationRate of the last
+
+	DecryptFailures     uint64 // transport messages which failed authentication
+	DecryptFailureAlarm bool   // the current keypair keeps failing, see DecryptFailureAlarm
+
+	Keypair *KeypairInfo // current keypair, nil if there is none
+
+	// round trip of the last handshake initiated by this side, from the
+	// last initiation sent to its response, and its moving average; zero
+	// until a handshake completed
+
+	HandshakeLatency    time.Duration
+	HandshakeLatencyAvg time.Duration
+
+	RoamsSuppressed uint64 // endpoint changes held back, see Device.SetRoamingHoldTime
+}
+
+/* Snapshot of the lifetime of a keypair
+ *
+ * Once Lifetime is zero, messages of the keypair are rejected, so traffic
+ * stops unless a handshake replaced it in time; the initiator of the
+ * keypair rekeys after RekeyAfterTime, any side on demand after that.
+ */
+type KeypairInfo struct {
+	Age          time.Duration // time since the handshake which derived it
+	Lifetime     time.Duration // time left until RejectAfterTime, zero once past
+	MessagesLeft uint64        // messages left to send until RejectAfterMessages
+	IsInitiator  bool          // derived by a handshake this side initiated
+}
+
+func (keypair *Keypair) info(now time.Time) *KeypairInfo {
+	if keypair == nil {
+		return nil
+	}
+	info := &KeypairInfo{
+		Age:         now.Sub(keypair.created),
+		IsInitiator: keypair.isInitiator,
+	}
+	if info.Age < RejectAfterTime {
+		info.Lifetime = RejectAfterTime - info.Age
+	}
+	if sent := atomic.LoadUint64(&keypair.sendNonce); sent < RejectAfterMessages {
+		info.MessagesLeft = RejectAfterMessages - sent
+	}
+	return info
+}
+
+func nanoTime(nano int64) time.Time {
+	if nano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nano)
+}
+
+/* Records the latency of a handshake initiated by this side, the first
+ * one seeding the moving average
+ */
+func (peer *Peer) observeHandshakeLatency(latency time.Duration) {
+	atomic.StoreInt64(&peer.stats.handshakeRTTNano, int64(latency))
+	for {
+		old := atomic.LoadInt64(&peer.stats.handshakeRTTAvgNano)
+		avg := int64(latency)
+		if old != 0 {
+			avg = old + int64(float64(int64(latency)-old)*rateAverageWeight)
+		}
+		if atomic.CompareAndSwapInt64(&peer.stats.handshakeRTTAvgNano, old, avg) {
+			return
+		}
+	}
+}
+
+func (peer *Peer) Stats() PeerStats {
+	return PeerStats{
+		TxBytes:       atomic.LoadUint64(&peer.stats.txBytes),
+		RxBytes:       atomic.LoadUint64(&peer.stats.rxBytes),
+		RxKeepalives:  atomic.LoadUint64(&peer.stats.rxKeepalives),
+		LastHandshake: nanoTime(atomic.LoadInt64(&peer.stats.lastHandshakeNano)),
+		LastReceive:   nanoTime(atomic.LoadInt64(&peer.stats.lastReceiveNano)),
+
+		HandshakesCompleted: atomic.LoadUint64(&peer.stats.handshakesCompleted),
+		HandshakesFailed:    atomic.LoadUint64(&peer.stats.handshakesFailed),
+		HandshakesThrottled: atomic.LoadUint64(&peer.stats.handshakesThrottled),
+
+		DecryptFailures:     atomic.LoadUint64(&peer.stats.decryptFailures),
+		DecryptFailureAlarm: peer.stats.decryptAlarm.Get(),
+
+		Keypair: peer.keypairs.Current().info(peer.device.now()),
+
+		HandshakeLatency:    time.Duration(atomic.LoadInt64(&peer.stats.handshakeRTTNano)),
+		HandshakeLatencyAvg: time.Duration(atomic.LoadInt64(&peer.stats.handshakeRTTAvgNano)),
+
+		RoamsSuppressed: atomic.LoadUint64(&peer.stats.roamsSuppressed),
+	}
+}
+
+/* Snapshot of the configuration and state of a peer, see Device.Peers
+ */
+type PeerInfo struct {
+	PublicKey           NoisePublicKey
+	Endpoint            string // empty if unknown
+	LastHandshake       time.Time
+	RxBytes             uint64
+	TxBytes             uint64
+	PersistentKeepalive time.Duration // zero if disabled
+	Connected           bool
+	ActiveSession       bool // see Peer.HasActiveSession
+}
+
+/* Returns a snapshot of every peer, ordered by public key
+ *
+ * Each peer is locked while read, so its endpoint is not torn by roaming
+ * or reconfiguration.
+ */
+func (device *Device) Peers() []PeerInfo {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	peers := make([]PeerInfo, 0, len(device.peers.keyMap))
+	for key, peer := range device.peers.keyMap {
+		info := PeerInfo{
+			PublicKey:           key,
+			LastHandshake:       nanoTime(atomic.LoadInt64(&peer.stats.lastHandshakeNano)),
+			RxBytes:             atomic.LoadUint64(&peer.stats.rxBytes),
+			TxBytes:             atomic.LoadUint64(&peer.stats.txBytes),
+			PersistentKeepalive: time.Duration(peer.PersistentKeepaliveInterval()) * time.Second,
+			Connected:           peer.IsConnected(),
+			ActiveSession:       peer.HasActiveSession(),
+		}
+		peer.RLock()
+		if peer.endpoint != nil {
+			info.Endpoint = peer.endpoint.DstToString()
+		}
+		peer.RUnlock()
+		peers = append(peers, info)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return bytes.Compare(peers[i].PublicKey[:], peers[j].PublicKey[:]) < 0
+	})
+	return peers
+}
+
+/* Raises an alarm for a peer when transport messages for one of its
+ * keypairs keep failing authentication, which usually means the keys are
+ * out of sync or someone is forging packets
+ *
+ * The alarm is raised when Threshold consecutive failures occur within
+ * Window, and cleared by the next message which authenticates. Callback,
+ * if set, is called from a decryption worker and must not block.
+ */
+type DecryptFailureAlarm struct {
+	Threshold uint64 // zero disables the alarm
+	Window    time.Duration
+	Callback  func(peer *Peer)
+}
+
+func (device *Device) DecryptFailureAlarm() DecryptFailureAlarm {
+	return device.alarm.Load().(DecryptFailureAlarm)
+}
+
+func (device *Device) SetDecryptFailureAlarm(alarm DecryptFailureAlarm) {
+	device.alarm.Store(alarm)
+}
+
+func (device *Device) decryptFailed(keypair *Keypair) {
+	peer := keypair.peer
+	if peer == nil {
+		return
+	}
+	atomic.AddUint64(&peer.stats.decryptFailures, 1)
+
+	// count consecutive failures, restarting once outside the window
+
+	alarm := device.DecryptFailureAlarm()
+	now := time.Now().UnixNano()
+	failures := atomic.AddUint64(&keypair.failures, 1)
+	if failures == 1 {
+		atomic.StoreInt64(&keypair.failuresNano, now)
+	} else if now-atomic.LoadInt64(&keypair.failuresNano) > int64(alarm.Window) {
+		atomic.StoreUint64(&keypair.failures, 1)
+		atomic.StoreInt64(&keypair.failuresNano, now)
+		return
+	}
+
+	if alarm.Threshold == 0 || failures != alarm.Threshold {
+		return
+	}
+	peer.stats.decryptAlarm.Set(true)
+	device.log.Error.Println(peer, "- Failed to decrypt", failures, "consecutive packets")
+	if alarm.Callback != nil {
+		alarm.Callback(peer)
+	}
+}
+
+func (device *Device) decryptSucceeded(keypair *Keypair) {
+	if !keypair.decrypted.Get() {
+		keypair.decrypted.Set(true)
+	}
+	if atomic.LoadUint64(&keypair.failures) != 0 {
+		atomic.StoreUint64(&keypair.failures, 0)
+	}
+
+	// the alarm of the peer clears with any keypair decrypting again
+
+	if peer := keypair.peer; peer != nil && peer.stats.decryptAlarm.Get() {
+		peer.stats.decryptAlarm.Set(false)
+	}
+}
+
+/* Snapshot of the statistics of a device
+ */
+type DeviceStats struct {
+	RxOversized   uint64 // decrypted packets dropped for exceeding the MTU
+	EventsDropped uint64 // handshake events dropped, as the consumer fell behind
+
+	TUNWriteExhausted uint64 // packets dropped as the TUN device stayed busy through all retries
+	TUNWriteFailed    uint64 // packets dropped as writing to the TUN device failed otherwise
+
+	// datagrams the kernel dropped before they were received, as the
+	// socket receive buffers were full, where the bind reports them;
+	// unlike the drops of DropStats these never reach the device
+
+	KernelDrops uint64
+
+	IndicesReaped uint64 // indices of keypairs past RejectAfterTime deleted by the sweeper
+
+	// cookie replies received, rejected ones being undecodable, for an
+	// unknown receiver index, or failing to decrypt; a burst of those
+	// suggests spoofed replies
+
+	CookieRepliesAccepted uint64
+	CookieRepliesRejected uint64
+
+	Forwarded uint64 // decrypted packets forwarded to another peer in transit mode
+}
+
+func (device *Device) Stats() DeviceStats {
+	device.net.RLock()
+	kernelDrops := atomic.LoadUint64(&device.stats.kernelDrops) + device.unsafeKernelDrops()
+	device.net.RUnlock()
+
+	return DeviceStats{
+		RxOversized:   atomic.LoadUint64(&device.stats.rxOversized),
+		EventsDropped: atomic.LoadUint64(&device.stats.eventsDropped),
+
+		TUNWriteExhausted: atomic.LoadUint64(&device.stats.tunWriteExhausted),
+		TUNWriteFailed:    atomic.LoadUint64(&device.stats.tunWriteFailed),
+
+		KernelDrops: kernelDrops,
+
+		IndicesReaped: atomic.LoadUint64(&device.stats.indicesReaped),
+
+		CookieRepliesAccepted: atomic.LoadUint64(&device.stats.cookiesAccepted),
+		CookieRepliesRejected: atomic.LoadUint64(&device.stats.cookiesRejected),
+
+		Forwarded: atomic.LoadUint64(&device.stats.forwarded),
+	}
+}
+
+/* Reasons for which received packets are dropped, see Metrics
+ */
+type DropReason int
+
+const (
+	DropQueueOverflow          DropReason = iota // a handshake, decryption or inbound queue was full
+	DropDecryptFail                              // transport message failed authentication
+	DropReplay                                   // counter already seen, behind the window or past the limit
+	DropMAC1FailInitiation                       // initiation with an invalid mac1
+	DropMAC1FailResponse                         // response with an invalid mac1
+	DropCookieFail                               // missing or invalid cookie under load, or invalid cookie reply
+	DropUnknownType                              // message of unknown type
+	DropShortPacket                              // message too short to have a type
+	DropSizeTransport                            // transport message shorter than an empty one
+	DropSizeInitiation                           // initiation of the wrong size
+	DropSizeResponse                             // response of the wrong size
+	DropSizeCookieReply                          // cookie reply of the wrong size
+	DropMalformed                                // decrypted packet with an invalid IP header
+	DropChecksum                                 // decrypted packet with an invalid checksum, if validated
+	DropUnknownIndex                             // transport message for a receiver index without keypair
+	DropHandshakeQueueOverflow                   // handshake queue was full, see HandshakeQueuePolicy
+	DropTruncated                                // datagram filling the whole receive buffer
+	DropEndpointMismatch                         // packet of a pinned peer from another endpoint
+	dropReasonCount
+)
+
+var dropReasonNames = [dropReasonCount]string{
+	DropQueueOverflow:      "queue_overflow",
+	DropDecryptFail:        "decrypt_fail",
+	DropReplay:             "replay",
+	DropMAC1FailInitiation: "mac1_fail_initiation",
+	DropMAC1FailResponse:   "mac1_fail_response",
+	DropCookieFail:         "cookie_fail",
+	DropUnknownType:        "unknown_type",
+	DropShortPacket:        "short_packet",
+	DropSizeTransport:      "size_transport",
+	DropSizeInitiation:     "size_initiation",
+	DropSizeResponse:       "size_response",
+	DropSizeCookieReply:    "size_cookie_reply",
+	DropMalformed:          "malformed",
+	DropChecksum:           "checksum",
+	DropUnknownIndex:       "unknown_index",
+
+	DropHandshakeQueueOverflow: "handshake_queue_overflow",
+	DropTruncated:              "truncated",
+	DropEndpointMismatch:       "endpoint_mismatch",
+}
+
+/* Returns a stable name for the reason, suitable as a metric label
+ */
+func (reason DropReason) String() string {
+	if reason < 0 || reason >= dropReasonCount {
+		return "unknown"
+	}
+	return dropReasonNames[reason]
+}
+
+func (device *Device) countDrop(reason DropReason) {
+	atomic.AddUint64(&device.stats.drops[reason], 1)
+	device.metrics().IncDrop(reason)
+}
+
+/* Snapshot of the number of received packets dropped, by reason
+ */
+type DropStats struct {
+	QueueOverflow uint64 // a handshake, decryption or inbound queue was full
+	DecryptFail   uint64 // transport message failed authentication
+	Replay        uint64 // counter already seen, behind the window or past the limit
+	MAC1Fail      uint64 // handshake message with an invalid mac1, of either type
+	CookieFail    uint64 // missing or invalid cookie under load, or invalid cookie reply
+	UnknownType   uint64 // message of unknown type
+	ShortPacket   uint64 // message too short, or of the wrong size for its type
+	Malformed     uint64 // decrypted packet with an invalid IP header
+	Checksum      uint64 // decrypted packet with an invalid checksum, if validated
+	UnknownIndex  uint64 // transport message for a receiver index without keypair
+
+	// invalid mac1 by message type, usually someone probing the port
+	// without knowing our public key
+
+	MAC1FailInitiation uint64
+	MAC1FailResponse   uint64
+
+	// wrong sizes by message type, also counted in ShortPacket, which
+	// additionally counts messages too short to have a type
+
+	SizeTransport   uint64 // shorter than an empty transport message
+	SizeInitiation  uint64
+	SizeResponse    uint64
+	SizeCookieReply uint64
+
+	// handshake messages dropped as the handshake queue was full, also
+	// counted in QueueOverflow, see HandshakeQueuePolicy
+
+	HandshakeQueueOverflow uint64
+
+	// datagrams filling the whole receive buffer, which were likely cut
+	// short by the read, so are not parsed at all
+
+	Truncated uint64
+
+	// authenticated packets of a peer with a pinned endpoint from
+	// elsewhere, see Peer.SetEndpointPinned
+
+	EndpointMismatch uint64
+}
+
+func (device *Device) DropStats() DropStats {
+	load := func(reason DropReason) uint64 {
+		return atomic.LoadUint64(&device.stats.drops[reason])
+	}
+	return DropStats{
+		QueueOverflow: load(DropQueueOverflow) + load(DropHandshakeQueueOverflow),
+		DecryptFail:   load(DropDecryptFail),
+		Replay:        load(DropReplay),
+		MAC1Fail:      load(DropMAC1FailInitiation) + load(DropMAC1FailResponse),
+		CookieFail:    load(DropCookieFail),
+		UnknownType:   load(DropUnknownType),
+		ShortPacket:   load(DropShortPacket) + load(DropSizeTransport) + load(DropSizeInitiation) + load(DropSizeResponse) + load(DropSizeCookieReply),
+		Malformed:     load(DropMalformed),
+		Checksum:      load(DropChecksum),
+		UnknownIndex:  load(DropUnknownIndex),
+
+		MAC1FailInitiation: load(DropMAC1FailInitiation),
+		MAC1FailResponse:   load(DropMAC1FailResponse),
+
+		SizeTransport:   load(DropSizeTransport),
+		SizeInitiation:  load(DropSizeInitiation),
+		SizeResponse:    load(DropSizeResponse),
+		SizeCookieReply: load(DropSizeCookieReply),
+
+		HandshakeQueueOverflow: load(DropHandshakeQueueOverflow),
+
+		Truncated:        load(DropTruncated),
+		EndpointMismatch: load(DropEndpointMismatch),
+	}
+}
@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+/* Activity of a running routine, updated at the top of its loop
+ */
+type heartbeat struct {
+	lastNano int64 // accessed atomically
+	name     string
+	peer     *Peer // nil for routines of the device
+}
+
+func (beat *heartbeat) beat() {
+	atomic.StoreInt64(&beat.lastNano, time.Now().UnixNano())
+}
+
+/* Registers a routine as running until stopHeartbeat, returning the
+ * heartbeat it must update whenever it starts on more work
+ */
+func (device *Device) startHeartbeat(name string, peer *Peer) *heartbeat {
+	beat := &heartbeat{name: name, peer: peer}
+	beat.beat()
+	device.heartbeats.Lock()
+	if device.heartbeats.running == nil {
+		device.heartbeats.running = make(map[*heartbeat]struct{})
+	}
+	device.heartbeats.running[beat] = struct{}{}
+	device.heartbeats.Unlock()
+	return beat
+}
+
+func (device *Device) stopHeartbeat(beat *heartbeat) {
+	device.heartbeats.Lock()
+	delete(device.heartbeats.running, beat)
+	device.heartbeats.Unlock()
+}
+
+/* A running routine, see Device.Status
+ */
+type RoutineStatus struct {
+	Name         string
+	Peer         string    // empty for routines of the device
+	LastActivity time.Time // when it last started on an element or event
+}
+
+/* Snapshot of the routines running and the depth of the queues between
+ * them, to diagnose a stalled pipeline
+ *
+ * Routines waiting for work do not update their activity, so a routine
+ * long inactive is only suspicious while the queue it reads fills up.
+ */
+type DeviceStatus struct {
+	Routines []RoutineStatus // ordered by name, then peer
+
+	HandshakeQueue  int
+	DecryptionQueue int
+	EncryptionQueue int
+	InboundQueues   map[NoisePublicKey]int // of each peer, read by its sequential receiver
+	TUNWriterQueues []int                  // empty unless writing to the TUN device in parallel
+}
+
+func (device *Device) Status() DeviceStatus {
+	status := DeviceStatus{
+		HandshakeQueue:  len(device.queue.handshake),
+		DecryptionQueue: len(device.queue.decryption),
+		EncryptionQueue: len(device.queue.encryption),
+	}
+	for _, queue := range device.queue.tunWriters {
+		status.TUNWriterQueues = append(status.TUNWriterQueues, len(queue))
+	}
+
+	device.peers.RLock()
+	status.InboundQueues = make(map[NoisePublicKey]int, len(device.peers.keyMap))
+	for key, peer := range device.peers.keyMap {
+		status.InboundQueues[key] = len(peer.queue.inbound)
+	}
+	device.peers.RUnlock()
+
+	device.heartbeats.Lock()
+	for beat := range device.heartbeats.running {
+		routine := RoutineStatus{
+			Name:         beat.name,
+			LastActivity: time.Unix(0, atomic.LoadInt64(&beat.lastNano)),
+		}
+		if beat.peer != nil {
+			routine.Peer = beat.peer.String()
+		}
+		status.Routines = append(status.Routines, routine)
+	}
+	device.heartbeats.Unlock()
+
+	sort.Slice(status.Routines, func(i, j int) bool {
+		a, b := status.Routines[i], status.Routines[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Peer < b.Peer
+	})
+	return status
+}
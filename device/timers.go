@@ -8,6 +8,7 @@
 package device
 
 import (
+	"encoding/binary"
 	"math/rand"
 	"sync"
 	"sync/atomic"
@@ -74,12 +75,15 @@ func (timer *Timer) IsPending() bool {
 }
 
 func (peer *Peer) timersActive() bool {
-	return peer.isRunning.Get() && peer.device != nil && peer.device.isUp.Get() && len(peer.device.peers.keyMap) > 0
+	return peer.isRunning.Get() && peer.device != nil && peer.device.isUp.Get()
 }
 
 func expiredRetransmitHandshake(peer *Peer) {
-	if atomic.LoadUint32(&peer.timers.handshakeAttempts) > MaxTimerHandshakes {
-		peer.device.log.Debug.Printf("%s - Handshake did not complete after %d attempts, giving up\n", peer, MaxTimerHandshakes+2)
+	timeouts := peer.effectiveTimeouts()
+	maxAttempts := uint32(timeouts.RekeyAttemptTime / timeouts.RekeyTimeout)
+	if atomic.LoadUint32(&peer.timers.handshakeAttempts) > maxAttempts {
+		peer.device.log.Info.Printf("%s - Handshake did not complete after %d attempts, giving up\n", peer, maxAttempts+2)
+		peer.device.emitHandshakeEvent(peer, true)
 
 		if peer.timersActive() {
 			peer.timers.sendKeepalive.Del()
@@ -98,7 +102,7 @@ func expiredRetransmitHandshake(peer *Peer) {
 		}
 	} else {
 		atomic.AddUint32(&peer.timers.handshakeAttempts, 1)
-		peer.device.log.Debug.Printf("%s - Handshake did not complete after %d seconds, retrying (try %d)\n", peer, int(RekeyTimeout.Seconds()), atomic.LoadUint32(&peer.timers.handshakeAttempts)+1)
+		peer.device.log.Debug.Printf("%s - Handshake did not complete after %d seconds, retrying (try %d)\n", peer, int(timeouts.RekeyTimeout.Seconds()), atomic.LoadUint32(&peer.timers.handshakeAttempts)+1)
 
 		/* We clear the endpoint address src address, in case this is the cause of trouble. */
 		peer.Lock()
@@ -116,13 +120,13 @@ func expiredSendKeepalive(peer *Peer) {
 	if peer.timers.needAnotherKeepalive.Get() {
 		peer.timers.needAnotherKeepalive.Set(false)
 		if peer.timersActive() {
-			peer.timers.sendKeepalive.Mod(KeepaliveTimeout)
+			peer.timers.sendKeepalive.Mod(peer.keepaliveTimeout())
 		}
 	}
 }
 
 func expiredNewHandshake(peer *Peer) {
-	peer.device.log.Debug.Printf("%s - Retrying handshake because we stopped hearing back after %d seconds\n", peer, int((KeepaliveTimeout + RekeyTimeout).Seconds()))
+	peer.device.log.Debug.Printf("%s - Retrying handshake because we stopped hearing back after %d seconds\n", peer, int((peer.keepaliveTimeout() + peer.rekeyTimeout()).Seconds()))
 	/* We clear the endpoint address src address, in case this is the cause of trouble. */
 	peer.Lock()
 	if peer.endpoint != nil {
@@ -138,8 +142,59 @@ func expiredZeroKeyMaterial(peer *Peer) {
 	peer.ZeroAndFlushAll()
 }
 
+func expiredRekey(peer *Peer) {
+	keypair := peer.keypairs.Current()
+	if keypair == nil || !keypair.isInitiator || peer.device.now().Sub(keypair.created) < RekeyAfterTime {
+		return
+	}
+
+	/* An idle tunnel stays silent, the next packet sent will rekey it instead. */
+	if atomic.LoadUint64(&keypair.sendNonce) == 0 {
+		return
+	}
+	peer.device.log.Debug.Printf("%s - Rekeying, since the current keypair is %d seconds old\n", peer, int(RekeyAfterTime.Seconds()))
+	peer.SendHandshakeInitiation(false)
+}
+
+func expiredDisconnect(peer *Peer) {
+	peer.setConnected(false)
+}
+
+func expiredLiveness(peer *Peer) {
+	liveness := peer.Liveness()
+	if liveness.KeepaliveTimeout == 0 {
+		return
+	}
+	peer.device.log.Info.Printf("%s - Nothing received for %d seconds, considering peer dead\n", peer, int((liveness.KeepaliveTimeout + peer.rekeyTimeout()).Seconds()))
+	if liveness.ClearKeypairs {
+		peer.ZeroAndFlushAll()
+	} else {
+		peer.ExpireCurrentKeypairs()
+	}
+
+	/* The host of the endpoint, if given by name, may have moved. */
+	go peer.resolveEndpoint()
+
+	/* We clear the endpoint address src address, in case this is the cause of trouble. */
+	peer.Lock()
+	if peer.endpoint != nil {
+		peer.endpoint.ClearSrc()
+	}
+	peer.Unlock()
+	peer.SendHandshakeInitiation(false)
+}
+
+func expiredResolveEndpoint(peer *Peer) {
+	peer.resolve.Lock()
+	if peer.resolve.host != "" && peer.isRunning.Get() {
+		peer.timers.resolveEndpoint.Mod(peer.resolve.interval)
+	}
+	peer.resolve.Unlock()
+	go peer.resolveEndpoint()
+}
+
 func expiredPersistentKeepalive(peer *Peer) {
-	if peer.persistentKeepaliveInterval > 0 {
+	if peer.PersistentKeepaliveInterval() > 0 {
 		peer.SendKeepalive()
 	}
 }
@@ -147,7 +202,10 @@ func expiredPersistentKeepalive(peer *Peer) {
 /* Should be called after an authenticated data packet is sent. */
 func (peer *Peer) timersDataSent() {
 	if peer.timersActive() && !peer.timers.newHandshake.IsPending() {
-		peer.timers.newHandshake.Mod(KeepaliveTimeout + RekeyTimeout + time.Millisecond*time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs)))
+		peer.timers.newHandshake.Mod(peer.keepaliveTimeout() + peer.rekeyTimeout() + time.Millisecond*time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs)))
+	}
+	if timeout := peer.Liveness().KeepaliveTimeout; timeout > 0 && peer.timersActive() && !peer.timers.liveness.IsPending() {
+		peer.timers.liveness.Mod(timeout + peer.rekeyTimeout())
 	}
 }
 
@@ -155,7 +213,7 @@ func (peer *Peer) timersDataSent() {
 func (peer *Peer) timersDataReceived() {
 	if peer.timersActive() {
 		if !peer.timers.sendKeepalive.IsPending() {
-			peer.timers.sendKeepalive.Mod(KeepaliveTimeout)
+			peer.timers.sendKeepalive.Mod(peer.keepaliveTimeout())
 		} else {
 			peer.timers.needAnotherKeepalive.Set(true)
 		}
@@ -173,13 +231,22 @@ func (peer *Peer) timersAnyAuthenticatedPacketSent() {
 func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
 	if peer.timersActive() {
 		peer.timers.newHandshake.Del()
+		peer.timers.liveness.Del()
+	}
+}
+
+/* Should be called after an authenticated transport packet, data or keepalive, is received. */
+func (peer *Peer) timersTransportPacketReceived() {
+	if peer.timersActive() {
+		peer.timers.disconnect.Mod(peer.Callbacks().DisconnectTimeout)
+		peer.setConnected(true)
 	}
 }
 
 /* Should be called after a handshake initiation message is sent. */
 func (peer *Peer) timersHandshakeInitiated() {
 	if peer.timersActive() {
-		peer.timers.retransmitHandshake.Mod(RekeyTimeout + time.Millisecond*time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs)))
+		peer.timers.retransmitHandshake.Mod(peer.rekeyTimeout() + time.Millisecond*time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs)))
 	}
 }
 
@@ -187,10 +254,13 @@ func (peer *Peer) timersHandshakeInitiated() {
 func (peer *Peer) timersHandshakeComplete() {
 	if peer.timersActive() {
 		peer.timers.retransmitHandshake.Del()
+		peer.timers.rekey.Mod(RekeyAfterTime)
 	}
 	atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
 	peer.timers.sentLastMinuteHandshake.Set(false)
 	atomic.StoreInt64(&peer.stats.lastHandshakeNano, time.Now().UnixNano())
+	atomic.AddUint64(&peer.stats.handshakesCompleted, 1)
+	peer.device.emitHandshakeEvent(peer, false)
 }
 
 /* Should be called after an ephemeral key is created, which is before sending a handshake response or after receiving a handshake response. */
@@ -202,9 +272,28 @@ func (peer *Peer) timersSessionDerived() {
 
 /* Should be called before a packet with authentication -- keepalive, data, or handshake -- is sent, or after one is received. */
 func (peer *Peer) timersAnyAuthenticatedPacketTraversal() {
-	if peer.persistentKeepaliveInterval > 0 && peer.timersActive() {
-		peer.timers.persistentKeepalive.Mod(time.Duration(peer.persistentKeepaliveInterval) * time.Second)
+	keepalive := peer.PersistentKeepaliveInterval()
+	if keepalive > 0 && peer.timersActive() {
+		peer.timers.persistentKeepalive.Mod(peer.persistentKeepaliveDelay(keepalive))
+	}
+}
+
+/* Returns the delay of the next persistent keepalive: the interval less
+ * up to PersistentKeepaliveJitter, or a quarter of short intervals
+ *
+ * Keepalives are only ever sent early, never after the interval, so NAT
+ * mappings sized to the interval do not expire. The advance is derived
+ * from the public key of the peer, so it is stable for each peer while
+ * many peers sharing an interval do not all send their keepalives at once.
+ */
+func (peer *Peer) persistentKeepaliveDelay(keepalive uint16) time.Duration {
+	interval := time.Duration(keepalive) * time.Second
+	jitter := PersistentKeepaliveJitter
+	if jitter > interval/4 {
+		jitter = interval / 4
 	}
+	seed := binary.LittleEndian.Uint64(peer.handshake.remoteStatic[:8])
+	return interval - time.Duration(seed%uint64(jitter+1))
 }
 
 func (peer *Peer) timersInit() {
@@ -213,6 +302,10 @@ func (peer *Peer) timersInit() {
 	peer.timers.newHandshake = peer.NewTimer(expiredNewHandshake)
 	peer.timers.zeroKeyMaterial = peer.NewTimer(expiredZeroKeyMaterial)
 	peer.timers.persistentKeepalive = peer.NewTimer(expiredPersistentKeepalive)
+	peer.timers.rekey = peer.NewTimer(expiredRekey)
+	peer.timers.disconnect = peer.NewTimer(expiredDisconnect)
+	peer.timers.resolveEndpoint = peer.NewTimer(expiredResolveEndpoint)
+	peer.timers.liveness = peer.NewTimer(expiredLiveness)
 	atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
 	peer.timers.sentLastMinuteHandshake.Set(false)
 	peer.timers.needAnotherKeepalive.Set(false)
@@ -224,4 +317,8 @@ func (peer *Peer) timersStop() {
 	peer.timers.newHandshake.DelSync()
 	peer.timers.zeroKeyMaterial.DelSync()
 	peer.timers.persistentKeepalive.DelSync()
+	peer.timers.rekey.DelSync()
+	peer.timers.disconnect.DelSync()
+	peer.timers.resolveEndpoint.DelSync()
+	peer.timers.liveness.DelSync()
 }
@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Enables transit mode, in which packets received from a peer whose
+ * destination is routed to another peer are encrypted and sent to that
+ * peer directly, without passing through the TUN device, as a hub
+ * relaying between its peers does; by default all packets received are
+ * written to the TUN device
+ *
+ * Packets routed to the peer they came from, or to no peer at all, are
+ * still written to the TUN device, which a relay may leave unconnected,
+ * see tuntest.SinkTUN.
+ */
+func (device *Device) SetTransit(enable bool) {
+	device.transit.Set(enable)
+}
+
+/* Forwards a decrypted packet to the peer its destination is routed to,
+ * if that is another peer than the one it came from, and reports whether
+ * the packet was taken, even if the peer was stopped and it was dropped
+ */
+func (device *Device) forwardTransit(packet []byte, from *Peer) bool {
+	var to *Peer
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		to = device.allowedips.LookupIPv4(packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len])
+	case ipv6.Version:
+		to = device.allowedips.LookupIPv6(packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len])
+	}
+	if to == nil || to == from {
+		return false
+	}
+
+	// the outbound element owns a copy, the inbound buffer is recycled
+
+	elem := device.NewOutboundElement()
+	offset := MessageTransportHeaderSize
+	elem.packet = elem.buffer[offset : offset+copy(elem.buffer[offset:], packet)]
+	if device.net.inheritDSCP.Get() {
+		elem.tos = innerDSCP(packet)
+	}
+	if !to.stagePacket(elem) {
+		device.PutMessageBuffer(elem.buffer)
+		device.PutOutboundElement(elem)
+		return true
+	}
+	atomic.AddUint64(&device.stats.forwarded, 1)
+	return true
+}
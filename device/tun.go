@@ -6,51 +6,166 @@
 package device
 
 import (
+	"errors"
+	"os"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"golang.zx2c4.com/wireguard/tun"
 )
 
 const DefaultMTU = 1420
 
+/* Errors writing to the TUN device which clear up once the kernel has
+ * drained its queues
+ */
+func isTransientTUNWriteError(err error) bool {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EINTR, syscall.EAGAIN, syscall.ENOBUFS, syscall.ENOMEM:
+			return true
+		}
+	}
+	return false
+}
+
+/* Errors writing to the TUN device which mean it is gone for good
+ */
+func isClosedTUNError(err error) bool {
+	return errors.Is(err, os.ErrClosed) || errors.Is(err, syscall.EBADF)
+}
+
+func (device *Device) tunDevice() tun.Device {
+	device.tun.RLock()
+	defer device.tun.RUnlock()
+	return device.tun.device
+}
+
+/* Replaces the TUN device, for instance after a resume from suspend has
+ * invalidated the one in use, taking over its MTU
+ *
+ * The TUN reader, event reader and writers move on to the new device,
+ * and packets being written to the old one are written to the new one
+ * instead. The old device is closed; the device owns the new one, unless
+ * an error is returned.
+ */
+func (device *Device) SetTUN(tunDevice tun.Device) error {
+	mtu, err := tunDevice.MTU()
+	if err != nil {
+		return err
+	}
+
+	device.state.Lock()
+	defer device.state.Unlock()
+
+	if device.isClosed.Get() {
+		return errors.New("device closed")
+	}
+
+	device.tun.Lock()
+	old := device.tun.device
+	device.tun.device = tunDevice
+	device.tun.Unlock()
+
+	atomic.StoreInt32(&device.tun.mtu, int32(mtu))
+	device.log.Info.Println("TUN device replaced, MTU:", mtu)
+
+	// the routines notice the replacement once the old device fails them
+
+	if err := old.Close(); err != nil {
+		device.log.Error.Println("Failed to close replaced TUN device:", err)
+	}
+	return nil
+}
+
+/* Writes a packet to the TUN device, retrying a few times with a short
+ * backoff while the device is too busy to take it
+ *
+ * Packets dropped after the last retry and those failing otherwise are
+ * counted separately.
+ */
+func (device *Device) writeToTUN(buffer []byte, offset int) error {
+	backoff := tunWriteBackoffMin
+	tunDevice := device.tunDevice()
+	for attempt := 0; ; attempt++ {
+		_, err := tunDevice.Write(buffer, offset)
+		if err == nil {
+			return nil
+		}
+
+		// a packet in flight while the TUN device was replaced goes to the new one
+
+		if replaced := device.tunDevice(); replaced != tunDevice {
+			tunDevice = replaced
+			continue
+		}
+		if !isTransientTUNWriteError(err) {
+			atomic.AddUint64(&device.stats.tunWriteFailed, 1)
+			return err
+		}
+		if attempt == tunWriteRetries || device.isClosed.Get() {
+			atomic.AddUint64(&device.stats.tunWriteExhausted, 1)
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
 func (device *Device) RoutineTUNEventReader() {
 	setUp := false
 	logDebug := device.log.Debug
 	logInfo := device.log.Info
 	logError := device.log.Error
 
+	beat := device.startHeartbeat("event worker", nil)
+
 	logDebug.Println("Routine: event worker - started")
 	device.state.starting.Done()
 
-	for event := range device.tun.device.Events() {
-		if event&tun.EventMTUUpdate != 0 {
-			mtu, err := device.tun.device.MTU()
-			old := atomic.LoadInt32(&device.tun.mtu)
-			if err != nil {
-				logError.Println("Failed to load updated MTU of device:", err)
-			} else if int(old) != mtu {
-				if mtu+MessageTransportSize > MaxMessageSize {
-					logInfo.Println("MTU updated:", mtu, "(too large)")
-				} else {
-					logInfo.Println("MTU updated:", mtu)
+	for {
+		tunDevice := device.tunDevice()
+		for event := range tunDevice.Events() {
+			beat.beat()
+			if event&tun.EventMTUUpdate != 0 {
+				mtu, err := tunDevice.MTU()
+				old := atomic.LoadInt32(&device.tun.mtu)
+				if err != nil {
+					logError.Println("Failed to load updated MTU of device:", err)
+				} else if int(old) != mtu {
+					if mtu+MessageTransportSize > MaxMessageSize {
+						logInfo.Println("MTU updated:", mtu, "(too large)")
+					} else {
+						logInfo.Println("MTU updated:", mtu)
+					}
+					atomic.StoreInt32(&device.tun.mtu, int32(mtu))
 				}
-				atomic.StoreInt32(&device.tun.mtu, int32(mtu))
 			}
-		}
 
-		if event&tun.EventUp != 0 && !setUp {
-			logInfo.Println("Interface set up")
-			setUp = true
-			device.Up()
+			if event&tun.EventUp != 0 && !setUp {
+				logInfo.Println("Interface set up")
+				setUp = true
+				device.Up()
+			}
+
+			if event&tun.EventDown != 0 && setUp {
+				logInfo.Println("Interface set down")
+				setUp = false
+				device.Down()
+			}
 		}
 
-		if event&tun.EventDown != 0 && setUp {
-			logInfo.Println("Interface set down")
-			setUp = false
-			device.Down()
+		// the events of a replaced TUN device end once it is closed,
+		// those of the new one follow
+
+		if device.tunDevice() == tunDevice {
+			break
 		}
 	}
 
+	device.stopHeartbeat(beat)
 	logDebug.Println("Routine: event worker - stopped")
 	device.state.stopping.Done()
 }
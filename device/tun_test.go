@@ -6,10 +6,19 @@
 package device
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"net"
 	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
 
+	"golang.org/x/net/ipv4"
 	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
 )
 
 // newDummyTUN creates a dummy TUN device with the specified name.
@@ -54,3 +63,133 @@ func (d *dummyTUN) Write(b []byte, offset int) (int, error) {
 	d.packets <- b[offset:]
 	return len(b), nil
 }
+
+// A failingTUN fails writes with queued errors before passing them on.
+type failingTUN struct {
+	tun.Device
+	mutex sync.Mutex
+	errs  []error
+}
+
+func (f *failingTUN) fail(errs ...error) {
+	f.mutex.Lock()
+	f.errs = append(f.errs, errs...)
+	f.mutex.Unlock()
+}
+
+func (f *failingTUN) Write(b []byte, offset int) (int, error) {
+	f.mutex.Lock()
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		f.mutex.Unlock()
+		return 0, err
+	}
+	f.mutex.Unlock()
+	return f.Device.Write(b, offset)
+}
+
+func TestTUNWriteRetries(t *testing.T) {
+	channelTUN := tuntest.NewChannelTUN()
+	tun := &failingTUN{Device: channelTUN.TUN()}
+	device := NewDevice(tun, NewLogger(LogLevelSilent, ""))
+	defer device.Close()
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(t, device, remote)
+	keypair := newTestKeypair(t)
+
+	counter := uint64(0)
+	deliver := func(packet []byte) {
+		queueTransportPacket(device, peer, keypair, counter, packet)
+		counter++
+	}
+	expect := func(packet []byte) {
+		t.Helper()
+		select {
+		case received := <-channelTUN.Inbound:
+			if !bytes.Equal(received, packet) {
+				t.Fatalf("received %q, expected %q", received, packet)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q not written to TUN device", packet)
+		}
+	}
+
+	// a busy device takes the packet after a retry
+
+	tun.fail(syscall.EAGAIN, syscall.ENOBUFS)
+	busy := testIPv4Packet(remote, local, []byte("busy"))
+	deliver(busy)
+	expect(busy)
+
+	// one that stays busy, or fails, drops it
+
+	for i := 0; i <= tunWriteRetries; i++ {
+		tun.fail(syscall.ENOBUFS)
+	}
+	deliver(testIPv4Packet(remote, local, []byte("exhausted")))
+	tun.fail(syscall.EINVAL)
+	deliver(testIPv4Packet(remote, local, []byte("failed")))
+	after := testIPv4Packet(remote, local, []byte("after"))
+	deliver(after)
+	expect(after)
+	if stats := device.Stats(); stats.TUNWriteExhausted != 1 || stats.TUNWriteFailed != 1 {
+		t.Fatalf("got %d exhausted and %d failed writes, expected one each", stats.TUNWriteExhausted, stats.TUNWriteFailed)
+	}
+
+	// a closed device stops the receiver rather than failing every packet
+
+	tun.fail(os.ErrClosed)
+	deliver(testIPv4Packet(remote, local, []byte("closed")))
+	deliver(testIPv4Packet(remote, local, []byte("ignored")))
+	select {
+	case packet := <-channelTUN.Inbound:
+		t.Fatalf("%q written after the TUN device closed", packet)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestParallelTUNWriters(t *testing.T) {
+	channelTUN := tuntest.NewChannelTUN()
+	device, err := NewDeviceWithOptions(channelTUN.TUN(), NewLogger(LogLevelError, ""), DeviceOptions{TUNWriters: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	local := net.IPv4(1, 0, 0, 1)
+	remote := net.IPv4(1, 0, 0, 2)
+	peer := newTestPeer(t, device, remote)
+	keypair := newTestKeypair(t)
+
+	// interleave the datagrams of several flows, numbered within each
+
+	const flows, datagrams = 8, 50
+	for i := 0; i < flows*datagrams; i++ {
+		udp := make([]byte, udpHeaderLen+2)
+		binary.BigEndian.PutUint16(udp[0:], uint16(1000+i%flows))
+		binary.BigEndian.PutUint16(udp[2:], 53)
+		binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+		binary.BigEndian.PutUint16(udp[udpHeaderLen:], uint16(i/flows))
+		packet := testIPv4Packet(remote, local, udp)
+		packet[9] = udpProtocolNumber
+		queueTransportPacket(device, peer, keypair, uint64(i), packet)
+	}
+
+	next := make(map[uint16]uint16)
+	for i := 0; i < flows*datagrams; i++ {
+		select {
+		case packet := <-channelTUN.Inbound:
+			port := binary.BigEndian.Uint16(packet[ipv4.HeaderLen:])
+			number := binary.BigEndian.Uint16(packet[ipv4.HeaderLen+udpHeaderLen:])
+			if number != next[port] {
+				t.Fatalf("flow %d: got datagram %d, expected %d", port, number, next[port])
+			}
+			next[port]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d datagrams written", i, flows*datagrams)
+		}
+	}
+}
@@ -87,7 +87,21 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) error {
 			send(fmt.Sprintf("last_handshake_time_nsec=%d", nano))
 			send(fmt.Sprintf("tx_bytes=%d", atomic.LoadUint64(&peer.stats.txBytes)))
 			send(fmt.Sprintf("rx_bytes=%d", atomic.LoadUint64(&peer.stats.rxBytes)))
-			send(fmt.Sprintf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval))
+			send(fmt.Sprintf("persistent_keepalive_interval=%d", peer.PersistentKeepaliveInterval()))
+
+			timeouts := peer.Timeouts()
+			if timeouts.RekeyTimeout != 0 {
+				send(fmt.Sprintf("rekey_timeout=%d", int64(timeouts.RekeyTimeout/time.Second)))
+			}
+			if timeouts.KeepaliveTimeout != 0 {
+				send(fmt.Sprintf("keepalive_timeout=%d", int64(timeouts.KeepaliveTimeout/time.Second)))
+			}
+			if timeouts.RekeyAttemptTime != 0 {
+				send(fmt.Sprintf("rekey_attempt_time=%d", int64(timeouts.RekeyAttemptTime/time.Second)))
+			}
+			if peer.EndpointPinned() {
+				send("pin_endpoint=true")
+			}
 
 			for _, ip := range device.allowedips.EntriesForPeer(peer) {
 				send("allowed_ip=" + ip.String())
@@ -119,6 +133,23 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 	createdNewPeer := false
 	deviceConfig := true
 
+	// the timeouts of a peer depend on each other, so those given are
+	// validated together and applied at the end of the block of the peer
+
+	var timeouts *PeerTimeouts
+	setTimeouts := func() error {
+		if timeouts == nil {
+			return nil
+		}
+		err := peer.SetTimeouts(*timeouts)
+		timeouts = nil
+		if err != nil {
+			logError.Println(peer, "- Failed to set timeouts:", err)
+			return &IPCError{ipc.IpcErrorInvalid}
+		}
+		return nil
+	}
+
 	for scanner.Scan() {
 
 		// parse line
@@ -127,7 +158,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 		device.log.Info.Println("Configuring via UAPI:", line)
 
 		if line == "" {
-			return nil
+			return setTimeouts()
 		}
 		parts := strings.Split(line, "=")
 		if len(parts) != 2 {
@@ -165,11 +196,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 
 				logDebug.Println("UAPI: Updating listen port")
 
-				device.net.Lock()
-				device.net.port = uint16(port)
-				device.net.Unlock()
-
-				if err := device.BindUpdate(); err != nil {
+				if err := device.SetListenPort(uint16(port)); err != nil {
 					logError.Println("Failed to set listen_port:", err)
 					return &IPCError{ipc.IpcErrorPortInUse}
 				}
@@ -224,6 +251,10 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 			switch key {
 
 			case "public_key":
+				if err := setTimeouts(); err != nil {
+					return err
+				}
+
 				var publicKey NoisePublicKey
 				err := publicKey.FromHex(value)
 				if err != nil {
@@ -270,6 +301,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 					device.RemovePeer(peer.handshake.remoteStatic)
 					peer = &Peer{}
 					dummy = true
+					timeouts = nil
 				}
 
 			case "remove":
@@ -286,6 +318,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 				}
 				peer = &Peer{}
 				dummy = true
+				timeouts = nil
 
 			case "preshared_key":
 
@@ -293,14 +326,12 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 
 				logDebug.Println(peer, "- UAPI: Updating preshared key")
 
-				peer.handshake.mutex.Lock()
-				err := peer.handshake.presharedKey.FromHex(value)
-				peer.handshake.mutex.Unlock()
-
-				if err != nil {
+				var psk NoiseSymmetricKey
+				if err := psk.FromHex(value); err != nil {
 					logError.Println("Failed to set preshared key:", err)
 					return &IPCError{ipc.IpcErrorInvalid}
 				}
+				peer.SetPresharedKey(psk)
 
 			case "endpoint":
 
@@ -311,13 +342,25 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 				err := func() error {
 					peer.Lock()
 					defer peer.Unlock()
-					endpoint, err := conn.CreateEndpoint(value)
+					create := conn.CreateEndpoint
+					if strings.HasPrefix(value, conn.TCPEndpointPrefix) {
+						create = conn.CreateTCPEndpoint
+					}
+					endpoint, err := create(value)
 					if err != nil {
 						return err
 					}
 					peer.endpoint = endpoint
 					return nil
 				}()
+				if err == nil {
+					peer.clearEndpointHost()
+				} else {
+
+					// not an address, but maybe a host name to resolve
+
+					err = peer.SetEndpointHost(value, 0)
+				}
 
 				if err != nil {
 					logError.Println("Failed to set endpoint:", err, ":", value)
@@ -336,19 +379,51 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 					return &IPCError{ipc.IpcErrorInvalid}
 				}
 
-				old := peer.persistentKeepaliveInterval
-				peer.persistentKeepaliveInterval = uint16(secs)
+				if !dummy {
+					peer.SetPersistentKeepaliveInterval(uint16(secs))
+				}
 
-				// send immediate keepalive if we're turning it on and before it wasn't on
+			case "rekey_timeout", "keepalive_timeout", "rekey_attempt_time":
 
-				if old == 0 && secs != 0 {
-					if err != nil {
-						logError.Println("Failed to get tun device status:", err)
-						return &IPCError{ipc.IpcErrorIO}
-					}
-					if device.isUp.Get() && !dummy {
-						peer.SendKeepalive()
-					}
+				// override a timer, zero restoring the default
+
+				logDebug.Println(peer, "- UAPI: Updating", key)
+
+				secs, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					logError.Println("Failed to set", key+":", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				if dummy {
+					continue
+				}
+
+				if timeouts == nil {
+					current := peer.Timeouts()
+					timeouts = &current
+				}
+				timeout := time.Duration(secs) * time.Second
+				switch key {
+				case "rekey_timeout":
+					timeouts.RekeyTimeout = timeout
+				case "keepalive_timeout":
+					timeouts.KeepaliveTimeout = timeout
+				default:
+					timeouts.RekeyAttemptTime = timeout
+				}
+
+			case "pin_endpoint":
+
+				logDebug.Println(peer, "- UAPI: Updating endpoint pinning")
+
+				if value != "true" && value != "false" {
+					logError.Println("Failed to set endpoint pinning, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				if !dummy {
+					peer.SetEndpointPinned(value == "true")
 				}
 
 			case "replace_allowed_ips":
@@ -397,7 +472,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 		}
 	}
 
-	return nil
+	return setTimeouts()
 }
 
 func (device *Device) IpcHandle(socket net.Conn) {
@@ -17,6 +17,7 @@ const (
 	garbageCollectTime = time.Second
 	packetCost         = 1000000000 / packetsPerSecond
 	maxTokens          = packetCost * packetsBurstable
+	ipv6PrefixLen      = 8 // IPv6 sources are limited per /64 prefix
 )
 
 type RatelimiterEntry struct {
@@ -31,7 +32,7 @@ type Ratelimiter struct {
 
 	stopReset chan struct{} // send to reset, close to stop
 	tableIPv4 map[[net.IPv4len]byte]*RatelimiterEntry
-	tableIPv6 map[[net.IPv6len]byte]*RatelimiterEntry
+	tableIPv6 map[[ipv6PrefixLen]byte]*RatelimiterEntry
 }
 
 func (rate *Ratelimiter) Close() {
@@ -58,7 +59,7 @@ func (rate *Ratelimiter) Init() {
 
 	rate.stopReset = make(chan struct{})
 	rate.tableIPv4 = make(map[[net.IPv4len]byte]*RatelimiterEntry)
-	rate.tableIPv6 = make(map[[net.IPv6len]byte]*RatelimiterEntry)
+	rate.tableIPv6 = make(map[[ipv6PrefixLen]byte]*RatelimiterEntry)
 
 	stopReset := rate.stopReset // store in case Init is called again.
 
@@ -106,10 +107,14 @@ func (rate *Ratelimiter) cleanup() (empty bool) {
 	return len(rate.tableIPv4) == 0 && len(rate.tableIPv6) == 0
 }
 
+// Allow reports whether a packet from ip is within the rate limit.
+//
+// IPv6 sources are bucketed by their /64 prefix, since a single host
+// is commonly able to use any address of its prefix.
 func (rate *Ratelimiter) Allow(ip net.IP) bool {
 	var entry *RatelimiterEntry
 	var keyIPv4 [net.IPv4len]byte
-	var keyIPv6 [net.IPv6len]byte
+	var keyIPv6 [ipv6PrefixLen]byte
 
 	// lookup entry
 
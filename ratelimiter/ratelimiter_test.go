@@ -117,3 +117,41 @@ func TestRatelimiter(t *testing.T) {
 		}
 	}
 }
+
+func TestRatelimiterIPv6Prefix(t *testing.T) {
+	var rate Ratelimiter
+
+	now := time.Now()
+	rate.timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		// Lock to avoid data race with cleanup goroutine from Init.
+		rate.mu.Lock()
+		defer rate.mu.Unlock()
+
+		rate.timeNow = time.Now
+	}()
+
+	rate.Init()
+	defer rate.Close()
+
+	// exhaust the bucket using addresses within the same /64
+
+	for i := 0; i < packetsBurstable; i++ {
+		now = now.Add(1)
+		ip := net.ParseIP("2001:db8:0:1::1")
+		ip[15] = byte(i)
+		if !rate.Allow(ip) {
+			t.Fatalf("%d: packet within initial burst denied", i)
+		}
+	}
+
+	if rate.Allow(net.ParseIP("2001:db8:0:1:ffff::1")) {
+		t.Fatal("address within the same /64 not limited")
+	}
+
+	if !rate.Allow(net.ParseIP("2001:db8:0:2::1")) {
+		t.Fatal("address within another /64 limited")
+	}
+}
@@ -5,10 +5,15 @@
 
 package replay
 
+import (
+	"sync/atomic"
+)
+
 /* Implementation of RFC6479
  * https://tools.ietf.org/html/rfc6479
  *
- * The implementation is not safe for concurrent use!
+ * The implementation is not safe for concurrent use,
+ * except for IsStale, which may race with ValidateCounter!
  */
 
 const (
@@ -37,12 +42,25 @@ func minUint64(a uint64, b uint64) uint64 {
 }
 
 type ReplayFilter struct {
-	counter   uint64
-	backtrack [BacktrackWords]uintptr
+	counter   uint64 // accessed atomically, must stay 64-bit aligned
+	window    uint64 // how far behind the latest counter others are accepted
+	backtrack []uintptr
 }
 
 func (filter *ReplayFilter) Init() {
+	filter.InitWindow(CounterWindowSize)
+}
+
+/* Initializes the filter with a window of the given size, which must be
+ * a positive multiple of 64; wider windows tolerate more reordering
+ */
+func (filter *ReplayFilter) InitWindow(size uint64) {
+	words := int(size/CounterRedundantBits) + 1
+	if len(filter.backtrack) != words {
+		filter.backtrack = make([]uintptr, words)
+	}
 	filter.counter = 0
+	filter.window = size
 	filter.backtrack[0] = 0
 }
 
@@ -57,21 +75,22 @@ func (filter *ReplayFilter) ValidateCounter(counter uint64, limit uint64) bool {
 
 		// move window forward
 
+		words := uint64(len(filter.backtrack))
 		current := filter.counter >> CounterRedundantBitsLog
-		diff := minUint64(indexWord-current, BacktrackWords)
+		diff := minUint64(indexWord-current, words)
 		for i := uint64(1); i <= diff; i++ {
-			filter.backtrack[(current+i)%BacktrackWords] = 0
+			filter.backtrack[(current+i)%words] = 0
 		}
-		filter.counter = counter
+		atomic.StoreUint64(&filter.counter, counter)
 
-	} else if filter.counter-counter > CounterWindowSize {
+	} else if filter.counter-counter > filter.window {
 
 		// behind current window
 
 		return false
 	}
 
-	indexWord %= BacktrackWords
+	indexWord %= uint64(len(filter.backtrack))
 	indexBit := counter & uint64(CounterRedundantBits-1)
 
 	// check and set bit
@@ -81,3 +100,38 @@ func (filter *ReplayFilter) ValidateCounter(counter uint64, limit uint64) bool {
 	filter.backtrack[indexWord] = newValue
 	return oldValue != newValue
 }
+
+/* Cheaply reports whether the counter is behind the window,
+ * without updating the filter
+ *
+ * The window only ever moves forward, so a stale counter remains stale;
+ * a counter which is not stale must still pass ValidateCounter.
+ */
+func (filter *ReplayFilter) IsStale(counter uint64) bool {
+	last := atomic.LoadUint64(&filter.counter)
+	return counter < last && last-counter > filter.window
+}
+
+/* Returns the latest counter validated
+ */
+func (filter *ReplayFilter) Latest() uint64 {
+	return atomic.LoadUint64(&filter.counter)
+}
+
+/* Reinitializes the filter as if every counter up to and including latest
+ * had been validated, so that a session can be continued from there on
+ * another host: counters which were not seen are rejected as well, rather
+ * than risking to accept a replay
+ */
+func (filter *ReplayFilter) Restore(latest uint64) {
+	for i := range filter.backtrack {
+		filter.backtrack[i] = ^uintptr(0)
+	}
+
+	// counters past the latest are yet to come
+
+	indexWord := (latest >> CounterRedundantBitsLog) % uint64(len(filter.backtrack))
+	indexBit := latest & uint64(CounterRedundantBits-1)
+	filter.backtrack[indexWord] = uintptr(2)<<indexBit - 1
+	atomic.StoreUint64(&filter.counter, latest)
+}
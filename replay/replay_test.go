@@ -117,3 +117,90 @@ func TestReplay(t *testing.T) {
 	T(0, true)
 	T(CounterWindowSize+1, true)
 }
+
+func TestIsStale(t *testing.T) {
+	var filter ReplayFilter
+	filter.Init()
+
+	if filter.IsStale(0) {
+		t.Fatal("counter stale in empty filter")
+	}
+
+	filter.ValidateCounter(CounterWindowSize*2, RejectAfterMessages)
+
+	for _, n := range []uint64{0, CounterWindowSize - 1, CounterWindowSize, CounterWindowSize + 1, CounterWindowSize * 3} {
+		stale := filter.IsStale(n)
+		if stale && filter.ValidateCounter(n, RejectAfterMessages) {
+			t.Fatal("stale counter", n, "accepted by filter")
+		}
+		if stale != (n < CounterWindowSize) {
+			t.Fatal("counter", n, "stale:", stale)
+		}
+	}
+}
+
+func TestReplayWindowSize(t *testing.T) {
+	for _, window := range []uint64{64, 128, 2048, 16384} {
+		var filter ReplayFilter
+		filter.InitWindow(window)
+
+		// reversing blocks of the window size reorders across its boundary,
+		// yet every counter stays within the window
+
+		const blocks = 5
+		for block := uint64(0); block < blocks; block++ {
+			for i := window; i > 0; i-- {
+				counter := block*window + i
+				if !filter.ValidateCounter(counter, RejectAfterMessages) {
+					t.Fatalf("window %d: counter %d rejected", window, counter)
+				}
+			}
+		}
+		latest := blocks * window
+		if filter.ValidateCounter(latest-1, RejectAfterMessages) {
+			t.Fatalf("window %d: replayed counter %d accepted", window, latest-1)
+		}
+
+		// the far edge of the window is still accepted, beyond it is not
+
+		latest += 2 * window
+		if !filter.ValidateCounter(latest, RejectAfterMessages) {
+			t.Fatalf("window %d: counter %d rejected", window, latest)
+		}
+		if filter.IsStale(latest - window) {
+			t.Fatalf("window %d: edge of window stale", window)
+		}
+		if !filter.ValidateCounter(latest-window, RejectAfterMessages) {
+			t.Fatalf("window %d: edge of window rejected", window)
+		}
+		if !filter.IsStale(latest - window - 1) {
+			t.Fatalf("window %d: counter behind window not stale", window)
+		}
+		if filter.ValidateCounter(latest-window-1, RejectAfterMessages) {
+			t.Fatalf("window %d: counter behind window accepted", window)
+		}
+	}
+}
+
+func TestRestore(t *testing.T) {
+	for _, latest := range []uint64{0, 62, 63, 64, CounterWindowSize, CounterWindowSize*3 + 17} {
+		var filter ReplayFilter
+		filter.Init()
+		filter.ValidateCounter(latest+5, RejectAfterMessages)
+		filter.Restore(latest)
+
+		if filter.Latest() != latest {
+			t.Fatalf("restored to %d, latest %d", latest, filter.Latest())
+		}
+		for _, n := range []uint64{0, latest / 2, latest} {
+			if filter.ValidateCounter(n, RejectAfterMessages) {
+				t.Fatalf("restored to %d: counter %d accepted", latest, n)
+			}
+		}
+		for _, n := range []uint64{latest + 1, latest + 3, latest + 2, latest + 64, latest + 65} {
+			if !filter.ValidateCounter(n, RejectAfterMessages) {
+				t.Fatalf("restored to %d: counter %d rejected", latest, n)
+			}
+		}
+	}
+}
@@ -27,3 +27,8 @@ type Device interface {
 	Events() chan Event             // returns a constant channel of events related to the device
 	Close() error                   // stops the device and closes the event channel
 }
+
+// MTUSetter is implemented by devices whose MTU can be changed.
+type MTUSetter interface {
+	SetMTU(mtu int) error // sets the MTU of the device
+}
@@ -219,7 +219,7 @@ func CreateTUNFromFile(file *os.File, mtu int) (Device, error) {
 	go tun.routineRouteListener(tunIfindex)
 
 	if mtu > 0 {
-		err = tun.setMTU(mtu)
+		err = tun.SetMTU(mtu)
 		if err != nil {
 			tun.Close()
 			return nil, err
@@ -319,7 +319,7 @@ func (tun *NativeTun) Close() error {
 	return err2
 }
 
-func (tun *NativeTun) setMTU(n int) error {
+func (tun *NativeTun) SetMTU(n int) error {
 
 	// open datagram socket
 
@@ -183,7 +183,7 @@ func CreateTUNFromFile(file *os.File, mtu int) (Device, error) {
 
 	currentMTU, err := tun.MTU()
 	if err != nil || currentMTU != mtu {
-		err = tun.setMTU(mtu)
+		err = tun.SetMTU(mtu)
 		if err != nil {
 			tun.Close()
 			return nil, err
@@ -270,7 +270,7 @@ func (tun *NativeTun) Close() error {
 	return err2
 }
 
-func (tun *NativeTun) setMTU(n int) error {
+func (tun *NativeTun) SetMTU(n int) error {
 	// open datagram socket
 
 	var fd int